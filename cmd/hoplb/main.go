@@ -2,50 +2,125 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"hoplb/internal/admin"
 	"hoplb/internal/lb"
 	"hoplb/internal/metrics"
+	"hoplb/internal/tracing"
 )
 
 func main() {
 	listenAddr := flag.String("listen", ":80", "Address to listen on for HTTP traffic")
-	adminAddr := flag.String("admin-listen", ":9091", "Address to listen on for admin endpoints (/health, /metrics)")
+	tlsAddr := flag.String("tls-listen", "", "Address to listen on for HTTPS traffic (e.g., :443); empty disables")
+	tlsCert := flag.String("tls-cert", "", "Certificate file for -tls-listen")
+	tlsKey := flag.String("tls-key", "", "Private key file for -tls-cert")
+	adminAddr := flag.String("admin-listen", ":9091", "Address to listen on for admin endpoints (/health, /metrics, ...)")
 	agentAddr := flag.String("agent", "http://127.0.0.1:8080", "Local hop agent address")
 	tagFilter := flag.String("tag", "", "Only route jobs with this tag (e.g., lb:haas)")
 	apiKey := flag.String("api-key", "", "API key for hop agent authentication")
+	trustedProxies := flag.String("trusted-proxies", "", "Comma-separated CIDRs whose X-Forwarded-For is trusted for the client IP (e.g., 10.0.0.0/8)")
+	fallbackJob := flag.String("fallback-job", "", "Job serving hosts that no route matches")
+	errorPages := flag.String("error-pages", "", "Directory of error page templates (404.html, 503.json, error.html, ...)")
+	forwardAuthURL := flag.String("forward-auth-url", "", "Auth endpoint for jobs tagged hoplb-forward-auth=true")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "OTLP/HTTP collector for traces (e.g., http://otel-collector:4318); empty disables tracing")
+	traceRatio := flag.Float64("trace-sample-ratio", 1.0, "Fraction of new traces to sample (0.0-1.0)")
+	traceKeepErrors := flag.Bool("trace-keep-errors", true, "Also export unsampled spans of failed (5xx) requests")
+	pushURL := flag.String("push-url", "", "Push metrics to this URL instead of (or besides) being scraped; empty disables")
+	pushFormat := flag.String("push-format", metrics.PushOTLP, "Push format: otlp (OTLP/HTTP JSON) or remote-write (Prometheus)")
+	pushInterval := flag.Duration("push-interval", 15*time.Second, "Interval between metric pushes")
+	adminTokenFile := flag.String("admin-token-file", "", "File holding a bearer token required on the admin listener")
+	adminTLSCert := flag.String("admin-tls-cert", "", "Certificate file; serves the admin listener over HTTPS")
+	adminTLSKey := flag.String("admin-tls-key", "", "Private key file for -admin-tls-cert")
+	adminClientCA := flag.String("admin-client-ca", "", "CA bundle; admin clients with a certificate from it are authenticated (needs -admin-tls-cert)")
+	adminPublicHealth := flag.Bool("admin-public-health", false, "Serve /health without admin authentication")
 	flag.Parse()
 
 	log.Printf("Starting hoplb")
 	log.Printf("  HTTP traffic: %s", *listenAddr)
+	if *tlsAddr != "" {
+		log.Printf("  HTTPS:        %s", *tlsAddr)
+	}
 	log.Printf("  Admin:        %s (/health, /metrics)", *adminAddr)
 	log.Printf("  Agent:        %s", *agentAddr)
 	log.Printf("  Tag filter:   %q", *tagFilter)
+	if *fallbackJob != "" {
+		log.Printf("  Fallback:     %s", *fallbackJob)
+	}
+	if *pushURL != "" {
+		log.Printf("  Push:         %s (%s every %v)", *pushURL, *pushFormat, *pushInterval)
+	}
+	if *otlpEndpoint != "" {
+		log.Printf("  Tracing:      %s (ratio %.2f, keep errors %v)", *otlpEndpoint, *traceRatio, *traceKeepErrors)
+	}
 
 	// Create metrics collector
 	m := metrics.New()
 
 	// Create route table and watcher
 	routeTable := lb.NewRouteTable()
-	watcher := lb.NewWatcher(*agentAddr, routeTable, *tagFilter, *apiKey)
+	watcher := lb.NewWatcher(*agentAddr, routeTable, *tagFilter, *apiKey, m)
+	watcher.FallbackJob = *fallbackJob
 	proxy := lb.NewProxy(routeTable, m)
 
+	trusted, err := lb.ParseCIDRs(*trustedProxies)
+	if err != nil {
+		log.Fatalf("-trusted-proxies: %v", err)
+	}
+	proxy.TrustedProxies = trusted
+	proxy.ForwardAuthURL = *forwardAuthURL
+	if *errorPages != "" {
+		if proxy.ErrorPages, err = lb.LoadErrorPages(*errorPages); err != nil {
+			log.Fatalf("-error-pages: %v", err)
+		}
+	}
+
+	// Optional tracing
+	var spanExporter *tracing.OTLPExporter
+	if *otlpEndpoint != "" {
+		spanExporter = tracing.NewOTLPExporter(*otlpEndpoint, "hoplb")
+		proxy.Tracer = tracing.NewTracer(spanExporter)
+		proxy.Tracer.SampleRatio = *traceRatio
+		proxy.Tracer.KeepErrors = *traceKeepErrors
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	// Start watcher (polls hop for jobs/tasks)
 	go watcher.Run(ctx)
 
+	// Optional metrics push
+	pushDone := make(chan struct{})
+	if *pushURL != "" {
+		pusher, err := metrics.NewPusher(m, *pushFormat, *pushURL)
+		if err != nil {
+			log.Fatalf("Metrics push: %v", err)
+		}
+		pusher.Interval = *pushInterval
+		go func() {
+			pusher.Run(ctx)
+			close(pushDone)
+		}()
+	} else {
+		close(pushDone)
+	}
+
 	// Start HTTP traffic server
 	httpServer := &http.Server{
-		Addr:    *listenAddr,
-		Handler: proxy,
+		Addr:      *listenAddr,
+		Handler:   proxy,
+		ConnState: m.ConnState, // active client connections
 	}
 
 	go func() {
@@ -55,19 +130,85 @@ func main() {
 		}
 	}()
 
+	// Optional HTTPS traffic server; jobs tagged hoplb-client-ca get mTLS
+	var tlsServer *http.Server
+	if *tlsAddr != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatalf("-tls-cert/-tls-key: %v", err)
+		}
+		if _, port, err := net.SplitHostPort(*tlsAddr); err == nil {
+			proxy.HTTPSPort = port // for hoplb-https-redirect
+		}
+		tlsServer = &http.Server{
+			Addr:      *tlsAddr,
+			Handler:   proxy,
+			ConnState: m.ConnState,
+			TLSConfig: proxy.TLSConfig(&tls.Config{
+				Certificates: []tls.Certificate{cert},
+				MinVersion:   tls.VersionTLS12,
+			}),
+		}
+
+		go func() {
+			log.Printf("HTTPS server listening on %s", *tlsAddr)
+			if err := tlsServer.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+				log.Fatalf("HTTPS server error: %v", err)
+			}
+		}()
+	}
+
+	adminAuth := &admin.Auth{PublicHealth: *adminPublicHealth}
+	if *adminTokenFile != "" {
+		if adminAuth.Token, err = admin.ReadToken(*adminTokenFile); err != nil {
+			log.Fatalf("-admin-token-file: %v", err)
+		}
+	}
+	if *adminClientCA != "" {
+		if *adminTLSCert == "" {
+			log.Fatalf("-admin-client-ca requires -admin-tls-cert and -admin-tls-key")
+		}
+		if adminAuth.ClientCAs, err = lb.LoadCertPool(*adminClientCA); err != nil {
+			log.Fatalf("-admin-client-ca: %v", err)
+		}
+	}
+
 	// Start admin server (health + metrics)
 	adminMux := http.NewServeMux()
 	adminMux.HandleFunc("/health", handleHealth)
 	adminMux.Handle("/metrics", metrics.NewExporter(m))
+	adminMux.Handle("/maintenance", adminAuth.GuardWrites(proxy.Maintenance))
+	adminMux.HandleFunc("/conflicts", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		conflicts := watcher.Conflicts()
+		if conflicts == nil {
+			conflicts = []lb.Conflict{}
+		}
+		json.NewEncoder(w).Encode(conflicts)
+	})
+	if !adminAuth.Enabled() {
+		log.Printf("Admin listener has no authentication: /maintenance is read-only (set -admin-token-file or -admin-client-ca)")
+	}
 
 	adminServer := &http.Server{
 		Addr:    *adminAddr,
-		Handler: adminMux,
+		Handler: adminAuth.Wrap(adminMux),
+	}
+	if *adminTLSCert != "" || *adminTLSKey != "" {
+		if adminServer.TLSConfig, err = admin.TLSConfig(*adminTLSCert, *adminTLSKey, adminAuth.ClientCAs); err != nil {
+			log.Fatalf("Admin TLS: %v", err)
+		}
 	}
 
 	go func() {
-		log.Printf("Admin server listening on %s", *adminAddr)
-		if err := adminServer.ListenAndServe(); err != http.ErrServerClosed {
+		log.Printf("Admin server listening on %s (TLS %v, auth %v)", *adminAddr, adminServer.TLSConfig != nil, adminAuth.Enabled())
+		var err error
+		if adminServer.TLSConfig != nil {
+			err = adminServer.ListenAndServeTLS("", "")
+		} else {
+			err = adminServer.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
 			log.Fatalf("Admin server error: %v", err)
 		}
 	}()
@@ -80,7 +221,17 @@ func main() {
 	log.Println("Shutting down...")
 	cancel()
 	httpServer.Close()
+	if tlsServer != nil {
+		tlsServer.Close()
+	}
 	adminServer.Close()
+	<-pushDone // final push
+
+	if spanExporter != nil {
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancelShutdown()
+		spanExporter.Shutdown(shutdownCtx)
+	}
 }
 
 // handleHealth returns a simple health check response
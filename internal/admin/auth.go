@@ -0,0 +1,109 @@
+// Package admin protects the admin listener (/health, /metrics).
+package admin
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Auth guards the admin mux. A request is let through if it presents the
+// bearer token or a client certificate verified against ClientCAs. With
+// neither configured, everything is allowed as before.
+type Auth struct {
+	Token        string         // bearer token; empty = token auth off
+	ClientCAs    *x509.CertPool // CAs for client certificates; nil = mTLS off
+	PublicHealth bool           // serve /health without authentication
+}
+
+// Enabled reports whether any authentication is configured
+func (a *Auth) Enabled() bool {
+	return a.Token != "" || a.ClientCAs != nil
+}
+
+// Wrap returns h guarded by a
+func (a *Auth) Wrap(h http.Handler) http.Handler {
+	if !a.Enabled() {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if (a.PublicHealth && r.URL.Path == "/health") || a.authorized(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if a.Token != "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="hoplb-admin"`)
+		}
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// GuardWrites returns h limited to GET and HEAD unless authentication is
+// configured, for endpoints that change hoplb's behaviour
+func (a *Auth) GuardWrites(h http.Handler) http.Handler {
+	if a.Enabled() {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "admin authentication required for "+r.Method, http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (a *Auth) authorized(r *http.Request) bool {
+	// The TLS config only lets through certificates that chain to ClientCAs
+	if a.ClientCAs != nil && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return true
+	}
+	if a.Token != "" {
+		scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+		if ok && strings.EqualFold(scheme, "Bearer") &&
+			subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), []byte(a.Token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadToken reads a bearer token from a file, ignoring surrounding whitespace
+func ReadToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return token, nil
+}
+
+// TLSConfig returns the admin listener's TLS config. Client certificates
+// are verified if presented but not required at the handshake, so token
+// clients and a public /health keep working; Wrap enforces the policy.
+func TLSConfig(certFile, keyFile string, clientCAs *x509.CertPool) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("both a certificate and a key are required")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAs != nil {
+		cfg.ClientCAs = clientCAs
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, nil
+}
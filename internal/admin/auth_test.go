@@ -0,0 +1,149 @@
+package admin
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var ok = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+func TestAuthToken(t *testing.T) {
+	auth := &Auth{Token: "s3cret", PublicHealth: true}
+	h := auth.Wrap(ok)
+
+	tests := []struct {
+		path, header string
+		want         int
+	}{
+		{"/metrics", "", http.StatusUnauthorized},
+		{"/metrics", "Bearer wrong", http.StatusUnauthorized},
+		{"/metrics", "Basic s3cret", http.StatusUnauthorized},
+		{"/metrics", "Bearer s3cret", http.StatusOK},
+		{"/metrics", "bearer s3cret", http.StatusOK},
+		{"/health", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s with %q = %d; want %d", tt.path, tt.header, w.Code, tt.want)
+		}
+	}
+
+	auth.PublicHealth = false
+	w := httptest.NewRecorder()
+	auth.Wrap(ok).ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("private /health = %d; want 401", w.Code)
+	}
+
+	// No auth configured: unchanged behaviour
+	w = httptest.NewRecorder()
+	(&Auth{}).Wrap(ok).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("unauthenticated admin = %d; want 200", w.Code)
+	}
+}
+
+// newCert issues a certificate signed by parent (self-signed if nil)
+func newCert(t *testing.T, cn string, parent *tls.Certificate, isCA bool) tls.Certificate {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		DNSNames:              []string{cn},
+	}
+	signer, signerKey := tmpl, any(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestAuthGuardWrites(t *testing.T) {
+	tests := []struct {
+		auth   *Auth
+		method string
+		want   int
+	}{
+		{&Auth{}, "GET", http.StatusOK},
+		{&Auth{}, "HEAD", http.StatusOK},
+		{&Auth{}, "PUT", http.StatusForbidden},
+		{&Auth{}, "DELETE", http.StatusForbidden},
+		{&Auth{Token: "s3cret"}, "PUT", http.StatusOK}, // Wrap checks the token
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		tt.auth.GuardWrites(ok).ServeHTTP(w, httptest.NewRequest(tt.method, "/maintenance", nil))
+		if w.Code != tt.want {
+			t.Errorf("%s with auth %v = %d; want %d", tt.method, tt.auth.Enabled(), w.Code, tt.want)
+		}
+	}
+}
+
+func TestAuthClientCert(t *testing.T) {
+	ca := newCert(t, "admin-ca", nil, true)
+	other := newCert(t, "other-ca", nil, true)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+
+	auth := &Auth{ClientCAs: pool, PublicHealth: true}
+	srv := httptest.NewUnstartedServer(auth.Wrap(ok))
+	srv.TLS = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	srv.StartTLS()
+	defer srv.Close()
+
+	get := func(path string, cert *tls.Certificate) (int, error) {
+		cfg := srv.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+		if cert != nil {
+			cfg.Certificates = []tls.Certificate{*cert}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+		resp, err := client.Get(srv.URL + path)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	good := newCert(t, "prometheus", &ca, false)
+	if code, err := get("/metrics", &good); err != nil || code != http.StatusOK {
+		t.Errorf("trusted client cert = %d, %v; want 200", code, err)
+	}
+	if code, err := get("/metrics", nil); err != nil || code != http.StatusUnauthorized {
+		t.Errorf("no client cert = %d, %v; want 401", code, err)
+	}
+	if code, err := get("/health", nil); err != nil || code != http.StatusOK {
+		t.Errorf("public /health = %d, %v; want 200", code, err)
+	}
+	bad := newCert(t, "intruder", &other, false)
+	if code, err := get("/metrics", &bad); err == nil && code != http.StatusUnauthorized {
+		t.Errorf("untrusted client cert = %d; want handshake failure or 401", code)
+	}
+}
@@ -0,0 +1,12 @@
+package lb
+
+import "net/netip"
+
+// allowed applies the route's IP lists to a client: deny entries always
+// win, and a non-empty allow list admits only matching clients
+func (r *Route) allowed(ip netip.Addr) bool {
+	if containsAddr(r.DenyCIDRs, ip) {
+		return false
+	}
+	return len(r.AllowCIDRs) == 0 || containsAddr(r.AllowCIDRs, ip)
+}
@@ -0,0 +1,136 @@
+package lb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"hoplib"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, _ := ParseCIDRs("10.0.0.0/8, 192.168.1.1")
+	p := &Proxy{TrustedProxies: trusted}
+
+	tests := []struct {
+		remote string
+		xff    string
+		want   string
+	}{
+		{"203.0.113.7:5000", "", "203.0.113.7"},
+		{"203.0.113.7:5000", "1.2.3.4", "203.0.113.7"},                       // untrusted peer: XFF ignored
+		{"10.1.2.3:5000", "198.51.100.9", "198.51.100.9"},                    // trusted peer: use XFF
+		{"10.1.2.3:5000", "6.6.6.6, 198.51.100.9, 10.0.0.5", "198.51.100.9"}, // skip trusted hops, ignore spoofed left part
+		{"10.1.2.3:5000", "192.168.1.1, 10.0.0.5", "192.168.1.1"},            // all trusted: outermost
+		{"10.1.2.3:5000", "bogus, 10.0.0.5", "10.0.0.5"},                     // garbage stops the walk
+		{"[::ffff:10.1.2.3]:5000", "198.51.100.9", "198.51.100.9"},           // v4-mapped peer
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remote
+		if tt.xff != "" {
+			r.Header.Set("X-Forwarded-For", tt.xff)
+		}
+		if got := p.clientIP(r); got.String() != tt.want {
+			t.Errorf("clientIP(%s, XFF %q) = %s; want %s", tt.remote, tt.xff, got, tt.want)
+		}
+	}
+}
+
+func TestRouteAllowed(t *testing.T) {
+	allow, _ := ParseCIDRs("10.0.0.0/8, 2001:db8::/32")
+	deny, _ := ParseCIDRs("10.66.0.0/16")
+	route := &Route{AllowCIDRs: allow, DenyCIDRs: deny}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"10.66.1.1", false}, // deny wins over allow
+		{"2001:db8::1", true},
+		{"192.0.2.1", false}, // not on allow list
+	}
+	for _, tt := range tests {
+		if got := route.allowed(netip.MustParseAddr(tt.ip)); got != tt.want {
+			t.Errorf("allowed(%s) = %v; want %v", tt.ip, got, tt.want)
+		}
+	}
+
+	// Deny-only route admits everyone else
+	route = &Route{DenyCIDRs: deny}
+	if !route.allowed(netip.MustParseAddr("192.0.2.1")) {
+		t.Errorf("deny-only route refused an unlisted client")
+	}
+}
+
+func TestDenyCIDRTagKeepsValidEntries(t *testing.T) {
+	route := &Route{}
+	errs := applyJobTags(route, &hoplib.Job{Name: "app", Tags: map[string]string{
+		TagDenyCIDR: "203.0.113.0/24, 10.0.0.0/33, 198.51.100.7, not-an-ip",
+	}})
+	if len(errs) != 2 {
+		t.Errorf("errors = %v; want one per bad entry", errs)
+	}
+	for _, ip := range []string{"203.0.113.9", "198.51.100.7"} {
+		if route.allowed(netip.MustParseAddr(ip)) {
+			t.Errorf("%s admitted; a bad entry must not drop the rest of the deny list", ip)
+		}
+	}
+	if !route.allowed(netip.MustParseAddr("192.0.2.1")) {
+		t.Error("unlisted client refused")
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	got, err := ParseCIDRs(" 10.1.2.3/8 ,192.168.1.10,, ::1 ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.0/8", "192.168.1.10/32", "::1/128"}
+	if len(got) != len(want) {
+		t.Fatalf("ParseCIDRs = %v; want %v", got, want)
+	}
+	for i := range want {
+		if got[i].String() != want[i] {
+			t.Errorf("ParseCIDRs[%d] = %s; want %s", i, got[i], want[i])
+		}
+	}
+
+	if _, err := ParseCIDRs("10.0.0.0/33"); err == nil {
+		t.Errorf("ParseCIDRs accepted an invalid prefix")
+	}
+}
+
+func TestProxyDeniesByCIDR(t *testing.T) {
+	proxy, m, _ := newTestProxy(t, "admin.example.com", func(w http.ResponseWriter, r *http.Request) {})
+	allow, _ := ParseCIDRs("10.0.0.0/8")
+	proxy.routeTable.Update(map[string]*Route{"admin.example.com": {
+		Pattern:    "admin.example.com",
+		Backends:   proxy.routeTable.Match("admin.example.com").Backends,
+		AllowCIDRs: allow,
+	}})
+	proxy.TrustedProxies, _ = ParseCIDRs("192.0.2.0/24")
+
+	// httptest requests come from 192.0.2.1, a trusted proxy here
+	req := httptest.NewRequest("GET", "http://admin.example.com/", nil)
+	req.Header.Set("X-Forwarded-For", "10.8.0.4")
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("VPN client = %d; want 200", w.Code)
+	}
+
+	req = httptest.NewRequest("GET", "http://admin.example.com/", nil)
+	req.Header.Set("X-Forwarded-For", "203.0.113.50")
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("outside client = %d; want 403", w.Code)
+	}
+	if got := m.Rejections()["admin.example.com"]["acl"]; got != 1 {
+		t.Errorf("acl rejections = %d; want 1", got)
+	}
+}
@@ -0,0 +1,27 @@
+package lb
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// BasicAuth protects a route with HTTP Basic auth against an htpasswd file
+type BasicAuth struct {
+	File  string // htpasswd file, re-read when it changes
+	Realm string // shown by the browser's login prompt
+}
+
+// checkBasicAuth verifies the request's credentials. On failure it writes
+// the 401 challenge to w and returns false.
+func (r *Route) checkBasicAuth(w http.ResponseWriter, req *http.Request) bool {
+	if user, password, ok := req.BasicAuth(); ok && r.htpasswd.verify(user, password) {
+		return true
+	}
+	realm := r.BasicAuth.Realm
+	if realm == "" {
+		realm = r.Pattern
+	}
+	w.Header().Set("WWW-Authenticate", "Basic realm="+strconv.Quote(realm)+`, charset="UTF-8"`)
+	http.Error(w, "unauthorized", http.StatusUnauthorized)
+	return false
+}
@@ -0,0 +1,126 @@
+package lb
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckPassword(t *testing.T) {
+	// Reference hashes from openssl passwd
+	tests := []struct {
+		hash string
+		want bool
+	}{
+		{"{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", true},
+		{"$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/", true},
+		{"$5$saltsalt$0IyaXrmV7.sGNS6tirgqHLqX/G.FBvgkYA.lpPdS5sA", true},
+		{"$6$saltsalt$TVLlQcbpFVof5W3Yz4DTP6gRstiNuHwwTt6GLc1E5n0U0aDehy0S5knV8wiOQSpT0Y77vwPZN.Pq.H91p5hVO1", true},
+		{"$6$rounds=10000$saltsalt$WowrPBpEDVlCoruBosYlrZycTCx3//TyDHYqEhX9DUHHt0XTztUqzQDDUuvUGRA8aUe9p55hcAxeGcu58sm3u.", true},
+		{"$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ0", false},
+		{"secret", false}, // plaintext is not accepted
+	}
+	for _, tt := range tests {
+		if got := checkPassword(tt.hash, "secret"); got != tt.want {
+			t.Errorf("checkPassword(%q, secret) = %v; want %v", tt.hash, got, tt.want)
+		}
+	}
+	if checkPassword("$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/", "Secret") {
+		t.Error("wrong password accepted")
+	}
+}
+
+func TestProxyBasicAuth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	os.WriteFile(path, []byte("# admins\nalice:$apr1$abcdefgh$h9FWgUz3n9YxylKLlR5SQ/\nbob:$2y$05$unsupportedbcrypthash\n"), 0o600)
+
+	proxy, m, _ := newTestProxy(t, "admin.example.com", func(w http.ResponseWriter, r *http.Request) {})
+	proxy.routeTable.Update(map[string]*Route{"admin.example.com": {
+		Pattern:   "admin.example.com",
+		Backends:  proxy.routeTable.Match("admin.example.com").Backends,
+		BasicAuth: &BasicAuth{File: path, Realm: "Admin"},
+	}})
+
+	do := func(user, password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://admin.example.com/", nil)
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("", "")
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != `Basic realm="Admin", charset="UTF-8"` {
+		t.Errorf("no credentials = %d %q; want 401 with Basic challenge", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+	if w := do("alice", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("wrong password = %d; want 401", w.Code)
+	}
+	if w := do("bob", "secret"); w.Code != http.StatusUnauthorized {
+		t.Errorf("bcrypt user = %d; want 401", w.Code)
+	}
+	if w := do("alice", strings.Repeat("x", maxPasswordLen+1)); w.Code != http.StatusUnauthorized {
+		t.Errorf("overlong password = %d; want 401", w.Code)
+	}
+	if w := do("alice", "secret"); w.Code != http.StatusOK {
+		t.Errorf("valid credentials = %d; want 200", w.Code)
+	}
+	if got := m.Rejections()["admin.example.com"]["basic_auth"]; got != 4 {
+		t.Errorf("basic_auth rejections = %d; want 4", got)
+	}
+
+	// Removing a user takes effect once the file changes
+	os.WriteFile(path, []byte("carol:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0o600)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(path, future, future)
+	proxy.routeTable.Match("admin.example.com").htpasswd.checked = time.Time{}
+	if w := do("alice", "secret"); w.Code != http.StatusUnauthorized {
+		t.Errorf("removed user = %d; want 401", w.Code)
+	}
+	if w := do("carol", "secret"); w.Code != http.StatusOK {
+		t.Errorf("added user = %d; want 200", w.Code)
+	}
+}
+
+func TestHtpasswdMissingFileThrottled(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	f := newHtpasswdFile(path)
+	for range 3 {
+		f.verify("alice", "secret")
+	}
+	if n := strings.Count(logs.String(), "\n"); n != 1 {
+		t.Errorf("missing file logged %d times; want once", n)
+	}
+
+	// Checked again only after the interval
+	os.WriteFile(path, []byte("alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0o600)
+	if f.verify("alice", "secret") {
+		t.Error("file re-read within the check interval")
+	}
+	f.checked = f.checked.Add(-5 * time.Second)
+	if !f.verify("alice", "secret") {
+		t.Error("file not picked up after the check interval")
+	}
+
+	// The same error again is not logged again
+	os.Remove(path)
+	f.checked = time.Time{}
+	f.verify("alice", "secret")
+	f.checked = time.Time{}
+	f.verify("alice", "secret")
+	if n := strings.Count(logs.String(), "\n"); n != 2 {
+		t.Errorf("log lines = %d; want 2 (error logged again after a good load only)", n)
+	}
+}
@@ -0,0 +1,160 @@
+package lb
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Headers describing a verified client certificate, set for routes with a
+// client CA. Client-supplied values are always dropped.
+const (
+	ClientCertSubjectHeader     = "X-Client-Cert-Subject"
+	ClientCertIssuerHeader      = "X-Client-Cert-Issuer"
+	ClientCertSerialHeader      = "X-Client-Cert-Serial"
+	ClientCertFingerprintHeader = "X-Client-Cert-Fingerprint" // SHA-256, hex
+	ClientCertDNSHeader         = "X-Client-Cert-Dns"
+	ClientCertEmailHeader       = "X-Client-Cert-Email"
+	ClientCertURIHeader         = "X-Client-Cert-Uri"
+)
+
+var clientCertHeaders = []string{
+	ClientCertSubjectHeader, ClientCertIssuerHeader, ClientCertSerialHeader,
+	ClientCertFingerprintHeader, ClientCertDNSHeader, ClientCertEmailHeader,
+	ClientCertURIHeader,
+}
+
+// ClientCA requires clients of a route to present a certificate issued by
+// one of the CAs in File
+type ClientCA struct {
+	File string
+	Pool *x509.CertPool // nil = File couldn't be loaded: deny everything
+
+	modTime time.Time // of File when Pool was loaded
+}
+
+// load reads File into Pool unless it is unchanged since prev, a ClientCA
+// for the same file, loaded it. If the file can't be read, prev's pool is
+// kept; without one, Pool stays nil and every client is refused.
+func (ca *ClientCA) load(prev *ClientCA) {
+	if prev != nil && prev.Pool == nil {
+		prev = nil
+	}
+	info, err := os.Stat(ca.File)
+	if err == nil && prev != nil && info.ModTime().Equal(prev.modTime) {
+		ca.Pool, ca.modTime = prev.Pool, prev.modTime
+		return
+	}
+	var pool *x509.CertPool
+	if err == nil {
+		pool, err = LoadCertPool(ca.File)
+	}
+	if err != nil {
+		if prev != nil {
+			log.Printf("Client CA %s: %v (keeping the previous certificates)", ca.File, err)
+			ca.Pool, ca.modTime = prev.Pool, prev.modTime
+		} else {
+			log.Printf("Client CA %s: %v (denying all clients)", ca.File, err)
+		}
+		return
+	}
+	ca.Pool, ca.modTime = pool, info.ModTime()
+}
+
+// LoadCertPool reads a PEM bundle of CA certificates
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s: no PEM certificates found", path)
+	}
+	return pool, nil
+}
+
+// TLSConfig returns base extended for the TLS listener: clients connecting
+// to an SNI host whose route has a client CA are asked for a certificate.
+// The certificate is verified per request by checkClientCert, so a client
+// can't dodge the check by sending a different Host than its SNI.
+func (p *Proxy) TLSConfig(base *tls.Config) *tls.Config {
+	cfg := base.Clone()
+	if cfg.NextProtos == nil {
+		cfg.NextProtos = []string{"h2", "http/1.1"}
+	}
+	cfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		route := p.routeTable.Match(hello.ServerName)
+		if route == nil || route.ClientCA == nil || route.ClientCA.Pool == nil {
+			return nil, nil
+		}
+		withCA := cfg.Clone()
+		withCA.GetConfigForClient = nil
+		withCA.ClientAuth = tls.RequestClientCert
+		withCA.ClientCAs = route.ClientCA.Pool // advertised so clients pick the right cert
+		return withCA, nil
+	}
+	return cfg
+}
+
+// checkClientCert verifies the connection's client certificate against ca
+// and describes it in request headers. On failure it writes a 403 error
+// page to w and returns false with the rejection reason.
+func (p *Proxy) checkClientCert(w http.ResponseWriter, req *http.Request, ca *ClientCA) (bool, string) {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		p.writeError(w, req, http.StatusForbidden, "client certificate required")
+		return false, "client_cert_missing"
+	}
+	if ca.Pool == nil {
+		p.writeError(w, req, http.StatusForbidden, "client certificate not trusted")
+		return false, "client_cert_invalid"
+	}
+
+	certs := req.TLS.PeerCertificates
+	intermediates := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         ca.Pool,
+		Intermediates: intermediates,
+		CurrentTime:   time.Now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		p.writeError(w, req, http.StatusForbidden, "client certificate not trusted")
+		return false, "client_cert_invalid"
+	}
+
+	setClientCertHeaders(req.Header, certs[0])
+	return true, ""
+}
+
+// setClientCertHeaders describes cert in h
+func setClientCertHeaders(h http.Header, cert *x509.Certificate) {
+	fingerprint := sha256.Sum256(cert.Raw)
+	h.Set(ClientCertSubjectHeader, cert.Subject.String())
+	h.Set(ClientCertIssuerHeader, cert.Issuer.String())
+	h.Set(ClientCertSerialHeader, cert.SerialNumber.Text(16))
+	h.Set(ClientCertFingerprintHeader, hex.EncodeToString(fingerprint[:]))
+	if len(cert.DNSNames) > 0 {
+		h.Set(ClientCertDNSHeader, strings.Join(cert.DNSNames, ","))
+	}
+	if len(cert.EmailAddresses) > 0 {
+		h.Set(ClientCertEmailHeader, strings.Join(cert.EmailAddresses, ","))
+	}
+	if len(cert.URIs) > 0 {
+		uris := make([]string, len(cert.URIs))
+		for i, u := range cert.URIs {
+			uris[i] = u.String()
+		}
+		h.Set(ClientCertURIHeader, strings.Join(uris, ","))
+	}
+}
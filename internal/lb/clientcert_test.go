@@ -0,0 +1,157 @@
+package lb
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestProxyClientCert(t *testing.T) {
+	ca := newTestCert(t, "Partner CA", nil, nil)
+	otherCA := newTestCert(t, "Other CA", nil, nil)
+	serverCert := newTestCert(t, "hoplb", []string{"partner.example.com", "www.example.com"}, ca)
+	partner := newTestCert(t, "acme-integration", []string{"api.acme.test"}, ca)
+	intruder := newTestCert(t, "intruder", nil, otherCA)
+
+	var upstream http.Header
+	proxy, m, addr := newTestProxy(t, "partner.example.com", func(w http.ResponseWriter, r *http.Request) {
+		upstream = r.Header.Clone()
+	})
+	proxy.routeTable.Update(map[string]*Route{
+		"partner.example.com": {
+			Pattern:  "partner.example.com",
+			Backends: []*Backend{{Address: addr, Healthy: true}},
+			ClientCA: &ClientCA{File: "partner-ca.pem", Pool: ca.pool()},
+		},
+		"www.example.com": {
+			Pattern:  "www.example.com",
+			Backends: []*Backend{{Address: addr, Healthy: true}},
+		},
+	})
+
+	srv := httptest.NewUnstartedServer(proxy)
+	srv.TLS = proxy.TLSConfig(&tls.Config{Certificates: []tls.Certificate{serverCert.Certificate}})
+	srv.StartTLS()
+	defer srv.Close()
+
+	// get connects with SNI sni, sends Host host and presents cert if given
+	get := func(sni, host string, cert *testCert) (int, bool) {
+		upstream = nil
+		var requested bool
+		cfg := &tls.Config{RootCAs: ca.pool(), ServerName: sni}
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			requested = true
+			if cert == nil {
+				return &tls.Certificate{}, nil
+			}
+			return &cert.Certificate, nil
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+		u, _ := url.Parse(srv.URL)
+		req, _ := http.NewRequest("GET", srv.URL+"/orders", nil)
+		req.Host = host
+		req.Header.Set(ClientCertSubjectHeader, "CN=spoofed")
+		req.URL.Host = u.Host
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s (SNI %s): %v", host, sni, err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode, requested
+	}
+
+	code, requested := get("partner.example.com", "partner.example.com", partner)
+	if code != http.StatusOK || !requested {
+		t.Fatalf("trusted client cert = %d (requested %v); want 200", code, requested)
+	}
+	if got := upstream.Get(ClientCertSubjectHeader); got != "CN=acme-integration,O=Example Partner" {
+		t.Errorf("subject header = %q; want the verified subject", got)
+	}
+	if upstream.Get(ClientCertDNSHeader) != "api.acme.test" || len(upstream.Get(ClientCertFingerprintHeader)) != 64 {
+		t.Errorf("SAN/fingerprint headers = %q/%q", upstream.Get(ClientCertDNSHeader), upstream.Get(ClientCertFingerprintHeader))
+	}
+
+	if code, _ := get("partner.example.com", "partner.example.com", nil); code != http.StatusForbidden {
+		t.Errorf("no client cert = %d; want 403", code)
+	}
+	if code, _ := get("partner.example.com", "partner.example.com", intruder); code != http.StatusForbidden {
+		t.Errorf("untrusted client cert = %d; want 403", code)
+	}
+
+	// Other hosts aren't asked for a certificate, and spoofed headers are dropped
+	code, requested = get("www.example.com", "www.example.com", nil)
+	if code != http.StatusOK || requested {
+		t.Errorf("www = %d (cert requested %v); want 200 without a request", code, requested)
+	}
+	if upstream.Get(ClientCertSubjectHeader) != "" {
+		t.Errorf("client-supplied %s reached the backend", ClientCertSubjectHeader)
+	}
+
+	// SNI of an open host doesn't unlock the protected one
+	if code, _ := get("www.example.com", "partner.example.com", nil); code != http.StatusForbidden {
+		t.Errorf("SNI/Host mismatch = %d; want 403", code)
+	}
+
+	rejections := m.Rejections()["partner.example.com"]
+	if rejections["client_cert_missing"] != 2 || rejections["client_cert_invalid"] != 1 {
+		t.Errorf("rejections = %v; want 2 missing, 1 invalid", rejections)
+	}
+
+	// Refusals are error pages
+	req := httptest.NewRequest("GET", "http://partner.example.com/", nil)
+	req.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("plain HTTP request = %d %q; want the JSON 403 error page", w.Code, w.Header().Get("Content-Type"))
+	}
+}
+
+func TestClientCACarryOver(t *testing.T) {
+	dir := t.TempDir()
+	ca, otherCA := newTestCert(t, "Partner CA", nil, nil), newTestCert(t, "Other CA", nil, nil)
+	caFile, _ := ca.writeFiles(t, dir, "ca")
+
+	rt := NewRouteTable()
+	update := func() *ClientCA {
+		rt.Update(map[string]*Route{"partner.example.com": {
+			Pattern:  "partner.example.com",
+			ClientCA: &ClientCA{File: caFile},
+		}})
+		return rt.Match("partner.example.com").ClientCA
+	}
+
+	first := update()
+	if first.Pool == nil {
+		t.Fatal("client CA not loaded")
+	}
+	if again := update(); again.Pool != first.Pool {
+		t.Error("unchanged CA file was re-read")
+	}
+
+	// A file that can't be read keeps the previous pool
+	os.Remove(caFile)
+	if kept := update(); kept.Pool != first.Pool {
+		t.Error("unreadable CA file dropped the loaded certificates")
+	}
+
+	// A changed file is picked up
+	otherCA.writeFiles(t, dir, "ca")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(caFile, future, future)
+	rotated := update()
+	if rotated.Pool == first.Pool || !rotated.Pool.Equal(otherCA.pool()) {
+		t.Error("rotated CA file was not loaded")
+	}
+
+	// Without certificates loaded before, a bad file denies everyone
+	rt = NewRouteTable()
+	os.WriteFile(caFile, []byte("not a certificate"), 0o600)
+	if ca := update(); ca.Pool != nil {
+		t.Error("bad CA file loaded a pool")
+	}
+}
@@ -0,0 +1,104 @@
+package lb
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// clientIP returns the real client IP. The connection's peer is the client
+// unless it is a trusted proxy; then X-Forwarded-For is walked from the
+// right, skipping trusted hops, and the first untrusted address wins.
+func (p *Proxy) clientIP(r *http.Request) netip.Addr {
+	peer := remoteAddr(r)
+	if !containsAddr(p.TrustedProxies, peer) {
+		return peer
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break // garbage: stop trusting the chain
+		}
+		addr = addr.Unmap()
+		if !containsAddr(p.TrustedProxies, addr) {
+			return addr
+		}
+		peer = addr
+	}
+	return peer // every hop trusted: use the outermost one
+}
+
+// forwardedFor returns the X-Forwarded-For value vouched for by trusted
+// proxies: the client IP, the trusted hops after it and the peer
+func (p *Proxy) forwardedFor(r *http.Request) string {
+	peer := remoteAddr(r)
+	chain := []string{peer.String()}
+	if containsAddr(p.TrustedProxies, peer) {
+		hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				break
+			}
+			addr = addr.Unmap()
+			chain = append(chain, addr.String())
+			if !containsAddr(p.TrustedProxies, addr) {
+				break
+			}
+		}
+	}
+	slices.Reverse(chain)
+	return strings.Join(chain, ", ")
+}
+
+// remoteAddr returns the IP of the connection's peer
+func remoteAddr(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, _ := netip.ParseAddr(host)
+	return addr.Unmap()
+}
+
+// containsAddr reports whether any prefix contains addr
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseCIDRs parses a comma-separated list of CIDRs or single IPs
+// (e.g. "10.0.0.0/8, 192.168.1.10")
+func ParseCIDRs(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if strings.Contains(part, "/") {
+			p, err := netip.ParsePrefix(part)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q", part)
+			}
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP %q", part)
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
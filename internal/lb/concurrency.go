@@ -0,0 +1,182 @@
+package lb
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AdaptiveLimit configures a concurrency limit that follows upstream
+// latency, parsed from a hoplb-adaptive-limit tag, e.g.
+// "aimd latency=250ms" or "gradient min=10 max=500".
+type AdaptiveLimit struct {
+	Algorithm string        // "aimd" or "gradient"
+	Initial   int           // starting limit
+	Min       int           // never shed below this many in flight
+	Max       int           // never allow more than this many in flight
+	Latency   time.Duration // aimd: slower responses count as drops
+}
+
+// ParseAdaptiveLimit parses a hoplb-adaptive-limit tag value
+func ParseAdaptiveLimit(tag string) (AdaptiveLimit, error) {
+	fields := strings.Fields(tag)
+	if len(fields) == 0 {
+		return AdaptiveLimit{}, fmt.Errorf("empty adaptive limit")
+	}
+
+	l := AdaptiveLimit{Algorithm: fields[0], Initial: 20, Min: 1, Max: 1000, Latency: time.Second}
+	if l.Algorithm != "aimd" && l.Algorithm != "gradient" {
+		return l, fmt.Errorf("unknown algorithm %q (want aimd or gradient)", l.Algorithm)
+	}
+
+	for _, opt := range fields[1:] {
+		k, v, _ := strings.Cut(opt, "=")
+		var err error
+		switch k {
+		case "initial":
+			l.Initial, err = strconv.Atoi(v)
+		case "min":
+			l.Min, err = strconv.Atoi(v)
+		case "max":
+			l.Max, err = strconv.Atoi(v)
+		case "latency":
+			l.Latency, err = time.ParseDuration(v)
+		default:
+			return l, fmt.Errorf("unknown option %q", opt)
+		}
+		if err != nil {
+			return l, fmt.Errorf("invalid %s %q", k, v)
+		}
+	}
+
+	if l.Min < 1 || l.Max < l.Min || l.Latency <= 0 {
+		return l, fmt.Errorf("need 1 <= min <= max and latency > 0")
+	}
+	l.Initial = min(max(l.Initial, l.Min), l.Max)
+	return l, nil
+}
+
+// concurrencyLimiter admits requests up to a (possibly moving) limit
+type concurrencyLimiter interface {
+	// acquire reserves a slot; false means the request must be shed
+	acquire() bool
+	// release frees the slot and feeds the outcome back
+	release(latency time.Duration, dropped bool)
+	// limit returns the current limit
+	limit() int
+}
+
+// newConcurrencyLimiter builds the limiter for a route's policy, or nil if
+// the route has none. A static max caps the adaptive limit.
+func newConcurrencyLimiter(maxInFlight int, adaptive AdaptiveLimit) concurrencyLimiter {
+	if adaptive.Algorithm != "" {
+		if maxInFlight > 0 && adaptive.Max > maxInFlight {
+			adaptive.Max = maxInFlight
+			adaptive.Min = min(adaptive.Min, maxInFlight)
+			adaptive.Initial = min(adaptive.Initial, maxInFlight)
+		}
+		return newAdaptiveLimiter(adaptive)
+	}
+	if maxInFlight > 0 {
+		return &staticLimiter{max: int64(maxInFlight)}
+	}
+	return nil
+}
+
+// staticLimiter is a fixed max in-flight limit
+type staticLimiter struct {
+	max      int64
+	inFlight int64
+}
+
+func (l *staticLimiter) acquire() bool {
+	if atomic.AddInt64(&l.inFlight, 1) > l.max {
+		atomic.AddInt64(&l.inFlight, -1)
+		return false
+	}
+	return true
+}
+
+func (l *staticLimiter) release(time.Duration, bool) { atomic.AddInt64(&l.inFlight, -1) }
+
+func (l *staticLimiter) limit() int { return int(l.max) }
+
+// adaptiveLimiter adjusts its limit from request outcomes, after Netflix's
+// concurrency-limits:
+//
+//   - aimd: a drop (5xx or latency above the threshold) multiplies the limit
+//     by 0.9; a success while at least half the limit is in use adds 1.
+//   - gradient: compares a long-term latency average with the latest sample.
+//     When latency rises, the limit shrinks toward limit*long/short (at most
+//     halving it); otherwise it grows by sqrt(limit) of queueing headroom.
+type adaptiveLimiter struct {
+	spec AdaptiveLimit
+
+	mu       sync.Mutex
+	current  float64
+	inFlight int
+	longRTT  float64 // gradient: EMA of latency in seconds
+}
+
+func newAdaptiveLimiter(spec AdaptiveLimit) *adaptiveLimiter {
+	return &adaptiveLimiter{spec: spec, current: float64(spec.Initial)}
+}
+
+func (l *adaptiveLimiter) acquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.inFlight >= int(l.current) {
+		return false
+	}
+	l.inFlight++
+	return true
+}
+
+func (l *adaptiveLimiter) release(latency time.Duration, dropped bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	inFlight := l.inFlight // including this request
+	l.inFlight--
+
+	switch l.spec.Algorithm {
+	case "aimd":
+		if dropped || latency > l.spec.Latency {
+			l.current *= 0.9
+		} else if inFlight*2 >= int(l.current) {
+			l.current++
+		}
+
+	case "gradient":
+		rtt := latency.Seconds()
+		if l.longRTT == 0 {
+			l.longRTT = rtt
+		}
+		l.longRTT = l.longRTT*0.95 + rtt*0.05
+
+		// Don't grow while the route isn't using its limit
+		if !dropped && inFlight*2 < int(l.current) {
+			break
+		}
+
+		gradient := 0.5
+		if !dropped && rtt > 0 {
+			gradient = math.Max(0.5, math.Min(1, 1.5*l.longRTT/rtt))
+		}
+		next := l.current*gradient + math.Sqrt(l.current)
+		l.current = l.current*0.8 + next*0.2 // smoothing
+	}
+
+	l.current = math.Min(float64(l.spec.Max), math.Max(float64(l.spec.Min), l.current))
+}
+
+func (l *adaptiveLimiter) limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int(l.current)
+}
@@ -0,0 +1,135 @@
+package lb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseAdaptiveLimit(t *testing.T) {
+	tests := []struct {
+		tag     string
+		want    AdaptiveLimit
+		wantErr bool
+	}{
+		{"aimd", AdaptiveLimit{Algorithm: "aimd", Initial: 20, Min: 1, Max: 1000, Latency: time.Second}, false},
+		{"gradient initial=50 min=10 max=200", AdaptiveLimit{Algorithm: "gradient", Initial: 50, Min: 10, Max: 200, Latency: time.Second}, false},
+		{"aimd latency=250ms initial=1 min=5", AdaptiveLimit{Algorithm: "aimd", Initial: 5, Min: 5, Max: 1000, Latency: 250 * time.Millisecond}, false},
+		{"", AdaptiveLimit{}, true},
+		{"vegas", AdaptiveLimit{}, true},
+		{"aimd min=10 max=5", AdaptiveLimit{}, true},
+		{"aimd latency=fast", AdaptiveLimit{}, true},
+		{"aimd foo=1", AdaptiveLimit{}, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseAdaptiveLimit(tt.tag)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseAdaptiveLimit(%q) error = %v; wantErr %v", tt.tag, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("ParseAdaptiveLimit(%q) = %+v; want %+v", tt.tag, got, tt.want)
+		}
+	}
+}
+
+func TestStaticLimiter(t *testing.T) {
+	l := newConcurrencyLimiter(2, AdaptiveLimit{})
+	if !l.acquire() || !l.acquire() {
+		t.Fatal("acquire within limit failed")
+	}
+	if l.acquire() {
+		t.Fatal("acquire above limit succeeded")
+	}
+	l.release(0, false)
+	if !l.acquire() {
+		t.Fatal("acquire after release failed")
+	}
+}
+
+func TestAIMDLimiter(t *testing.T) {
+	l := newAdaptiveLimiter(AdaptiveLimit{Algorithm: "aimd", Initial: 10, Min: 2, Max: 12, Latency: 100 * time.Millisecond})
+
+	// Fast responses under load grow the limit by one each, up to Max
+	for i := 0; i < 5; i++ {
+		for j := 0; j < l.limit(); j++ {
+			l.acquire()
+		}
+		for l.inFlight > 0 {
+			l.release(10*time.Millisecond, false)
+		}
+	}
+	if got := l.limit(); got != 12 {
+		t.Errorf("limit after fast responses = %d; want capped at 12", got)
+	}
+
+	// Slow responses and errors back off multiplicatively, down to Min
+	for i := 0; i < 50; i++ {
+		l.acquire()
+		l.release(time.Second, false)
+	}
+	if got := l.limit(); got != 2 {
+		t.Errorf("limit after slow responses = %d; want floored at 2", got)
+	}
+}
+
+func TestGradientLimiter(t *testing.T) {
+	l := newAdaptiveLimiter(AdaptiveLimit{Algorithm: "gradient", Initial: 50, Min: 1, Max: 1000, Latency: time.Second})
+
+	// Steady latency at full use: limit grows
+	for i := 0; i < 100; i++ {
+		l.inFlight = l.limit()
+		l.release(20*time.Millisecond, false)
+	}
+	grown := l.limit()
+	if grown <= 50 {
+		t.Fatalf("limit with steady latency = %d; want > 50", grown)
+	}
+
+	// Latency jumps 10x: limit shrinks
+	for i := 0; i < 20; i++ {
+		l.inFlight = l.limit()
+		l.release(200*time.Millisecond, false)
+	}
+	if got := l.limit(); got >= grown {
+		t.Errorf("limit after latency spike = %d; want < %d", got, grown)
+	}
+}
+
+func TestProxySheds(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	proxy, m, _ := newTestProxy(t, "api.example.com", func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	})
+	proxy.routeTable.Update(map[string]*Route{"api.example.com": {
+		Pattern:     "api.example.com",
+		Backends:    proxy.routeTable.Match("api.example.com").Backends,
+		MaxInFlight: 1,
+	}})
+
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, httptest.NewRequest("GET", "http://api.example.com/", nil))
+		done <- w.Code
+	}()
+	<-started
+
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "http://api.example.com/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("request over max in-flight = %d; want 503", w.Code)
+	}
+
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("admitted request = %d; want 200", code)
+	}
+	if got := m.Rejections()["api.example.com"]["concurrency"]; got != 1 {
+		t.Errorf("concurrency rejections = %d; want 1", got)
+	}
+}
@@ -0,0 +1,107 @@
+package lb
+
+import (
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Reasons a job won a contested host
+const (
+	ConflictPriority        = "priority"         // higher hoplb-route-priority
+	ConflictFirstRegistered = "first_registered" // seen by hoplb before the others
+)
+
+// Conflict is a host claimed by several jobs without hoplb-match where
+// some were left out. Merged jobs share the host with the owner because
+// both sides are tagged hoplb-route-merge=true.
+type Conflict struct {
+	Pattern string   `json:"pattern"`
+	Owner   string   `json:"owner"`
+	Merged  []string `json:"merged,omitempty"`
+	Ignored []string `json:"ignored"`
+	Reason  string   `json:"reason"`
+}
+
+// String describes the conflict for logs
+func (c *Conflict) String() string {
+	s := c.Pattern + ": " + c.Owner + " wins (" + c.Reason + ")"
+	if len(c.Merged) > 0 {
+		s += ", merged with " + strings.Join(c.Merged, ", ")
+	}
+	return s + ", ignoring " + strings.Join(c.Ignored, ", ")
+}
+
+// routePriority returns the job's hoplb-route-priority, 0 if unset or invalid
+func routePriority(jb jobBackends) int {
+	v := jb.job.Tags[TagRoutePriority]
+	if v == "" {
+		return 0
+	}
+	priority, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("Ignoring tag: job %s: %s: invalid priority %q", jb.job.Name, TagRoutePriority, v)
+		return 0
+	}
+	return priority
+}
+
+// resolveClaims picks the jobs that serve pattern among the default jobs
+// (no hoplb-match) claiming it. The highest hoplb-route-priority wins,
+// then the first registered job, then the lowest name. Other jobs join
+// the winner only if both are tagged hoplb-route-merge=true. served[0] is
+// the owner; conflict is nil unless a job was left out.
+func resolveClaims(pattern string, jobs []jobBackends) (served []jobBackends, conflict *Conflict) {
+	if len(jobs) == 0 {
+		return nil, nil
+	}
+
+	priorities := make(map[string]int, len(jobs))
+	for _, jb := range jobs {
+		priorities[jb.job.Name] = routePriority(jb)
+	}
+	sorted := append([]jobBackends(nil), jobs...)
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if pa, pb := priorities[a.job.Name], priorities[b.job.Name]; pa != pb {
+			return pa > pb
+		}
+		if a.seq != b.seq {
+			return a.seq < b.seq
+		}
+		return a.job.Name < b.job.Name
+	})
+
+	owner := sorted[0]
+	served = []jobBackends{owner}
+	merge := owner.job.Tags[TagRouteMerge] == "true"
+	var merged, ignored []string
+	for _, jb := range sorted[1:] {
+		if merge && jb.job.Tags[TagRouteMerge] == "true" {
+			served = append(served, jb)
+			merged = append(merged, jb.job.Name)
+			continue
+		}
+		ignored = append(ignored, jb.job.Name)
+	}
+	if len(ignored) == 0 {
+		return served, nil
+	}
+
+	// Priority only explains the outcome if it beat every ignored job
+	reason := ConflictPriority
+	for _, name := range ignored {
+		if priorities[name] == priorities[owner.job.Name] {
+			reason = ConflictFirstRegistered
+			break
+		}
+	}
+	return served, &Conflict{
+		Pattern: pattern,
+		Owner:   owner.job.Name,
+		Merged:  merged,
+		Ignored: ignored,
+		Reason:  reason,
+	}
+}
@@ -0,0 +1,235 @@
+package lb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+)
+
+// errorPageStatuses are the statuses hoplb renders with ErrorPages
+var errorPageStatuses = []int{
+	http.StatusForbidden,
+	http.StatusNotFound,
+	http.StatusTooManyRequests,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// ErrorPage is the data passed to error page templates
+type ErrorPage struct {
+	Status     int    // e.g. 503
+	StatusText string // e.g. "Service Unavailable"
+	Message    string // e.g. "no healthy backend"
+	RequestID  string
+	Host       string
+
+	Maintenance bool // the route is in maintenance mode
+}
+
+// ErrorPages renders the 403, 404, 429, 502, 503 and 504 responses hoplb
+// generates itself. Clients preferring JSON get JSON, browsers get HTML,
+// everything else plain text.
+type ErrorPages struct {
+	html map[int]*htmltemplate.Template // status -> page, 0 = any
+	json map[int]*texttemplate.Template // status -> page, 0 = any; nil = built in
+}
+
+// defaultHTML is the built-in HTML error page
+var defaultHTML = htmltemplate.Must(htmltemplate.New("error.html").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Status}} {{.StatusText}}</title>
+<style>body{font-family:system-ui,sans-serif;max-width:40em;margin:4em auto;padding:0 1em;color:#222}small{color:#777}</style>
+</head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>{{.Message}}</p>
+<p><small>Request ID: <code>{{.RequestID}}</code></small></p>
+</body>
+</html>
+`))
+
+// LoadErrorPages reads templates from dir: <status>.html and
+// <status>.json (e.g. 503.html) for one status, error.html and error.json
+// for the others. Missing files fall back to the built-in pages. HTML
+// templates use html/template; JSON templates have a "json" function
+// that quotes a value, e.g. {"id": {{json .RequestID}}}.
+func LoadErrorPages(dir string) (*ErrorPages, error) {
+	pages := &ErrorPages{
+		html: make(map[int]*htmltemplate.Template),
+		json: make(map[int]*texttemplate.Template),
+	}
+	funcs := texttemplate.FuncMap{"json": jsonValue}
+
+	for _, status := range append([]int{0}, errorPageStatuses...) {
+		name := "error"
+		if status != 0 {
+			name = strconv.Itoa(status)
+		}
+
+		path := filepath.Join(dir, name+".html")
+		if b, err := os.ReadFile(path); err == nil {
+			t, err := htmltemplate.New(name + ".html").Parse(string(b))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			pages.html[status] = t
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+
+		path = filepath.Join(dir, name+".json")
+		if b, err := os.ReadFile(path); err == nil {
+			t, err := texttemplate.New(name + ".json").Funcs(funcs).Parse(string(b))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			pages.json[status] = t
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return pages, nil
+}
+
+// jsonValue renders v as a JSON value for JSON templates
+func jsonValue(v any) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+// write renders page in the format r prefers
+func (ep *ErrorPages) write(w http.ResponseWriter, r *http.Request, page ErrorPage) {
+	status, msg := page.Status, page.Message
+
+	var body bytes.Buffer
+	var contentType string
+	var err error
+	switch errorFormat(r.Header.Get("Accept")) {
+	case "json":
+		contentType = "application/json"
+		if t := ep.jsonTemplate(status); t != nil {
+			err = t.Execute(&body, page)
+		} else {
+			err = json.NewEncoder(&body).Encode(struct {
+				Status      int    `json:"status"`
+				Error       string `json:"error"`
+				RequestID   string `json:"request_id"`
+				Maintenance bool   `json:"maintenance,omitempty"`
+			}{status, msg, page.RequestID, page.Maintenance})
+		}
+	case "html":
+		contentType = "text/html; charset=utf-8"
+		err = ep.htmlTemplate(status).Execute(&body, page)
+	default:
+		contentType = "text/plain; charset=utf-8"
+		fmt.Fprintf(&body, "%s\nrequest id: %s\n", msg, page.RequestID)
+	}
+	if err != nil {
+		log.Printf("Error page for %d: %v", status, err)
+		body.Reset()
+		contentType = "text/plain; charset=utf-8"
+		fmt.Fprintf(&body, "%s\nrequest id: %s\n", msg, page.RequestID)
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", contentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Cache-Control", "no-store")
+	h.Set(RequestIDHeader, page.RequestID)
+	w.WriteHeader(status)
+	w.Write(body.Bytes())
+}
+
+// htmlTemplate returns the HTML page for status
+func (ep *ErrorPages) htmlTemplate(status int) *htmltemplate.Template {
+	if ep != nil {
+		if t := ep.html[status]; t != nil {
+			return t
+		}
+		if t := ep.html[0]; t != nil {
+			return t
+		}
+	}
+	return defaultHTML
+}
+
+// jsonTemplate returns the JSON page for status, or nil for the built-in one
+func (ep *ErrorPages) jsonTemplate(status int) *texttemplate.Template {
+	if ep == nil {
+		return nil
+	}
+	if t := ep.json[status]; t != nil {
+		return t
+	}
+	return ep.json[0]
+}
+
+// errorFormat picks "json", "html" or "text" from an Accept header: the
+// acceptable JSON or HTML type with the highest q wins, earlier on ties.
+// Wildcards alone mean text, so curl and scripts keep getting plain text.
+func errorFormat(accept string) string {
+	best, bestQ := "text", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		var format string
+		switch {
+		case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+			format = "json"
+		case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+			format = "html"
+		default:
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > bestQ {
+			best, bestQ = format, q
+		}
+	}
+	return best
+}
+
+// newErrorPage returns the error page data for r
+func newErrorPage(r *http.Request, status int, msg string) ErrorPage {
+	return ErrorPage{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Message:    msg,
+		RequestID:  r.Header.Get(RequestIDHeader),
+		Host:       r.Host,
+	}
+}
+
+// writeError writes an error page generated by hoplb
+func (p *Proxy) writeError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	p.ErrorPages.write(w, r, newErrorPage(r, status, msg))
+}
+
+// writeMaintenance writes the 503 page for a route in maintenance mode
+func (p *Proxy) writeMaintenance(w http.ResponseWriter, r *http.Request) {
+	page := newErrorPage(r, http.StatusServiceUnavailable, "down for maintenance")
+	page.Maintenance = true
+	p.ErrorPages.write(w, r, page)
+}
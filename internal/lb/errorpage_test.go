@@ -0,0 +1,110 @@
+package lb
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestErrorFormat(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", "text"},
+		{"*/*", "text"},
+		{"application/json", "json"},
+		{"application/problem+json", "json"},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", "html"},
+		{"application/json;q=0.5, text/html", "html"},
+		{"text/html;q=0.2, application/json;q=0.9", "json"},
+		{"text/html, application/json", "html"}, // tie: first wins
+		{"text/html;q=0", "text"},
+		{"text/plain", "text"},
+	}
+	for _, tt := range tests {
+		if got := errorFormat(tt.accept); got != tt.want {
+			t.Errorf("errorFormat(%q) = %q; want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestProxyErrorPages(t *testing.T) {
+	proxy, _, _ := newTestProxy(t, "api.example.com", nil)
+
+	serve := func(host, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://"+host+"/", nil)
+		req.Header.Set(RequestIDHeader, "req-123")
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve("unknown.example.com", "application/json")
+	var body struct {
+		Status    int    `json:"status"`
+		Error     string `json:"error"`
+		RequestID string `json:"request_id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("JSON error page: %v: %s", err, w.Body)
+	}
+	if w.Code != http.StatusBadGateway || body.Status != 502 || body.Error != "no route for host" || body.RequestID != "req-123" {
+		t.Errorf("JSON error page = %d %+v", w.Code, body)
+	}
+
+	w = serve("unknown.example.com", "text/html")
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") || !strings.Contains(w.Body.String(), "req-123") {
+		t.Errorf("HTML error page = %q: %s", ct, w.Body)
+	}
+
+	w = serve("unknown.example.com", "")
+	if !strings.HasPrefix(w.Body.String(), "no route for host\n") || w.Header().Get(RequestIDHeader) != "req-123" {
+		t.Errorf("plain error page = %q, request ID header %q", w.Body, w.Header().Get(RequestIDHeader))
+	}
+
+	// Custom templates: per status, then the generic one
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "503.html"), []byte(`<p>Down for a moment ({{.RequestID}})</p>`), 0o644)
+	os.WriteFile(filepath.Join(dir, "error.html"), []byte(`<p>Oops {{.Status}}: {{.Message}}</p>`), 0o644)
+	os.WriteFile(filepath.Join(dir, "error.json"), []byte(`{"code": {{.Status}}, "id": {{json .RequestID}}}`), 0o644)
+	pages, err := LoadErrorPages(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.ErrorPages = pages
+	proxy.routeTable.Update(map[string]*Route{
+		"down.example.com": {Pattern: "down.example.com", Backends: []*Backend{{Address: "127.0.0.1:1"}}},
+		"private.example.com": {
+			Pattern:   "private.example.com",
+			Backends:  []*Backend{{Address: "127.0.0.1:1", Healthy: true}},
+			DenyCIDRs: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+		},
+	})
+
+	if w := serve("down.example.com", "text/html"); w.Code != 503 || w.Body.String() != "<p>Down for a moment (req-123)</p>" {
+		t.Errorf("custom 503 page = %d %q", w.Code, w.Body)
+	}
+	if w := serve("unknown.example.com", "text/html"); w.Body.String() != "<p>Oops 502: no route for host</p>" {
+		t.Errorf("custom error page = %q", w.Body)
+	}
+	if w := serve("private.example.com", "text/html"); w.Code != 403 || w.Body.String() != "<p>Oops 403: forbidden</p>" {
+		t.Errorf("custom 403 page = %d %q", w.Code, w.Body)
+	}
+	if w := serve("unknown.example.com", "application/json"); w.Body.String() != `{"code": 502, "id": "req-123"}` {
+		t.Errorf("custom JSON page = %q", w.Body)
+	}
+
+	os.WriteFile(filepath.Join(dir, "404.html"), []byte(`{{.Broken`), 0o644)
+	if _, err := LoadErrorPages(dir); err == nil {
+		t.Error("LoadErrorPages accepted a broken template")
+	}
+}
@@ -0,0 +1,133 @@
+package lb
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ForwardAuth delegates the access decision to an external service, like
+// Traefik ForwardAuth or nginx auth_request
+type ForwardAuth struct {
+	URL             string   // auth endpoint; empty = the proxy's ForwardAuthURL
+	ResponseHeaders []string // auth response headers copied to the upstream request
+
+	invalid bool // tag didn't parse: deny everything
+}
+
+// ParseForwardAuth parses a hoplb-forward-auth tag: "true" (use the global
+// endpoint) or an http(s) URL
+func ParseForwardAuth(tag string) (*ForwardAuth, error) {
+	switch strings.ToLower(strings.TrimSpace(tag)) {
+	case "true", "on", "1":
+		return &ForwardAuth{}, nil
+	}
+	u, err := url.Parse(tag)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("want true or an http(s) URL, got %q", tag)
+	}
+	return &ForwardAuth{URL: tag}, nil
+}
+
+// ParseHeaderList parses a comma-separated list of header names
+func ParseHeaderList(tag string) []string {
+	var headers []string
+	for _, h := range strings.Split(tag, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			headers = append(headers, http.CanonicalHeaderKey(h))
+		}
+	}
+	return headers
+}
+
+// newAuthClient returns the client for auth subrequests. Redirects are not
+// followed: a 302 to a login page must reach the user's browser.
+func newAuthClient() *http.Client {
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// hopHeaders are connection-specific and never forwarded
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// forwardAuth sends the auth subrequest for r. On 2xx it copies the
+// configured headers into r and returns true. Otherwise it writes the
+// auth service's response (or a 502 error page if it can't be reached)
+// to w and returns false with the rejection reason.
+func (p *Proxy) forwardAuth(w http.ResponseWriter, r *http.Request, fa *ForwardAuth) (bool, string) {
+	authURL := fa.URL
+	if authURL == "" {
+		authURL = p.ForwardAuthURL
+	}
+	if authURL == "" || fa.invalid {
+		log.Printf("Forward auth for %s enabled but no valid endpoint configured", r.Host)
+		http.Error(w, "auth misconfigured", http.StatusInternalServerError)
+		return false, "forward_auth_error"
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), "GET", authURL, nil)
+	if err != nil {
+		http.Error(w, "auth misconfigured", http.StatusInternalServerError)
+		return false, "forward_auth_error"
+	}
+
+	// The auth service sees the original request's headers (cookies,
+	// Authorization) and where it was headed
+	req.Header = r.Header.Clone()
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+	req.Header.Del("Content-Length")
+	proto := "http"
+	if p.isHTTPS(r) {
+		proto = "https"
+	}
+	req.Header.Set("X-Forwarded-Method", r.Method)
+	req.Header.Set("X-Forwarded-Proto", proto)
+	req.Header.Set("X-Forwarded-Host", r.Host)
+	req.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+	req.Header.Set("X-Forwarded-For", p.forwardedFor(r))
+
+	resp, err := p.authClient.Do(req)
+	if err != nil {
+		log.Printf("Forward auth for %s failed: %v", r.Host, err)
+		p.writeError(w, r, http.StatusBadGateway, "auth service unavailable")
+		return false, "forward_auth_error"
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		// Only the auth service may set these; drop client-supplied values
+		for _, h := range fa.ResponseHeaders {
+			r.Header.Del(h)
+			for _, v := range resp.Header.Values(h) {
+				r.Header.Add(h, v)
+			}
+		}
+		return true, ""
+	}
+
+	// Denied: relay the auth service's answer (login redirect, 401, ...)
+	for k, vs := range resp.Header {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	for _, h := range hopHeaders {
+		w.Header().Del(h)
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+	return false, "forward_auth"
+}
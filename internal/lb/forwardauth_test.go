@@ -0,0 +1,126 @@
+package lb
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestParseForwardAuth(t *testing.T) {
+	tests := []struct {
+		tag     string
+		wantURL string
+		wantErr bool
+	}{
+		{"true", "", false},
+		{"ON", "", false},
+		{"http://auth.internal:4181/verify", "http://auth.internal:4181/verify", false},
+		{"https://sso.example.com/auth", "https://sso.example.com/auth", false},
+		{"auth.internal", "", true},
+		{"ftp://auth.internal", "", true},
+	}
+	for _, tt := range tests {
+		fa, err := ParseForwardAuth(tt.tag)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseForwardAuth(%q) error = %v; wantErr %v", tt.tag, err, tt.wantErr)
+			continue
+		}
+		if err == nil && fa.URL != tt.wantURL {
+			t.Errorf("ParseForwardAuth(%q).URL = %q; want %q", tt.tag, fa.URL, tt.wantURL)
+		}
+	}
+}
+
+func TestProxyForwardAuth(t *testing.T) {
+	var seen http.Header
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Clone()
+		switch r.Header.Get("Cookie") {
+		case "session=good":
+			w.Header().Set("X-Auth-User", "alice")
+			w.Header().Set("X-Auth-Secret", "not-forwarded")
+		case "":
+			http.Redirect(w, r, "https://sso.example.com/login", http.StatusFound)
+		default:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="hop"`)
+			http.Error(w, "bad session", http.StatusUnauthorized)
+		}
+	}))
+	defer auth.Close()
+
+	var upstream http.Header
+	proxy, m, _ := newTestProxy(t, "dash.example.com", func(w http.ResponseWriter, r *http.Request) {
+		upstream = r.Header.Clone()
+	})
+	proxy.ForwardAuthURL = auth.URL
+	proxy.routeTable.Update(map[string]*Route{"dash.example.com": {
+		Pattern:     "dash.example.com",
+		Backends:    proxy.routeTable.Match("dash.example.com").Backends,
+		ForwardAuth: &ForwardAuth{ResponseHeaders: []string{"X-Auth-User"}},
+	}})
+
+	// Allowed: selected auth headers replace client-supplied ones
+	req := httptest.NewRequest("POST", "http://dash.example.com/api/x?y=1", nil)
+	req.Header.Set("Cookie", "session=good")
+	req.Header.Set("X-Auth-User", "mallory")
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("authorized request = %d; want 200", w.Code)
+	}
+	if upstream.Get("X-Auth-User") != "alice" || upstream.Get("X-Auth-Secret") != "" {
+		t.Errorf("upstream auth headers = %q/%q; want alice and nothing else", upstream.Get("X-Auth-User"), upstream.Get("X-Auth-Secret"))
+	}
+	if seen.Get("X-Forwarded-Method") != "POST" || seen.Get("X-Forwarded-Uri") != "/api/x?y=1" || seen.Get("X-Forwarded-Host") != "dash.example.com" {
+		t.Errorf("auth service saw %v; want original method, URI and host", seen)
+	}
+
+	// Behind a trusted proxy, the auth service gets the vouched-for chain
+	// and the scheme the client used
+	proxy.TrustedProxies = []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}
+	req = httptest.NewRequest("GET", "http://dash.example.com/", nil) // from 192.0.2.1
+	req.Header.Set("Cookie", "session=good")
+	req.Header.Set("X-Forwarded-For", "6.6.6.6, 203.0.113.7, 192.0.2.9")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	proxy.ServeHTTP(httptest.NewRecorder(), req)
+	if got := seen.Get("X-Forwarded-For"); got != "203.0.113.7, 192.0.2.9, 192.0.2.1" {
+		t.Errorf("auth service X-Forwarded-For = %q; want the trusted chain from the client", got)
+	}
+	if got := seen.Get("X-Forwarded-Proto"); got != "https" {
+		t.Errorf("auth service X-Forwarded-Proto = %q; want https", got)
+	}
+	proxy.TrustedProxies = nil
+
+	// Redirect to login is passed through, not followed
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "http://dash.example.com/", nil))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "https://sso.example.com/login" {
+		t.Errorf("unauthenticated request = %d %q; want 302 to login", w.Code, w.Header().Get("Location"))
+	}
+
+	// Denial is relayed as is
+	req = httptest.NewRequest("GET", "http://dash.example.com/", nil)
+	req.Header.Set("Cookie", "session=expired")
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	body, _ := io.ReadAll(w.Body)
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" || string(body) != "bad session\n" {
+		t.Errorf("denied request = %d %q; want auth service's 401", w.Code, body)
+	}
+
+	if got := m.Rejections()["dash.example.com"]["forward_auth"]; got != 2 {
+		t.Errorf("forward_auth rejections = %d; want 2", got)
+	}
+
+	// Unreachable auth service fails closed
+	auth.Close()
+	req = httptest.NewRequest("GET", "http://dash.example.com/", nil)
+	req.Header.Set("Accept", "application/json")
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	if w.Code != http.StatusBadGateway || w.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("request with auth service down = %d %q; want a 502 error page", w.Code, w.Header().Get("Content-Type"))
+	}
+}
@@ -0,0 +1,173 @@
+package lb
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// secureDefaults is the hoplb-security-headers preset. Backends that send
+// their own values for these keep them.
+var secureDefaults = map[string]string{
+	"X-Content-Type-Options":  "nosniff",
+	"X-Frame-Options":         "SAMEORIGIN",
+	"Referrer-Policy":         "strict-origin-when-cross-origin",
+	"Content-Security-Policy": "default-src 'self'; object-src 'none'; base-uri 'self'; frame-ancestors 'self'",
+}
+
+// leakyHeaders reveal backend software and are dropped by the preset
+var leakyHeaders = []string{"Server", "X-Powered-By", "X-AspNet-Version", "X-AspNetMvc-Version"}
+
+// HeaderRules rewrite the headers of a route's responses
+type HeaderRules struct {
+	Set     http.Header // replace whatever the backend sent
+	Default http.Header // only added if the backend sent none
+	Remove  []string    // dropped from the response
+}
+
+// SecureDefaults returns the preset: common security headers as defaults
+// and software-identifying headers removed
+func SecureDefaults() *HeaderRules {
+	rules := &HeaderRules{Default: make(http.Header), Remove: leakyHeaders}
+	for k, v := range secureDefaults {
+		rules.Default.Set(k, v)
+	}
+	return rules
+}
+
+// apply rewrites h: removals first, then defaults, then overrides
+func (hr *HeaderRules) apply(h http.Header) {
+	for _, k := range hr.Remove {
+		h.Del(k)
+	}
+	for k, vs := range hr.Default {
+		if _, ok := h[k]; !ok {
+			h[k] = append([]string(nil), vs...)
+		}
+	}
+	for k, vs := range hr.Set {
+		h[k] = append([]string(nil), vs...)
+	}
+}
+
+// headerWriter applies a route's response header rules to responses
+// hoplb writes itself: redirects, error pages, auth challenges. Backend
+// responses already had the rules applied, which is harmless to repeat.
+type headerWriter struct {
+	http.ResponseWriter
+	rules   *HeaderRules
+	applied bool
+}
+
+// WriteHeader applies the rules before the final status goes out
+func (w *headerWriter) WriteHeader(code int) {
+	if !w.applied && code >= 200 {
+		w.rules.apply(w.Header())
+		w.applied = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write sends the header first if needed, like http.ResponseWriter
+func (w *headerWriter) Write(b []byte) (int, error) {
+	if !w.applied {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap exposes the underlying writer so http.ResponseController can flush
+func (w *headerWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// validHeaderName reports whether name is a usable header field name
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c <= ' ' || c >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseHeaderRules builds response header rules from a job's tags
+func parseHeaderRules(tags map[string]string) (*HeaderRules, []error) {
+	var rules *HeaderRules
+	var errs []error
+
+	if v := tags[TagSecurityHeaders]; v != "" {
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "true", "secure-defaults":
+			rules = SecureDefaults()
+		case "false":
+		default:
+			errs = append(errs, fmt.Errorf("%s: want true or secure-defaults, got %q", TagSecurityHeaders, v))
+		}
+	}
+	if rules == nil {
+		rules = &HeaderRules{}
+	}
+
+	for tag, v := range tags {
+		name, ok := strings.CutPrefix(tag, TagResponseHeaderPrefix)
+		if !ok {
+			continue
+		}
+		if !validHeaderName(name) || strings.ContainsAny(v, "\r\n") {
+			errs = append(errs, fmt.Errorf("%s: invalid header %q", tag, name))
+			continue
+		}
+		if rules.Set == nil {
+			rules.Set = make(http.Header)
+		}
+		rules.Set.Set(name, v)
+	}
+
+	if v := tags[TagRemoveResponseHeaders]; v != "" {
+		rules.Remove = append(append([]string(nil), rules.Remove...), ParseHeaderList(v)...)
+	}
+
+	if len(rules.Set) == 0 && len(rules.Default) == 0 && len(rules.Remove) == 0 {
+		return nil, errs
+	}
+	return rules, errs
+}
+
+// parseRequestHeaders reads hoplb-request-header.<Name> tags: headers set
+// on requests to the backend. Values may use {name} captures of the host
+// pattern.
+func parseRequestHeaders(tags map[string]string) (map[string]string, []error) {
+	var headers map[string]string
+	var errs []error
+	for tag, v := range tags {
+		name, ok := strings.CutPrefix(tag, TagRequestHeaderPrefix)
+		if !ok {
+			continue
+		}
+		if !validHeaderName(name) || strings.ContainsAny(v, "\r\n") {
+			errs = append(errs, fmt.Errorf("%s: invalid header %q", tag, name))
+			continue
+		}
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		headers[http.CanonicalHeaderKey(name)] = v
+	}
+	return headers, errs
+}
+
+// setRequestHeaders sets the route's request headers on h, replacing
+// client-supplied values
+func (r *Route) setRequestHeaders(h http.Header, vars Vars) {
+	for name, v := range r.RequestHeaders {
+		v = expandVars(v, vars)
+		if strings.ContainsAny(v, "\r\n") {
+			continue
+		}
+		h.Set(name, v)
+	}
+}
@@ -0,0 +1,125 @@
+package lb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestParseHeaderRules(t *testing.T) {
+	rules, errs := parseHeaderRules(map[string]string{
+		TagSecurityHeaders:                             "secure-defaults",
+		TagResponseHeaderPrefix + "x-frame-options":    "DENY",
+		TagResponseHeaderPrefix + "Permissions-Policy": "geolocation=(), camera=()",
+		TagResponseHeaderPrefix + "Bad Header":         "x",
+		TagRemoveResponseHeaders:                       "Via, X-Runtime",
+	})
+	if len(errs) != 1 {
+		t.Errorf("errors = %v; want one for the invalid header name", errs)
+	}
+	if rules.Set.Get("X-Frame-Options") != "DENY" || rules.Set.Get("Permissions-Policy") != "geolocation=(), camera=()" {
+		t.Errorf("Set = %v", rules.Set)
+	}
+	if rules.Default.Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("Default = %v; want the preset", rules.Default)
+	}
+	if len(rules.Remove) != len(leakyHeaders)+2 || len(leakyHeaders) != 4 {
+		t.Errorf("Remove = %v; want the preset plus Via and X-Runtime", rules.Remove)
+	}
+
+	if rules, errs := parseHeaderRules(map[string]string{TagURLPrefix: "a.example.com"}); rules != nil || errs != nil {
+		t.Errorf("no header tags = %v, %v; want nil", rules, errs)
+	}
+}
+
+func TestProxyResponseHeaders(t *testing.T) {
+	proxy, _, addr := newTestProxy(t, "app.example.com", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "Apache/2.4.1 (Unix)")
+		w.Header().Set("X-Powered-By", "PHP/5.6")
+		w.Header().Set("Content-Security-Policy", "default-src 'self' cdn.example.com")
+		w.Header().Set("X-Frame-Options", "ALLOWALL")
+		w.Header().Set("Cache-Control", "no-store")
+	})
+	rules := SecureDefaults()
+	rules.Set = http.Header{"X-Frame-Options": {"DENY"}}
+	proxy.routeTable.Update(map[string]*Route{"app.example.com": {
+		Pattern:         "app.example.com",
+		Backends:        []*Backend{{Address: addr, Healthy: true}},
+		ResponseHeaders: rules,
+	}})
+
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "http://app.example.com/", nil))
+
+	want := map[string]string{
+		"Server":                  "",
+		"X-Powered-By":            "",
+		"Content-Security-Policy": "default-src 'self' cdn.example.com", // backend's own policy kept
+		"X-Frame-Options":         "DENY",                               // explicit tag overrides
+		"X-Content-Type-Options":  "nosniff",
+		"Referrer-Policy":         "strict-origin-when-cross-origin",
+		"Cache-Control":           "no-store",
+	}
+	for k, v := range want {
+		if got := w.Header().Values(k); len(got) > 1 || w.Header().Get(k) != v {
+			t.Errorf("%s = %q; want %q", k, got, v)
+		}
+	}
+}
+
+func TestProxyResponseHeadersOnOwnResponses(t *testing.T) {
+	proxy, _, addr := newTestProxy(t, "app.example.com", nil)
+	rules := SecureDefaults()
+	rules.Set = http.Header{"X-Frame-Options": {"DENY"}}
+	proxy.routeTable.Update(map[string]*Route{
+		"app.example.com": {
+			Pattern:         "app.example.com",
+			Backends:        []*Backend{{Address: addr, Healthy: true}},
+			ResponseHeaders: rules,
+			DenyCIDRs:       []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+		},
+		"down.example.com": {
+			Pattern:         "down.example.com",
+			ResponseHeaders: rules,
+			HTTPSRedirect:   http.StatusMovedPermanently,
+		},
+	})
+
+	for _, url := range []string{"http://app.example.com/", "http://down.example.com/"} {
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		if w.Code < 300 {
+			t.Fatalf("%s = %d; want a response from hoplb itself", url, w.Code)
+		}
+		if w.Header().Get("X-Frame-Options") != "DENY" || w.Header().Get("Referrer-Policy") == "" {
+			t.Errorf("%s (%d) headers = %v; want the route's rules applied", url, w.Code, w.Header())
+		}
+	}
+}
+
+func TestProxyRequestHeadersFromCaptures(t *testing.T) {
+	var upstream http.Header
+	proxy, _, addr := newTestProxy(t, "unused.example.com", func(w http.ResponseWriter, r *http.Request) {
+		upstream = r.Header.Clone()
+	})
+	proxy.routeTable.Update(map[string]*Route{`~cust-(?P<customer>\d+)\.app\.eu`: {
+		Pattern:  `~cust-(?P<customer>\d+)\.app\.eu`,
+		Backends: []*Backend{{Address: addr, Healthy: true}},
+		RequestHeaders: map[string]string{
+			"X-Customer-Id": "{customer}",
+			"X-Env":         "prod",
+		},
+	}})
+
+	req := httptest.NewRequest("GET", "http://cust-42.app.eu/", nil)
+	req.Header.Set("X-Customer-Id", "1") // spoofed
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want 200", w.Code)
+	}
+	if got := upstream.Values("X-Customer-Id"); len(got) != 1 || got[0] != "42" || upstream.Get("X-Env") != "prod" {
+		t.Errorf("upstream headers = %v / %q; want X-Customer-Id 42 and X-Env prod", got, upstream.Get("X-Env"))
+	}
+}
@@ -0,0 +1,111 @@
+package lb
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Vars are the named captures of a regex or template host pattern
+type Vars map[string]string
+
+// isHostRegexp reports whether pattern is a regex ("~^cust-(?P<id>\d+)\.app\.eu$")
+// or template ("{customer}.app.eu") pattern rather than a plain host or wildcard
+func isHostRegexp(pattern string) bool {
+	return strings.HasPrefix(pattern, "~") || strings.Contains(pattern, "{")
+}
+
+// compileHostPattern compiles a regex or template host pattern. The whole
+// host must match. In templates, {name} captures one label.
+func compileHostPattern(pattern string) (*regexp.Regexp, error) {
+	var expr string
+	if re, ok := strings.CutPrefix(pattern, "~"); ok {
+		expr = "^(?:" + re + ")$"
+	} else {
+		var b strings.Builder
+		b.WriteString("^")
+		rest := pattern
+		for {
+			open := strings.Index(rest, "{")
+			if open == -1 {
+				break
+			}
+			end := strings.Index(rest[open:], "}")
+			if end == -1 {
+				return nil, fmt.Errorf("unclosed { in %q", pattern)
+			}
+			name := rest[open+1 : open+end]
+			if !validVarName(name) {
+				return nil, fmt.Errorf("invalid variable {%s} in %q", name, pattern)
+			}
+			b.WriteString(regexp.QuoteMeta(rest[:open]))
+			b.WriteString("(?P<" + name + ">[^.]+)")
+			rest = rest[open+end+1:]
+		}
+		b.WriteString(regexp.QuoteMeta(rest))
+		b.WriteString("$")
+		expr = b.String()
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("host pattern %q: %w", pattern, err)
+	}
+	return re, nil
+}
+
+// validVarName reports whether name is usable as a capture name
+func validVarName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		if c != '_' && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (i == 0 || c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// captures returns the named groups of re matched against host
+func captures(re *regexp.Regexp, host string) (Vars, bool) {
+	m := re.FindStringSubmatch(host)
+	if m == nil {
+		return nil, false
+	}
+	vars := make(Vars)
+	for i, name := range re.SubexpNames() {
+		if name != "" {
+			vars[name] = m[i]
+		}
+	}
+	return vars, true
+}
+
+// expandVars replaces {name} in s with the captured value. Braces that
+// don't name a capture are left alone.
+func expandVars(s string, vars Vars) string {
+	if len(vars) == 0 || !strings.Contains(s, "{") {
+		return s
+	}
+	var b strings.Builder
+	for {
+		open := strings.Index(s, "{")
+		if open == -1 {
+			break
+		}
+		end := strings.Index(s[open:], "}")
+		if end == -1 {
+			break
+		}
+		b.WriteString(s[:open])
+		if v, ok := vars[s[open+1:open+end]]; ok {
+			b.WriteString(v)
+		} else {
+			b.WriteString(s[open : open+end+1])
+		}
+		s = s[open+end+1:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
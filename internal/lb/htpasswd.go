@@ -0,0 +1,326 @@
+package lb
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxPasswordLen bounds the passwords hashed per request. SHA-crypt's
+// cost grows with the square of the password length.
+const maxPasswordLen = 1024
+
+// htpasswdFile is an htpasswd file that is re-read when it changes.
+// Supported hashes: $apr1$ (htpasswd -m), $5$/$6$ SHA-crypt and {SHA}.
+// bcrypt entries are skipped with a warning.
+type htpasswdFile struct {
+	path string
+
+	mu      sync.Mutex
+	users   map[string]string // user -> hash
+	modTime time.Time
+	checked time.Time
+	lastErr string // logged once until it changes
+}
+
+func newHtpasswdFile(path string) *htpasswdFile {
+	return &htpasswdFile{path: path}
+}
+
+// verify checks user/password against the current file contents.
+// Passwords longer than maxPasswordLen are rejected without hashing.
+func (f *htpasswdFile) verify(user, password string) bool {
+	if len(password) > maxPasswordLen {
+		return false
+	}
+	f.mu.Lock()
+	f.reloadLocked()
+	hash, ok := f.users[user]
+	f.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+	return checkPassword(hash, password)
+}
+
+// reloadLocked re-reads the file if it changed, checking at most every
+// few seconds, also while it is missing or broken. A file that can't be
+// read keeps the last good contents.
+func (f *htpasswdFile) reloadLocked() {
+	if !f.checked.IsZero() && time.Since(f.checked) < 5*time.Second {
+		return
+	}
+	f.checked = time.Now()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		f.logError(err)
+		return
+	}
+	if f.users != nil && info.ModTime().Equal(f.modTime) {
+		return
+	}
+
+	users, err := readHtpasswd(f.path)
+	if err != nil {
+		f.logError(err)
+		return
+	}
+	f.users = users
+	f.modTime = info.ModTime()
+	f.lastErr = ""
+}
+
+// logError logs err unless it is the error logged last
+func (f *htpasswdFile) logError(err error) {
+	if msg := err.Error(); msg != f.lastErr {
+		log.Printf("htpasswd %s: %v", f.path, err)
+		f.lastErr = msg
+	}
+}
+
+// readHtpasswd parses "user:hash" lines, skipping blanks and # comments
+func readHtpasswd(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("line %d: missing ':'", n)
+		}
+		if strings.HasPrefix(hash, "$2") {
+			log.Printf("htpasswd %s: user %s uses bcrypt, which hoplb can't verify; use htpasswd -m or -5", path, user)
+			continue
+		}
+		users[user] = hash
+	}
+	return users, scanner.Err()
+}
+
+// checkPassword verifies password against an htpasswd hash
+func checkPassword(hash, password string) bool {
+	var computed string
+	switch {
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		computed = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(hash, "$apr1$"):
+		computed = apr1Crypt(password, cryptSalt(hash, "$apr1$"))
+	case strings.HasPrefix(hash, "$5$"):
+		computed = shaCrypt(sha256.New, "$5$", password, hash[len("$5$"):])
+	case strings.HasPrefix(hash, "$6$"):
+		computed = shaCrypt(sha512.New, "$6$", password, hash[len("$6$"):])
+	default:
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1
+}
+
+// cryptSalt extracts the salt from "<magic><salt>$<hash>"
+func cryptSalt(hash, magic string) string {
+	salt, _, _ := strings.Cut(hash[len(magic):], "$")
+	return salt
+}
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// cryptBase64 appends n characters encoding v, low bits first
+func cryptBase64(b []byte, v uint32, n int) []byte {
+	for ; n > 0; n-- {
+		b = append(b, cryptAlphabet[v&0x3f])
+		v >>= 6
+	}
+	return b
+}
+
+// apr1Crypt is Apache's MD5-based crypt ($apr1$)
+func apr1Crypt(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	h := md5.New()
+	h.Write(pw)
+	h.Write([]byte(magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		h.Write(altSum[:min(i, 16)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	final := h.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		h := md5.New()
+		if i&1 != 0 {
+			h.Write(pw)
+		} else {
+			h.Write(final)
+		}
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			h.Write(pw)
+		}
+		if i&1 != 0 {
+			h.Write(final)
+		} else {
+			h.Write(pw)
+		}
+		final = h.Sum(nil)
+	}
+
+	out := []byte(magic + salt + "$")
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		out = cryptBase64(out, uint32(final[g[0]])<<16|uint32(final[g[1]])<<8|uint32(final[g[2]]), 4)
+	}
+	out = cryptBase64(out, uint32(final[11]), 2)
+	return string(out)
+}
+
+// Byte order of the SHA-crypt output encoding (groups of three bytes)
+var (
+	sha256CryptOrder = [][3]int{
+		{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+		{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29},
+	}
+	sha512CryptOrder = [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+		{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+		{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+		{62, 20, 41},
+	}
+)
+
+// shaCrypt is the SHA-256/512 crypt from glibc ($5$, $6$). spec is the
+// part after magic: "[rounds=N$]salt[$hash]".
+func shaCrypt(newHash func() hash.Hash, magic, password, spec string) string {
+	rounds, explicitRounds := 5000, false
+	if r, ok := strings.CutPrefix(spec, "rounds="); ok {
+		n, rest, _ := strings.Cut(r, "$")
+		if v, err := strconv.Atoi(n); err == nil {
+			rounds = min(max(v, 1000), 999999999)
+			explicitRounds = true
+			spec = rest
+		}
+	}
+	salt, _, _ := strings.Cut(spec, "$")
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+	pw, s := []byte(password), []byte(salt)
+
+	b := newHash()
+	b.Write(pw)
+	b.Write(s)
+	b.Write(pw)
+	bSum := b.Sum(nil)
+	size := len(bSum)
+
+	a := newHash()
+	a.Write(pw)
+	a.Write(s)
+	for i := len(pw); i > 0; i -= size {
+		a.Write(bSum[:min(i, size)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			a.Write(bSum)
+		} else {
+			a.Write(pw)
+		}
+	}
+	c := a.Sum(nil)
+
+	dp := newHash()
+	for range pw {
+		dp.Write(pw)
+	}
+	dpSum := dp.Sum(nil)
+	p := make([]byte, 0, len(pw))
+	for i := len(pw); i > 0; i -= size {
+		p = append(p, dpSum[:min(i, size)]...)
+	}
+
+	ds := newHash()
+	for i := 0; i < 16+int(c[0]); i++ {
+		ds.Write(s)
+	}
+	sp := ds.Sum(nil)[:len(s)]
+
+	for i := 0; i < rounds; i++ {
+		h := newHash()
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(sp)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(p)
+		}
+		c = h.Sum(nil)
+	}
+
+	out := []byte(magic)
+	if explicitRounds {
+		out = append(out, "rounds="+strconv.Itoa(rounds)+"$"...)
+	}
+	out = append(out, salt+"$"...)
+	if size == sha256.Size {
+		for _, g := range sha256CryptOrder {
+			out = cryptBase64(out, uint32(c[g[0]])<<16|uint32(c[g[1]])<<8|uint32(c[g[2]]), 4)
+		}
+		out = cryptBase64(out, uint32(c[31])<<8|uint32(c[30]), 3)
+	} else {
+		for _, g := range sha512CryptOrder {
+			out = cryptBase64(out, uint32(c[g[0]])<<16|uint32(c[g[1]])<<8|uint32(c[g[2]]), 4)
+		}
+		out = cryptBase64(out, uint32(c[63]), 2)
+	}
+	return string(out)
+}
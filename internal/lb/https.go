@@ -0,0 +1,118 @@
+package lb
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// HSTSHeader is the response header carrying the HSTS policy
+const HSTSHeader = "Strict-Transport-Security"
+
+// HSTS is a Strict-Transport-Security policy sent on HTTPS responses
+type HSTS struct {
+	MaxAge            int // seconds
+	IncludeSubDomains bool
+	Preload           bool
+}
+
+// String renders the header value
+func (h HSTS) String() string {
+	v := "max-age=" + strconv.Itoa(h.MaxAge)
+	if h.IncludeSubDomains {
+		v += "; includeSubDomains"
+	}
+	if h.Preload {
+		v += "; preload"
+	}
+	return v
+}
+
+// ParseHSTS parses a hoplb-hsts tag. It uses the header's own syntax
+// ("max-age=31536000; includeSubDomains; preload"); "true" means one year.
+func ParseHSTS(tag string) (HSTS, error) {
+	tag = strings.TrimSpace(tag)
+	if strings.EqualFold(tag, "true") {
+		return HSTS{MaxAge: 31536000}, nil
+	}
+
+	h := HSTS{MaxAge: -1}
+	for _, part := range strings.Split(tag, ";") {
+		part = strings.TrimSpace(part)
+		switch {
+		case part == "":
+		case strings.EqualFold(part, "includeSubDomains"):
+			h.IncludeSubDomains = true
+		case strings.EqualFold(part, "preload"):
+			h.Preload = true
+		case strings.HasPrefix(strings.ToLower(part), "max-age="):
+			n, err := strconv.Atoi(part[len("max-age="):])
+			if err != nil || n < 0 {
+				return HSTS{}, fmt.Errorf("invalid max-age %q", part)
+			}
+			h.MaxAge = n
+		default:
+			return HSTS{}, fmt.Errorf("unknown directive %q", part)
+		}
+	}
+	if h.MaxAge < 0 {
+		return HSTS{}, fmt.Errorf("max-age is required")
+	}
+	// Requirements of the browser preload lists
+	if h.Preload && (!h.IncludeSubDomains || h.MaxAge < 31536000) {
+		return HSTS{}, fmt.Errorf("preload needs includeSubDomains and max-age of at least 31536000")
+	}
+	return h, nil
+}
+
+// ParseHTTPSRedirect parses a hoplb-https-redirect tag: "true" (301 for
+// GET/HEAD, 308 otherwise so bodies are resent), "301", "308" or "false"
+func ParseHTTPSRedirect(tag string) (int, error) {
+	switch strings.ToLower(strings.TrimSpace(tag)) {
+	case "true", "on", "1":
+		return -1, nil
+	case "false", "off", "0":
+		return 0, nil
+	case "301":
+		return http.StatusMovedPermanently, nil
+	case "308":
+		return http.StatusPermanentRedirect, nil
+	}
+	return 0, fmt.Errorf("want true, false, 301 or 308, got %q", tag)
+}
+
+// isHTTPS reports whether the client reached hoplb over TLS, either
+// directly or through a trusted proxy that set X-Forwarded-Proto
+func (p *Proxy) isHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	return containsAddr(p.TrustedProxies, remoteAddr(r)) &&
+		strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// redirectToHTTPS writes the redirect to the https:// URL of r
+func (p *Proxy) redirectToHTTPS(w http.ResponseWriter, r *http.Request, code int) int {
+	if code < 0 {
+		code = http.StatusMovedPermanently
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			code = http.StatusPermanentRedirect
+		}
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if p.HTTPSPort != "" && p.HTTPSPort != "443" {
+		host = net.JoinHostPort(host, p.HTTPSPort)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]" // IPv6 literal
+	}
+
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), code)
+	return code
+}
@@ -0,0 +1,120 @@
+package lb
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestParseHSTS(t *testing.T) {
+	tests := []struct {
+		tag     string
+		want    string
+		wantErr bool
+	}{
+		{"true", "max-age=31536000", false},
+		{"max-age=300", "max-age=300", false},
+		{"max-age=63072000; includeSubDomains; preload", "max-age=63072000; includeSubDomains; preload", false},
+		{"includesubdomains;max-age=0", "max-age=0; includeSubDomains", false},
+		{"includeSubDomains", "", true},
+		{"max-age=-1", "", true},
+		{"max-age=300; preload", "", true}, // preload needs a year and subdomains
+		{"max-age=300; always", "", true},
+	}
+	for _, tt := range tests {
+		h, err := ParseHSTS(tt.tag)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseHSTS(%q) error = %v; wantErr %v", tt.tag, err, tt.wantErr)
+			continue
+		}
+		if err == nil && h.String() != tt.want {
+			t.Errorf("ParseHSTS(%q) = %q; want %q", tt.tag, h.String(), tt.want)
+		}
+	}
+}
+
+func TestProxyHTTPSRedirect(t *testing.T) {
+	proxy, m, addr := newTestProxy(t, "app.example.com", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(HSTSHeader, "max-age=5")
+	})
+	proxy.TrustedProxies = []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	proxy.routeTable.Update(map[string]*Route{"app.example.com": {
+		Pattern:       "app.example.com",
+		Backends:      []*Backend{{Address: addr, Healthy: true}},
+		HTTPSRedirect: -1,
+		HSTS:          &HSTS{MaxAge: 31536000, IncludeSubDomains: true},
+	}})
+
+	tests := []struct {
+		name         string
+		method, url  string
+		tls          bool
+		remote, xfp  string
+		httpsPort    string
+		wantCode     int
+		wantLocation string
+	}{
+		{"GET", "GET", "http://app.example.com/a?b=1", false, "", "", "", 301, "https://app.example.com/a?b=1"},
+		{"POST keeps method", "POST", "http://app.example.com/form", false, "", "", "", 308, "https://app.example.com/form"},
+		{"listener port dropped", "GET", "http://app.example.com:8080/", false, "", "", "443", 301, "https://app.example.com/"},
+		{"custom HTTPS port", "GET", "http://app.example.com:8080/", false, "", "", "8443", 301, "https://app.example.com:8443/"},
+		{"already TLS", "GET", "https://app.example.com/", true, "", "", "", 200, ""},
+		{"TLS terminated by trusted proxy", "GET", "http://app.example.com/", false, "10.1.2.3:5000", "https", "", 200, ""},
+		{"X-Forwarded-Proto from untrusted peer", "GET", "http://app.example.com/", false, "203.0.113.9:5000", "https", "", 301, "https://app.example.com/"},
+	}
+	for _, tt := range tests {
+		proxy.HTTPSPort = tt.httpsPort
+		req := httptest.NewRequest(tt.method, tt.url, nil)
+		if tt.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+		if tt.remote != "" {
+			req.RemoteAddr = tt.remote
+		}
+		if tt.xfp != "" {
+			req.Header.Set("X-Forwarded-Proto", tt.xfp)
+		}
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		if w.Code != tt.wantCode || w.Header().Get("Location") != tt.wantLocation {
+			t.Errorf("%s: got %d %q; want %d %q", tt.name, w.Code, w.Header().Get("Location"), tt.wantCode, tt.wantLocation)
+		}
+
+		// HSTS only over HTTPS, and the route's policy replaces the backend's
+		wantHSTS := ""
+		if tt.wantCode == 200 {
+			wantHSTS = "max-age=31536000; includeSubDomains"
+		}
+		if got := w.Header().Values(HSTSHeader); len(got) > 1 || w.Header().Get(HSTSHeader) != wantHSTS {
+			t.Errorf("%s: HSTS = %q; want %q", tt.name, got, wantHSTS)
+		}
+	}
+
+	if got := m.RequestCounts()["app.example.com"][""][301]; got != 2 {
+		t.Errorf("recorded redirects = %d; want 2", got)
+	}
+}
+
+func TestRedirectToHTTPSIPv6(t *testing.T) {
+	tests := []struct {
+		host, httpsPort, want string
+	}{
+		{"[::1]", "", "https://[::1]/a"},
+		{"[::1]:8080", "", "https://[::1]/a"},
+		{"[::1]", "8443", "https://[::1]:8443/a"},
+		{"[::1]:8080", "8443", "https://[::1]:8443/a"},
+		{"::1", "", "https://[::1]/a"},
+	}
+	for _, tt := range tests {
+		p := &Proxy{HTTPSPort: tt.httpsPort}
+		req := httptest.NewRequest("GET", "/a", nil)
+		req.Host = tt.host
+		w := httptest.NewRecorder()
+		p.redirectToHTTPS(w, req, -1)
+		if got := w.Header().Get("Location"); got != tt.want {
+			t.Errorf("Host %q, HTTPS port %q: Location = %q; want %q", tt.host, tt.httpsPort, got, tt.want)
+		}
+	}
+}
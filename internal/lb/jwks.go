@@ -0,0 +1,294 @@
+package lb
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JWKS refresh intervals
+const (
+	jwksURLTTL           = 10 * time.Minute // refetch a JWKS URL this often
+	jwksMinRefetch       = 30 * time.Second // earliest refetch on an unknown kid
+	jwksRecheck          = 5 * time.Second  // stat a file or retry a failed fetch at most this often
+	jwksMaxSize    int64 = 1 << 20
+)
+
+// jwk is a verification key from a JSON Web Key Set
+type jwk struct {
+	kid string
+	alg string // optional; restricts the key to one algorithm
+	key any    // *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey or []byte (oct)
+}
+
+// keySet is a JWKS loaded from a file or URL. Files are re-read when they
+// change; URLs are refetched periodically and when a token names an
+// unknown kid. Loads run in the background, one at a time, while requests
+// keep using the previous keys.
+type keySet struct {
+	source string
+	client *http.Client
+
+	mu      sync.Mutex
+	keys    []jwk
+	loaded  time.Time     // last successful load
+	tried   time.Time     // last load attempt
+	modTime time.Time     // file only
+	loading chan struct{} // closed when the load in flight finishes
+}
+
+func newKeySet(source string) *keySet {
+	return &keySet{source: source, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (ks *keySet) isURL() bool {
+	return strings.HasPrefix(ks.source, "http://") || strings.HasPrefix(ks.source, "https://")
+}
+
+// lookup returns the keys that may have signed a token with this kid.
+// Only requests that can't be served from the current keys wait for a
+// load: the first ones, and those naming a kid that isn't known yet.
+// An error means no keys could be loaded at all.
+func (ks *keySet) lookup(kid string) ([]jwk, error) {
+	now := time.Now()
+	ks.mu.Lock()
+	stale := now.Sub(ks.tried) >= jwksRecheck
+	if ks.isURL() {
+		stale = stale && (ks.keys == nil || now.Sub(ks.loaded) >= jwksURLTTL)
+	}
+	if stale {
+		ks.startLoadLocked(now)
+	}
+	keys, loading := ks.keys, ks.loading
+	ks.mu.Unlock()
+
+	if keys == nil && loading != nil {
+		<-loading
+		keys = ks.current()
+	}
+	if keys == nil {
+		return nil, fmt.Errorf("no keys loaded from %s", ks.source)
+	}
+
+	matches := match(keys, kid)
+	if len(matches) == 0 {
+		// Keys may have been rotated since the last load
+		ks.mu.Lock()
+		if ks.isURL() && now.Sub(ks.tried) >= jwksMinRefetch {
+			ks.startLoadLocked(now)
+		}
+		loading = ks.loading
+		ks.mu.Unlock()
+		if loading != nil {
+			<-loading
+			matches = match(ks.current(), kid)
+		}
+	}
+	return matches, nil
+}
+
+// current returns the loaded keys
+func (ks *keySet) current() []jwk {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return ks.keys
+}
+
+// match returns keys with the given kid, or all keys if kid is empty
+func match(keys []jwk, kid string) []jwk {
+	var matches []jwk
+	for _, k := range keys {
+		if kid == "" || k.kid == kid {
+			matches = append(matches, k)
+		}
+	}
+	return matches
+}
+
+// startLoadLocked starts loading the key set unless a load is already in
+// flight
+func (ks *keySet) startLoadLocked(now time.Time) {
+	if ks.loading != nil {
+		return
+	}
+	ks.tried = now
+	done := make(chan struct{})
+	ks.loading = done
+	modTime := ks.modTime
+	if ks.keys == nil {
+		modTime = time.Time{}
+	}
+
+	go func() {
+		keys, modTime, err := ks.load(modTime)
+		if err != nil {
+			log.Printf("JWKS %s: %v", ks.source, err)
+		}
+		ks.mu.Lock()
+		if keys != nil {
+			ks.keys = keys
+			ks.loaded = now
+		}
+		ks.modTime = modTime
+		ks.loading = nil
+		ks.mu.Unlock()
+		close(done)
+	}()
+}
+
+// load reads the key set. A file whose modification time is still
+// modTime isn't read again and yields nil keys.
+func (ks *keySet) load(modTime time.Time) ([]jwk, time.Time, error) {
+	var data []byte
+	if ks.isURL() {
+		resp, err := ks.client.Get(ks.source)
+		if err != nil {
+			return nil, modTime, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, modTime, fmt.Errorf("HTTP %d", resp.StatusCode)
+		}
+		if data, err = io.ReadAll(io.LimitReader(resp.Body, jwksMaxSize)); err != nil {
+			return nil, modTime, err
+		}
+	} else {
+		info, err := os.Stat(ks.source)
+		if err != nil {
+			return nil, modTime, err
+		}
+		if info.ModTime().Equal(modTime) {
+			return nil, modTime, nil
+		}
+		if data, err = os.ReadFile(ks.source); err != nil {
+			return nil, modTime, err
+		}
+		modTime = info.ModTime()
+	}
+
+	keys, err := parseJWKS(data)
+	return keys, modTime, err
+}
+
+// parseJWKS parses a JWK Set. Keys that aren't for signatures or can't be
+// parsed are skipped.
+func parseJWKS(data []byte) ([]jwk, error) {
+	var set struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+
+	keys := []jwk{}
+	for _, raw := range set.Keys {
+		k, err := parseJWK(raw)
+		if err != nil {
+			log.Printf("Skipping JWK: %v", err)
+			continue
+		}
+		if k != nil {
+			keys = append(keys, *k)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS has no usable signing keys")
+	}
+	return keys, nil
+}
+
+// parseJWK parses one key. Encryption keys yield nil.
+func parseJWK(raw []byte) (*jwk, error) {
+	var j struct {
+		Kty, Kid, Alg, Use, Crv string
+		N, E, X, Y, K           string
+	}
+	if err := json.Unmarshal(raw, &j); err != nil {
+		return nil, err
+	}
+	if j.Use != "" && j.Use != "sig" {
+		return nil, nil
+	}
+
+	k := &jwk{kid: j.Kid, alg: j.Alg}
+	switch j.Kty {
+	case "RSA":
+		n, err1 := decodeBigInt(j.N)
+		e, err2 := decodeBigInt(j.E)
+		if err1 != nil || err2 != nil || !e.IsInt64() || e.Int64() < 3 {
+			return nil, fmt.Errorf("kid %q: invalid RSA key", j.Kid)
+		}
+		k.key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case "EC":
+		pub, err := parseECKey(j.Crv, j.X, j.Y)
+		if err != nil {
+			return nil, fmt.Errorf("kid %q: %w", j.Kid, err)
+		}
+		k.key = pub
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if j.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("kid %q: unsupported OKP key", j.Kid)
+		}
+		k.key = ed25519.PublicKey(x)
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(j.K)
+		if err != nil || len(secret) == 0 {
+			return nil, fmt.Errorf("kid %q: invalid oct key", j.Kid)
+		}
+		k.key = secret
+	default:
+		return nil, fmt.Errorf("kid %q: unsupported key type %q", j.Kid, j.Kty)
+	}
+	return k, nil
+}
+
+// parseECKey builds an ECDSA public key, checking the point is on the curve
+func parseECKey(crv, xs, ys string) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	var validate ecdh.Curve
+	switch crv {
+	case "P-256":
+		curve, validate = elliptic.P256(), ecdh.P256()
+	case "P-384":
+		curve, validate = elliptic.P384(), ecdh.P384()
+	case "P-521":
+		curve, validate = elliptic.P521(), ecdh.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %q", crv)
+	}
+
+	size := (curve.Params().BitSize + 7) / 8
+	x, err1 := base64.RawURLEncoding.DecodeString(xs)
+	y, err2 := base64.RawURLEncoding.DecodeString(ys)
+	if err1 != nil || err2 != nil || len(x) != size || len(y) != size {
+		return nil, errors.New("invalid EC coordinates")
+	}
+	point := append(append([]byte{4}, x...), y...)
+	if _, err := validate.NewPublicKey(point); err != nil {
+		return nil, errors.New("EC point not on curve")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid integer")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,324 @@
+package lb
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256" // register hashes used by crypto.Hash
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// jwtLeeway tolerates clock skew when checking exp and nbf
+const jwtLeeway = time.Minute
+
+// JWTAuth requires a valid bearer JWT signed by a key from a JWKS
+type JWTAuth struct {
+	JWKS     string        // JWKS file path or http(s) URL
+	Issuer   string        // required iss; empty = any
+	Audience string        // required aud entry; empty = any
+	Claims   []ClaimHeader // claims forwarded to the backend
+
+	invalid bool // tags didn't parse: deny everything
+}
+
+// ClaimHeader forwards a token claim as a request header
+type ClaimHeader struct {
+	Claim  string
+	Header string
+}
+
+// ParseClaimHeaders parses a hoplb-jwt-claims tag: comma-separated
+// "claim=Header" pairs, e.g. "sub=X-User, email=X-Email"
+func ParseClaimHeaders(tag string) ([]ClaimHeader, error) {
+	var claims []ClaimHeader
+	for _, part := range strings.Split(tag, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		claim, header, ok := strings.Cut(part, "=")
+		claim, header = strings.TrimSpace(claim), strings.TrimSpace(header)
+		if !ok || claim == "" || header == "" || strings.ContainsAny(header, " \t:") {
+			return nil, fmt.Errorf("want claim=Header, got %q", part)
+		}
+		claims = append(claims, ClaimHeader{Claim: claim, Header: http.CanonicalHeaderKey(header)})
+	}
+	return claims, nil
+}
+
+// jwtAlgorithms maps supported JWS algorithms to their hash. "none" is
+// deliberately absent.
+var jwtAlgorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+	"HS256": crypto.SHA256, "HS384": crypto.SHA384, "HS512": crypto.SHA512,
+	"EdDSA": 0,
+}
+
+// ecdsaKeySize is the coordinate size of each ES algorithm's curve
+var ecdsaKeySize = map[string]int{"ES256": 32, "ES384": 48, "ES512": 66}
+
+// errNoKeys means the JWKS couldn't be loaded, so no token can be checked
+var errNoKeys = errors.New("signing keys unavailable")
+
+// checkJWT validates the request's bearer token and copies the configured
+// claims into request headers. On failure it writes the response to w and
+// returns false with the rejection reason.
+func (p *Proxy) checkJWT(w http.ResponseWriter, req *http.Request, route *Route) (bool, string) {
+	// Only a validated token may set these; drop client-supplied values
+	for _, c := range route.JWT.Claims {
+		req.Header.Del(c.Header)
+	}
+
+	if route.JWT.invalid || route.jwks == nil {
+		log.Printf("JWT auth for %s enabled but misconfigured", req.Host)
+		http.Error(w, "auth misconfigured", http.StatusInternalServerError)
+		return false, "jwt_error"
+	}
+
+	token, ok := bearerToken(req)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Bearer realm="+strconv.Quote(route.Pattern))
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false, "jwt"
+	}
+
+	claims, err := verifyJWT(token, route.jwks, route.JWT, time.Now())
+	if errors.Is(err, errNoKeys) {
+		log.Printf("JWT auth for %s: %v", req.Host, err)
+		p.writeError(w, req, http.StatusServiceUnavailable, "auth unavailable")
+		return false, "jwt_error"
+	}
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token", error_description=`+strconv.Quote(err.Error()))
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false, "jwt"
+	}
+
+	for _, c := range route.JWT.Claims {
+		if v, ok := claims[c.Claim]; ok {
+			req.Header.Set(c.Header, claimString(v))
+		}
+	}
+	return true, ""
+}
+
+// bearerToken returns the token from "Authorization: Bearer <token>"
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// verifyJWT checks a compact JWS token's signature and its exp, nbf, iss
+// and aud claims, returning the claims
+func verifyJWT(token string, keys *keySet, spec *JWTAuth, now time.Time) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg  string          `json:"alg"`
+		Kid  string          `json:"kid"`
+		Crit json.RawMessage `json:"crit"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errors.New("malformed token header")
+	}
+	if _, ok := jwtAlgorithms[header.Alg]; !ok {
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	if header.Crit != nil {
+		return nil, errors.New("unsupported critical header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+
+	candidates, err := keys.lookup(header.Kid)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errNoKeys, err)
+	}
+	signed := []byte(token[:len(parts[0])+1+len(parts[1])])
+	verified := false
+	for _, k := range candidates {
+		if (k.alg == "" || k.alg == header.Alg) && verifySignature(header.Alg, k.key, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("invalid signature")
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errors.New("malformed token claims")
+	}
+	if err := validateClaims(claims, spec, now); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// verifySignature checks sig over signed. The key type must match the
+// algorithm family, so an RSA public key can't be used as an HMAC secret.
+func verifySignature(alg string, key any, signed, sig []byte) bool {
+	hash := jwtAlgorithms[alg]
+	if alg == "EdDSA" {
+		pub, ok := key.(ed25519.PublicKey)
+		return ok && ed25519.Verify(pub, signed, sig)
+	}
+
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch alg[:2] {
+	case "RS":
+		pub, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(pub, hash, digest, sig) == nil
+	case "PS":
+		pub, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPSS(pub, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+	case "ES":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return false
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if size != ecdsaKeySize[alg] || len(sig) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(pub, digest, r, s)
+	case "HS":
+		secret, ok := key.([]byte)
+		if !ok {
+			return false
+		}
+		mac := hmac.New(hash.New, secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), sig)
+	}
+	return false
+}
+
+// validateClaims checks expiry (required), not-before, issuer and audience
+func validateClaims(claims map[string]any, spec *JWTAuth, now time.Time) error {
+	exp, ok := numericDate(claims["exp"])
+	if !ok {
+		return errors.New("missing exp claim")
+	}
+	if now.After(exp.Add(jwtLeeway)) {
+		return errors.New("token expired")
+	}
+	if nbf, ok := numericDate(claims["nbf"]); ok && now.Before(nbf.Add(-jwtLeeway)) {
+		return errors.New("token not yet valid")
+	}
+
+	if spec.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != spec.Issuer {
+			return errors.New("wrong issuer")
+		}
+	}
+
+	if spec.Audience != "" {
+		found := false
+		switch aud := claims["aud"].(type) {
+		case string:
+			found = aud == spec.Audience
+		case []any:
+			for _, a := range aud {
+				if a == spec.Audience {
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			return errors.New("wrong audience")
+		}
+	}
+	return nil
+}
+
+// numericDate converts a JWT NumericDate claim
+func numericDate(v any) (time.Time, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	sec := int64(f)
+	return time.Unix(sec, int64((f-float64(sec))*1e9)), true
+}
+
+// decodeSegment decodes a base64url JSON token segment, keeping numbers exact
+func decodeSegment(seg string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// claimString renders a claim as a header value. Lists of strings are
+// comma-joined; other structured values are sent as JSON.
+func claimString(v any) string {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case json.Number:
+		s = v.String()
+	case bool:
+		s = strconv.FormatBool(v)
+	case []any:
+		strs := make([]string, 0, len(v))
+		for _, e := range v {
+			str, ok := e.(string)
+			if !ok {
+				b, _ := json.Marshal(v)
+				return string(b)
+			}
+			strs = append(strs, str)
+		}
+		s = strings.Join(strs, ",")
+	default:
+		b, _ := json.Marshal(v)
+		s = string(b)
+	}
+	// A header value can't carry control characters
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, s)
+}
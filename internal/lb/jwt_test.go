@@ -0,0 +1,337 @@
+package lb
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var b64 = base64.RawURLEncoding
+
+// testKeys holds one signing key per family and their JWKS
+type testKeys struct {
+	rsa    *rsa.PrivateKey
+	ec     *ecdsa.PrivateKey
+	ed     ed25519.PrivateKey
+	secret []byte
+}
+
+func newTestKeys(t *testing.T) *testKeys {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	return &testKeys{rsa: rsaKey, ec: ecKey, ed: edKey, secret: []byte("0123456789abcdef0123456789abcdef")}
+}
+
+func (k *testKeys) jwks() []byte {
+	ecX := make([]byte, 32)
+	ecY := make([]byte, 32)
+	k.ec.X.FillBytes(ecX)
+	k.ec.Y.FillBytes(ecY)
+	set := map[string]any{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "n": b64.EncodeToString(k.rsa.N.Bytes()), "e": b64.EncodeToString(big.NewInt(int64(k.rsa.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64.EncodeToString(ecX), "y": b64.EncodeToString(ecY)},
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64.EncodeToString(k.ed.Public().(ed25519.PublicKey))},
+		{"kty": "oct", "kid": "hmac", "alg": "HS256", "k": b64.EncodeToString(k.secret)},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": "AQAB", "e": "AQAB"},
+	}}
+	data, _ := json.Marshal(set)
+	return data
+}
+
+// sign builds a compact JWS token
+func (k *testKeys) sign(t *testing.T, alg, kid string, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	var err error
+	switch alg {
+	case "RS256":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, k.rsa, crypto.SHA256, digest[:])
+	case "PS256":
+		sig, err = rsa.SignPSS(rand.Reader, k.rsa, crypto.SHA256, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k.ec, digest[:])
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	case "EdDSA":
+		sig = ed25519.Sign(k.ed, []byte(signed))
+	case "HS256":
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case "none":
+	default:
+		t.Fatalf("sign: unknown alg %s", alg)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + b64.EncodeToString(sig)
+}
+
+func TestVerifyJWT(t *testing.T) {
+	keys := newTestKeys(t)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	os.WriteFile(path, keys.jwks(), 0o600)
+	ks := newKeySet(path)
+	spec := &JWTAuth{Issuer: "https://sso.example.com", Audience: "dash"}
+
+	now := time.Now()
+	valid := func() map[string]any {
+		return map[string]any{
+			"iss": "https://sso.example.com", "aud": []string{"other", "dash"},
+			"sub": "alice", "exp": now.Add(time.Hour).Unix(),
+		}
+	}
+	with := func(k string, v any) map[string]any {
+		c := valid()
+		if v == nil {
+			delete(c, k)
+		} else {
+			c[k] = v
+		}
+		return c
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{"RS256", keys.sign(t, "RS256", "rsa", valid()), ""},
+		{"PS256", keys.sign(t, "PS256", "rsa", valid()), ""},
+		{"ES256", keys.sign(t, "ES256", "ec", valid()), ""},
+		{"EdDSA", keys.sign(t, "EdDSA", "ed", valid()), ""},
+		{"HS256", keys.sign(t, "HS256", "hmac", valid()), ""},
+		{"no kid tries all keys", keys.sign(t, "ES256", "", valid()), ""},
+		{"audience string", keys.sign(t, "RS256", "rsa", with("aud", "dash")), ""},
+		{"within leeway", keys.sign(t, "RS256", "rsa", with("exp", now.Add(-30*time.Second).Unix())), ""},
+		{"expired", keys.sign(t, "RS256", "rsa", with("exp", now.Add(-time.Hour).Unix())), "token expired"},
+		{"no exp", keys.sign(t, "RS256", "rsa", with("exp", nil)), "missing exp claim"},
+		{"not yet valid", keys.sign(t, "RS256", "rsa", with("nbf", now.Add(time.Hour).Unix())), "token not yet valid"},
+		{"wrong issuer", keys.sign(t, "RS256", "rsa", with("iss", "https://evil.example.com")), "wrong issuer"},
+		{"wrong audience", keys.sign(t, "RS256", "rsa", with("aud", "billing")), "wrong audience"},
+		{"unknown kid", keys.sign(t, "RS256", "nope", valid()), "invalid signature"},
+		{"key of other type", keys.sign(t, "RS256", "ec", valid()), "invalid signature"},
+		{"alg none", keys.sign(t, "none", "rsa", valid()), `unsupported algorithm "none"`},
+		{"encryption key ignored", keys.sign(t, "RS256", "enc", valid()), "invalid signature"},
+		{"malformed", "abc.def", "malformed token"},
+	}
+	for _, tt := range tests {
+		_, err := verifyJWT(tt.token, ks, spec, now)
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+		if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+			t.Errorf("%s: error = %v; want %q", tt.name, err, tt.wantErr)
+		}
+	}
+
+	// HS256 forged with the RSA public key as secret must not verify
+	// against the RSA key (algorithm confusion)
+	pub := keys.rsa.PublicKey
+	forger := &testKeys{secret: pub.N.Bytes()}
+	if _, err := verifyJWT(forger.sign(t, "HS256", "rsa", valid()), ks, spec, now); err == nil {
+		t.Error("HS256 token signed with the RSA public key was accepted")
+	}
+}
+
+func TestJWKSURLRefetchesUnknownKid(t *testing.T) {
+	oldKeys, newKeys := newTestKeys(t), newTestKeys(t)
+	var current atomic.Pointer[[]byte]
+	jwks := oldKeys.jwks()
+	current.Store(&jwks)
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Write(*current.Load())
+	}))
+	defer srv.Close()
+
+	ks := newKeySet(srv.URL)
+	claims := map[string]any{"exp": time.Now().Add(time.Hour).Unix()}
+	if _, err := verifyJWT(oldKeys.sign(t, "ES256", "ec", claims), ks, &JWTAuth{}, time.Now()); err != nil {
+		t.Fatalf("initial key: %v", err)
+	}
+
+	// Keys rotate; new kid arrives before the cache expires
+	jwks = []byte(strings.ReplaceAll(string(newKeys.jwks()), `"kid":"ec"`, `"kid":"ec2"`))
+	current.Store(&jwks)
+	ks.tried = ks.tried.Add(-jwksMinRefetch)
+	if _, err := verifyJWT(newKeys.sign(t, "ES256", "ec2", claims), ks, &JWTAuth{}, time.Now()); err != nil {
+		t.Fatalf("rotated key: %v", err)
+	}
+	if got := fetches.Load(); got != 2 {
+		t.Errorf("JWKS fetched %d times; want 2", got)
+	}
+
+	// Unknown kids right after a fetch don't hammer the JWKS endpoint
+	verifyJWT(newKeys.sign(t, "ES256", "bogus", claims), ks, &JWTAuth{}, time.Now())
+	if got := fetches.Load(); got != 2 {
+		t.Errorf("JWKS fetched %d times after unknown kid; want 2", got)
+	}
+}
+
+func TestJWKSRefreshDoesNotBlock(t *testing.T) {
+	keys := newTestKeys(t)
+	release := make(chan struct{})
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fetches.Add(1) > 1 {
+			<-release
+		}
+		w.Write(keys.jwks())
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	ks := newKeySet(srv.URL)
+	claims := map[string]any{"exp": time.Now().Add(time.Hour).Unix()}
+	token := keys.sign(t, "ES256", "ec", claims)
+	if _, err := verifyJWT(token, ks, &JWTAuth{}, time.Now()); err != nil {
+		t.Fatalf("initial key: %v", err)
+	}
+
+	// The cache expires and the JWKS endpoint hangs: the old keys keep working
+	ks.mu.Lock()
+	ks.loaded = ks.loaded.Add(-jwksURLTTL)
+	ks.tried = ks.tried.Add(-jwksURLTTL)
+	ks.mu.Unlock()
+	done := make(chan error, 1)
+	go func() {
+		for range 3 {
+			if _, err := verifyJWT(token, ks, &JWTAuth{}, time.Now()); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("known kid during refresh: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("lookup blocked on the JWKS refresh")
+	}
+	for deadline := time.Now().Add(time.Second); fetches.Load() < 2 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := fetches.Load(); got != 2 {
+		t.Errorf("JWKS fetched %d times; want 2 (one refresh in flight)", got)
+	}
+}
+
+func TestParseClaimHeaders(t *testing.T) {
+	claims, err := ParseClaimHeaders("sub=X-User, email = x-email,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ClaimHeader{{"sub", "X-User"}, {"email", "X-Email"}}
+	if len(claims) != 2 || claims[0] != want[0] || claims[1] != want[1] {
+		t.Errorf("ParseClaimHeaders = %v; want %v", claims, want)
+	}
+	for _, bad := range []string{"sub", "sub=", "=X-User", "sub=X User"} {
+		if _, err := ParseClaimHeaders(bad); err == nil {
+			t.Errorf("ParseClaimHeaders(%q) succeeded; want error", bad)
+		}
+	}
+}
+
+func TestProxyJWT(t *testing.T) {
+	keys := newTestKeys(t)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	os.WriteFile(path, keys.jwks(), 0o600)
+
+	var upstream http.Header
+	proxy, m, _ := newTestProxy(t, "api.example.com", func(w http.ResponseWriter, r *http.Request) {
+		upstream = r.Header.Clone()
+	})
+	proxy.routeTable.Update(map[string]*Route{"api.example.com": {
+		Pattern:  "api.example.com",
+		Backends: proxy.routeTable.Match("api.example.com").Backends,
+		JWT: &JWTAuth{
+			JWKS:   path,
+			Issuer: "https://sso.example.com",
+			Claims: []ClaimHeader{{"sub", "X-User"}, {"groups", "X-Groups"}, {"admin", "X-Admin"}},
+		},
+	}})
+
+	do := func(auth string) *httptest.ResponseRecorder {
+		upstream = nil
+		req := httptest.NewRequest("GET", "http://api.example.com/", nil)
+		req.Header.Set("X-User", "mallory")
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		return w
+	}
+
+	token := keys.sign(t, "RS256", "rsa", map[string]any{
+		"iss": "https://sso.example.com", "sub": "alice", "groups": []string{"ops", "dev"},
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	if w := do("Bearer " + token); w.Code != http.StatusOK {
+		t.Fatalf("valid token = %d; want 200", w.Code)
+	}
+	if upstream.Get("X-User") != "alice" || upstream.Get("X-Groups") != "ops,dev" || upstream.Get("X-Admin") != "" {
+		t.Errorf("claim headers = %q/%q/%q; want alice, ops,dev and nothing", upstream.Get("X-User"), upstream.Get("X-Groups"), upstream.Get("X-Admin"))
+	}
+
+	w := do("")
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != `Bearer realm="api.example.com"` {
+		t.Errorf("no token = %d %q; want 401 with Bearer challenge", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+	expired := keys.sign(t, "RS256", "rsa", map[string]any{"iss": "https://sso.example.com", "exp": 1})
+	w = do("Bearer " + expired)
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Header().Get("WWW-Authenticate"), `error="invalid_token"`) {
+		t.Errorf("expired token = %d %q; want 401 invalid_token", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+	if upstream != nil {
+		t.Error("rejected request reached the backend")
+	}
+	if got := m.Rejections()["api.example.com"]["jwt"]; got != 2 {
+		t.Errorf("jwt rejections = %d; want 2", got)
+	}
+
+	// Without loadable keys nothing gets through
+	os.Remove(path)
+	proxy.routeTable.Update(map[string]*Route{"api.example.com": {
+		Pattern:  "api.example.com",
+		Backends: proxy.routeTable.Match("api.example.com").Backends,
+		JWT:      &JWTAuth{JWKS: path + ".missing"},
+	}})
+	if w := do("Bearer " + token); w.Code != http.StatusServiceUnavailable || w.Header().Get(RequestIDHeader) == "" {
+		t.Errorf("missing JWKS = %d %q; want the 503 error page", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,124 @@
+package lb
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MaintenanceMode answers requests with a 503 maintenance page, except
+// for clients in Allow
+type MaintenanceMode struct {
+	Allow []netip.Prefix `json:"allow"`
+	Since time.Time      `json:"since,omitzero"` // set when enabled via the admin API
+}
+
+// allows reports whether ip passes through
+func (m *MaintenanceMode) allows(ip netip.Addr) bool {
+	return containsAddr(m.Allow, ip)
+}
+
+// Maintenance holds maintenance modes switched on at runtime, globally or
+// per route pattern. They are kept in memory only. The zero value is off.
+type Maintenance struct {
+	mu     sync.RWMutex
+	global *MaintenanceMode
+	routes map[string]*MaintenanceMode // route pattern -> mode
+}
+
+// Enable turns maintenance on for pattern, or globally if pattern is ""
+func (m *Maintenance) Enable(pattern string, allow []netip.Prefix) {
+	mode := &MaintenanceMode{Allow: allow, Since: time.Now().UTC()}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if pattern == "" {
+		m.global = mode
+		return
+	}
+	if m.routes == nil {
+		m.routes = make(map[string]*MaintenanceMode)
+	}
+	m.routes[pattern] = mode
+}
+
+// Disable turns maintenance off for pattern, or globally if pattern is "".
+// Routes tagged hoplb-maintenance stay in maintenance.
+func (m *Maintenance) Disable(pattern string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if pattern == "" {
+		m.global = nil
+		return
+	}
+	delete(m.routes, pattern)
+}
+
+// modes returns the runtime modes that apply to pattern
+func (m *Maintenance) modes(pattern string) (global, route *MaintenanceMode) {
+	if m == nil {
+		return nil, nil
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.global, m.routes[pattern]
+}
+
+// inMaintenance reports whether the request from ip must get the
+// maintenance page: some mode applying to the route is on and doesn't
+// allow ip
+func (p *Proxy) inMaintenance(route *Route, ip netip.Addr) bool {
+	global, runtime := p.Maintenance.modes(route.Pattern)
+	for _, mode := range []*MaintenanceMode{route.Maintenance, runtime, global} {
+		if mode != nil && !mode.allows(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP is the admin API for maintenance mode:
+//
+//	GET    /maintenance                                 current state
+//	PUT    /maintenance?route=<pattern>&allow=<cidrs>   switch on; no route = globally
+//	DELETE /maintenance?route=<pattern>                 switch off
+func (m *Maintenance) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	pattern := r.URL.Query().Get("route")
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPut, http.MethodPost:
+		allow, err := ParseCIDRs(r.URL.Query().Get("allow"))
+		if err != nil {
+			http.Error(w, "allow: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		m.Enable(pattern, allow)
+	case http.MethodDelete:
+		m.Disable(pattern)
+	default:
+		w.Header().Set("Allow", "GET, PUT, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	type routeMode struct {
+		Route string `json:"route"`
+		*MaintenanceMode
+	}
+	state := struct {
+		Global *MaintenanceMode `json:"global"`
+		Routes []routeMode      `json:"routes"`
+	}{Routes: []routeMode{}}
+	m.mu.RLock()
+	state.Global = m.global
+	for pattern, mode := range m.routes {
+		state.Routes = append(state.Routes, routeMode{pattern, mode})
+	}
+	m.mu.RUnlock()
+	sort.Slice(state.Routes, func(i, j int) bool { return state.Routes[i].Route < state.Routes[j].Route })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
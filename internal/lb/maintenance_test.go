@@ -0,0 +1,98 @@
+package lb
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"hoplib"
+)
+
+func TestProxyMaintenance(t *testing.T) {
+	proxy, m, addr := newTestProxy(t, "unused.example.com", func(w http.ResponseWriter, r *http.Request) {})
+	tagged := &Route{Pattern: "app.example.com", Backends: []*Backend{{Address: addr, Healthy: true}}}
+	if errs := applyJobTags(tagged, &hoplib.Job{Name: "app", Tags: map[string]string{
+		TagMaintenance:      "true",
+		TagMaintenanceAllow: "10.1.0.0/16",
+	}}); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	proxy.routeTable.Update(map[string]*Route{
+		"app.example.com": tagged,
+		"api.example.com": {Pattern: "api.example.com", Backends: []*Backend{{Address: addr, Healthy: true}}},
+	})
+
+	serve := func(host, remote string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://"+host+"/", nil)
+		req.RemoteAddr = remote + ":40000"
+		req.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve("app.example.com", "192.0.2.1")
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), `"maintenance":true`) {
+		t.Errorf("tagged route = %d %s; want 503 maintenance page", w.Code, w.Body)
+	}
+	if w := serve("app.example.com", "10.1.2.3"); w.Code != http.StatusOK {
+		t.Errorf("allowlisted client = %d; want 200", w.Code)
+	}
+	if w := serve("api.example.com", "192.0.2.1"); w.Code != http.StatusOK {
+		t.Errorf("untagged route = %d; want 200", w.Code)
+	}
+
+	// Admin API: globally, with its own allowlist
+	admin := func(method, query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		proxy.Maintenance.ServeHTTP(w, httptest.NewRequest(method, "http://admin/maintenance?"+query, nil))
+		return w
+	}
+	if w := admin("PUT", "allow=192.0.2.1"); w.Code != http.StatusOK {
+		t.Fatalf("PUT /maintenance = %d %s", w.Code, w.Body)
+	}
+	if w := serve("api.example.com", "192.0.2.2"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("global maintenance = %d; want 503", w.Code)
+	}
+	if w := serve("api.example.com", "192.0.2.1"); w.Code != http.StatusOK {
+		t.Errorf("global allowlist = %d; want 200", w.Code)
+	}
+	// Every mode that applies must let the client through
+	if w := serve("app.example.com", "10.1.2.3"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("tag allowlist under global maintenance = %d; want 503", w.Code)
+	}
+	admin("DELETE", "")
+
+	// Admin API: one route
+	admin("PUT", "route=api.example.com")
+	if w := serve("api.example.com", "192.0.2.1"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("route maintenance = %d; want 503", w.Code)
+	}
+	var state struct {
+		Global *MaintenanceMode `json:"global"`
+		Routes []struct {
+			Route string         `json:"route"`
+			Allow []netip.Prefix `json:"allow"`
+		} `json:"routes"`
+	}
+	if err := json.Unmarshal(admin("GET", "").Body.Bytes(), &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.Global != nil || len(state.Routes) != 1 || state.Routes[0].Route != "api.example.com" {
+		t.Errorf("GET /maintenance = %+v", state)
+	}
+	admin("DELETE", "route=api.example.com")
+	if w := serve("api.example.com", "192.0.2.1"); w.Code != http.StatusOK {
+		t.Errorf("after DELETE = %d; want 200", w.Code)
+	}
+
+	if w := admin("PUT", "allow=nonsense"); w.Code != http.StatusBadRequest {
+		t.Errorf("PUT with bad allow = %d; want 400", w.Code)
+	}
+	if got := m.Rejections()["app.example.com"]["maintenance"]; got != 2 {
+		t.Errorf("maintenance rejections for app.example.com = %d; want 2", got)
+	}
+}
@@ -0,0 +1,134 @@
+package lb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"hoplb/internal/metrics"
+)
+
+const (
+	defaultMirrorMaxBody = 1 << 20          // bytes buffered per mirrored body
+	maxMirrorsInFlight   = 100              // across all routes; more are dropped
+	mirrorTimeout        = 30 * time.Second // per mirrored request
+	mirrorDrainLimit     = 64 << 10         // response bytes read to keep the connection
+)
+
+// Mirror copies a sample of a route's requests to another job and
+// discards the responses
+type Mirror struct {
+	Job     string  // hop job receiving the copies
+	Percent float64 // share of requests copied, 0-100
+	MaxBody int64   // requests with larger bodies are not copied
+
+	Backends []*Backend // the mirror job's running tasks, set by the watcher
+	next     uint64     // round-robin counter
+}
+
+// ParseMirrorPercent parses a hoplb-mirror-percent tag: "10", "0.5" or "10%"
+func ParseMirrorPercent(tag string) (float64, error) {
+	v := strings.TrimSuffix(strings.TrimSpace(tag), "%")
+	pct, err := strconv.ParseFloat(v, 64)
+	if err != nil || pct < 0 || pct > 100 {
+		return 0, fmt.Errorf("want a percentage from 0 to 100, got %q", tag)
+	}
+	return pct, nil
+}
+
+// sampled reports whether this request is copied
+func (m *Mirror) sampled() bool {
+	return m.Percent >= 100 || rand.Float64()*100 < m.Percent
+}
+
+// startMirror copies r to the route's mirror job in the background if
+// the request is sampled. The body is buffered up to the mirror's
+// MaxBody and r.Body is replaced so the primary still reads all of it.
+// Nothing the mirror does reaches the client.
+func (p *Proxy) startMirror(route *Route, r *http.Request) {
+	m := route.Mirror
+	if m == nil || len(m.Backends) == 0 || !m.sampled() || r.Header.Get("Upgrade") != "" {
+		return
+	}
+
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		if r.ContentLength > m.MaxBody {
+			p.recordMirror(route, metrics.MirrorTooLarge)
+			return
+		}
+		buf, err := io.ReadAll(io.LimitReader(r.Body, m.MaxBody+1))
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+		if err != nil {
+			p.recordMirror(route, metrics.MirrorError) // the primary sees the error too
+			return
+		}
+		if int64(len(buf)) > m.MaxBody {
+			p.recordMirror(route, metrics.MirrorTooLarge)
+			return
+		}
+		body = buf
+	}
+
+	backend := pickHealthy(m.Backends, &m.next)
+	if backend == nil {
+		p.recordMirror(route, metrics.MirrorError)
+		return
+	}
+	select {
+	case p.mirrorSlots <- struct{}{}:
+	default:
+		p.recordMirror(route, metrics.MirrorDropped)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mirrorTimeout)
+	req, err := http.NewRequestWithContext(ctx, r.Method, "http://"+backend.Address+r.URL.RequestURI(), bytes.NewReader(body))
+	if err != nil {
+		cancel()
+		<-p.mirrorSlots
+		p.recordMirror(route, metrics.MirrorError)
+		return
+	}
+	req.Header = r.Header.Clone()
+	for _, h := range hopHeaders {
+		req.Header.Del(h)
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		req.Header.Set("X-Forwarded-For", strings.Join(append(req.Header.Values("X-Forwarded-For"), host), ", "))
+	}
+	req.Host = r.Host
+
+	go func() {
+		defer func() { <-p.mirrorSlots }()
+		defer cancel()
+
+		resp, err := p.transport.RoundTrip(req)
+		if err != nil {
+			log.Printf("Mirror error for %s -> %s: %v", route.Pattern, backend.Address, err)
+			p.recordMirror(route, metrics.MirrorError)
+			return
+		}
+		io.CopyN(io.Discard, resp.Body, mirrorDrainLimit)
+		resp.Body.Close()
+		p.recordMirror(route, metrics.MirrorOK)
+	}()
+}
+
+// recordMirror counts a mirror result for route
+func (p *Proxy) recordMirror(route *Route, result string) {
+	if p.metrics != nil {
+		p.metrics.RecordMirror(route.Pattern, result)
+	}
+}
@@ -0,0 +1,152 @@
+package lb
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"hoplib"
+
+	"hoplb/internal/metrics"
+)
+
+func TestParseMirrorPercent(t *testing.T) {
+	tests := []struct {
+		tag     string
+		want    float64
+		wantErr bool
+	}{
+		{"10", 10, false},
+		{"0.5", 0.5, false},
+		{"25%", 25, false},
+		{"100", 100, false},
+		{"0", 0, false},
+		{"101", 0, true},
+		{"-1", 0, true},
+		{"half", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseMirrorPercent(tt.tag)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseMirrorPercent(%q) = %v, %v; want %v (error %v)", tt.tag, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// mirrored is a request seen by the mirror backend
+type mirrored struct {
+	host, uri, body string
+}
+
+func TestProxyMirror(t *testing.T) {
+	proxy, m, addr := newTestProxy(t, "unused.example.com", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body) // echo
+	})
+
+	seen := make(chan mirrored, 10)
+	release := make(chan struct{})
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		seen <- mirrored{r.Host, r.RequestURI, string(body)}
+		<-release // a slow mirror must not hold up the client
+		http.Error(w, "shadow broke", http.StatusInternalServerError)
+	}))
+	defer shadow.Close()
+	defer close(release)
+
+	mirror := &Mirror{Job: "app-v2", Percent: 100, MaxBody: 16,
+		Backends: []*Backend{{Address: shadow.Listener.Addr().String(), Healthy: true}}}
+	proxy.routeTable.Update(map[string]*Route{"app.example.com": {
+		Pattern:  "app.example.com",
+		Backends: []*Backend{{Address: addr, Healthy: true}},
+		Mirror:   mirror,
+	}})
+
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "http://app.example.com/orders?id=1", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := post("small order"); w.Code != http.StatusOK || w.Body.String() != "small order" {
+		t.Errorf("primary = %d %q; want 200 echo", w.Code, w.Body)
+	}
+	select {
+	case got := <-seen:
+		if got != (mirrored{"app.example.com", "/orders?id=1", "small order"}) {
+			t.Errorf("mirror got %+v", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("mirror not called")
+	}
+
+	// Over the buffer limit: the primary gets the whole body, the mirror nothing
+	large := strings.Repeat("x", 100)
+	if w := post(large); w.Code != http.StatusOK || w.Body.String() != large {
+		t.Errorf("primary with large body = %d, %d bytes; want 200 echo", w.Code, w.Body.Len())
+	}
+	select {
+	case got := <-seen:
+		t.Errorf("mirror got a body over the limit: %+v", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if n := m.Mirrors()["app.example.com"][metrics.MirrorTooLarge]; n != 1 {
+		t.Errorf("too_large mirrors = %d; want 1", n)
+	}
+
+	// An unreachable mirror only shows in its metric
+	mirror.Backends = []*Backend{{Address: "127.0.0.1:1", Healthy: true}}
+	if w := post("x"); w.Code != http.StatusOK {
+		t.Errorf("primary with broken mirror = %d; want 200", w.Code)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for m.Mirrors()["app.example.com"][metrics.MirrorError] != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := m.Mirrors()["app.example.com"][metrics.MirrorError]; n != 1 {
+		t.Errorf("error mirrors = %d; want 1", n)
+	}
+
+	mirror.Percent = 0
+	post("x")
+	if total := m.Mirrors()["app.example.com"]; len(total) != 2 {
+		t.Errorf("mirror results = %v; want nothing new at 0%%", total)
+	}
+}
+
+func TestBuildRoutesMirror(t *testing.T) {
+	w := newTestWatcher(t, nil)
+	w.agentHosts["agent-1"] = "10.0.0.1"
+
+	w.addJob("app", map[string]string{
+		TagURLPrefix:     "app.example.com",
+		TagMirror:        "app-v2",
+		TagMirrorPercent: "5%",
+	}, map[string][]*hoplib.Task{
+		"agent-1": {{ID: "task-0001", State: "running", Ports: map[string]int{"http": 8080}}},
+	})
+	w.addJob("app-v2", nil, map[string][]*hoplib.Task{
+		"agent-1": {{ID: "task-0002", State: "running", Ports: map[string]int{"http": 9090}}},
+	})
+
+	w.buildRoutes()
+
+	route := w.routeTable.Match("app.example.com")
+	if route == nil || route.Mirror == nil {
+		t.Fatalf("route = %+v; want a mirror", route)
+	}
+	if route.Mirror.Percent != 5 || route.Mirror.MaxBody != defaultMirrorMaxBody {
+		t.Errorf("mirror = %+v; want 5%% with the default body limit", route.Mirror)
+	}
+	if len(route.Mirror.Backends) != 1 || route.Mirror.Backends[0].Address != "10.0.0.1:9090" {
+		t.Errorf("mirror backends = %v; want app-v2's task", route.Mirror.Backends)
+	}
+	if len(route.Backends) != 1 || route.Backends[0].Job != "app" {
+		t.Errorf("backends = %v; want app's only", route.Backends)
+	}
+}
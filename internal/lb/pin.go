@@ -0,0 +1,85 @@
+package lb
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Pin is a job sharing a route's host that requests can be pinned to
+// with the route's pin header or cookie
+type Pin struct {
+	Job      string
+	Only     bool // tagged hoplb-pin-only: gets pinned requests only
+	Backends []*Backend
+	next     uint64 // round-robin counter
+}
+
+// GetHealthyBackend returns the next healthy backend of the pinned job
+func (pin *Pin) GetHealthyBackend() *Backend {
+	return pickHealthy(pin.Backends, &pin.next)
+}
+
+// pinned returns the job the request asks for by the route's pin header,
+// then its pin cookie. Unknown values are ignored.
+func (r *Route) pinned(req *http.Request) *Pin {
+	if len(r.Pins) == 0 {
+		return nil
+	}
+	if r.PinHeader != "" {
+		if pin := r.Pins[strings.TrimSpace(req.Header.Get(r.PinHeader))]; pin != nil {
+			return pin
+		}
+	}
+	if r.PinCookie != "" {
+		if c, err := req.Cookie(r.PinCookie); err == nil {
+			return r.Pins[c.Value]
+		}
+	}
+	return nil
+}
+
+// pinOnly reports whether the job is tagged hoplb-pin-only
+func pinOnly(jb jobBackends) bool {
+	return jb.job.Tags[TagPinOnly] == "true"
+}
+
+// pinAliases returns the job's hoplb-pin-alias values
+func pinAliases(jb jobBackends) []string {
+	var aliases []string
+	for _, a := range strings.Split(jb.job.Tags[TagPinAlias], ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			aliases = append(aliases, a)
+		}
+	}
+	return aliases
+}
+
+// newPins indexes the jobs sharing a host by name and hoplb-pin-alias.
+// Job names win over aliases; among aliases the first job by name wins.
+func newPins(pattern string, jobs []jobBackends) map[string]*Pin {
+	sorted := append([]jobBackends(nil), jobs...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].job.Name < sorted[j].job.Name })
+
+	pins := make(map[string]*Pin, len(sorted))
+	byJob := make(map[string]*Pin, len(sorted))
+	for _, jb := range sorted {
+		pin := &Pin{Job: jb.job.Name, Only: pinOnly(jb), Backends: jb.backends}
+		pins[jb.job.Name] = pin
+		byJob[jb.job.Name] = pin
+	}
+	for _, jb := range sorted {
+		for _, alias := range pinAliases(jb) {
+			if other, taken := pins[alias]; taken {
+				if other.Job != jb.job.Name {
+					log.Printf("Ignoring tag: %v", fmt.Errorf("job %s: %s: %q on %s already pins to %s", jb.job.Name, TagPinAlias, alias, pattern, other.Job))
+				}
+				continue
+			}
+			pins[alias] = byJob[jb.job.Name]
+		}
+	}
+	return pins
+}
@@ -0,0 +1,165 @@
+package lb
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"hoplib"
+)
+
+func TestNewRoutePins(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	job := func(name string, tags map[string]string, addr string) jobBackends {
+		return jobBackends{
+			job:      &hoplib.Job{Name: name, Tags: tags},
+			backends: []*Backend{{Address: addr, Job: name, Healthy: true}},
+		}
+	}
+	route, conflict := newRoute("app.example.com", []jobBackends{
+		job("myapp", map[string]string{TagPinHeader: "X-Canary", TagPinCookie: "canary"}, "10.0.0.1:80"),
+		job("myapp-canary", map[string]string{TagPinOnly: "true", TagPinAlias: "always, canary"}, "10.0.0.2:80"),
+		job("myapp-beta", map[string]string{TagMatch: "header:X-Tenant=beta", TagPinAlias: "always"}, "10.0.0.3:80"),
+	})
+
+	if conflict != nil {
+		t.Errorf("conflict = %v; pin-only jobs don't compete for the host", conflict)
+	}
+	if len(route.Backends) != 1 || route.Backends[0].Job != "myapp" {
+		t.Errorf("default backends = %v; want myapp's only", route.Backends)
+	}
+	if route.PinHeader != "X-Canary" || route.PinCookie != "canary" {
+		t.Errorf("pin header/cookie = %q/%q; want the owner's", route.PinHeader, route.PinCookie)
+	}
+	tests := []struct {
+		value, want string
+	}{
+		{"myapp", "myapp"},
+		{"myapp-canary", "myapp-canary"},
+		{"myapp-beta", "myapp-beta"},
+		{"canary", "myapp-canary"},
+		{"always", "myapp-beta"}, // first job by name keeps a shared alias
+	}
+	for _, tt := range tests {
+		if pin := route.Pins[tt.value]; pin == nil || pin.Job != tt.want {
+			t.Errorf("Pins[%q] = %+v; want %s", tt.value, pin, tt.want)
+		}
+	}
+	if n := route.backendCount(); n != 3 {
+		t.Errorf("backendCount = %d; want 3 including the pin-only job", n)
+	}
+}
+
+func TestNewRouteIgnoredPolicyTags(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	job := func(name string, tags map[string]string) jobBackends {
+		return jobBackends{job: &hoplib.Job{Name: name, Tags: tags}}
+	}
+	route, _ := newRoute("app.example.com", []jobBackends{
+		job("app", map[string]string{TagURLPrefix: "app.example.com", TagRateLimit: "100/s"}),
+		job("app-beta", map[string]string{TagURLPrefix: "app.example.com", TagMatch: "header:X-Beta", TagBasicAuth: "/etc/htpasswd"}),
+		job("app-canary", map[string]string{TagURLPrefix + ".1": "app.example.com", TagPinOnly: "true", TagAllowCIDR: "10.0.0.0/8", TagPinAlias: "canary"}),
+	})
+
+	if route.BasicAuth != nil || len(route.AllowCIDRs) != 0 || len(route.RateLimits) != 1 {
+		t.Errorf("route policy = %+v; want the owner's only", route)
+	}
+	out := logs.String()
+	for _, want := range []string{
+		"job app-beta: " + TagBasicAuth + ": app.example.com takes its policy from job app",
+		"job app-canary: " + TagAllowCIDR + ": app.example.com takes its policy from job app",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log lacks %q:\n%s", want, out)
+		}
+	}
+	for _, tag := range []string{TagMatch, TagPinOnly, TagPinAlias, TagURLPrefix, TagRateLimit} {
+		if strings.Contains(out, ": "+tag+":") {
+			t.Errorf("log warns about %s:\n%s", tag, out)
+		}
+	}
+}
+
+func TestProxyPinning(t *testing.T) {
+	hit := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) { w.Header().Set("X-Served-By", name) }
+	}
+	proxy, _, prodAddr := newTestProxy(t, "unused.example.com", hit("prod"))
+	canary := httptest.NewServer(hit("canary"))
+	defer canary.Close()
+	beta := httptest.NewServer(hit("beta"))
+	defer beta.Close()
+
+	job := func(name string, tags map[string]string, addr string) jobBackends {
+		return jobBackends{
+			job:      &hoplib.Job{Name: name, Tags: tags},
+			backends: []*Backend{{Address: addr, Job: name, Healthy: true}},
+		}
+	}
+	route, _ := newRoute("app.example.com", []jobBackends{
+		job("myapp", map[string]string{TagPinHeader: "X-Canary", TagPinCookie: "canary"}, prodAddr),
+		job("myapp-canary", map[string]string{TagPinOnly: "true", TagPinAlias: "always"}, canary.Listener.Addr().String()),
+		job("myapp-beta", map[string]string{TagMatch: "header:X-Tenant=beta"}, beta.Listener.Addr().String()),
+	})
+	proxy.routeTable.Update(map[string]*Route{"app.example.com": route})
+
+	tests := []struct {
+		header, cookie, tenant string
+		wantBy                 string
+	}{
+		{"", "", "", "prod"},
+		{"always", "", "", "canary"},
+		{"", "myapp-canary", "", "canary"},
+		{"myapp", "myapp-canary", "", "prod"},      // header before cookie
+		{"nonsense", "myapp-canary", "", "canary"}, // unknown header value ignored
+		{"", "nonsense", "", "prod"},
+		{"", "", "beta", "beta"},
+		{"myapp", "", "beta", "prod"},  // pinning beats rules
+		{"", "myapp-beta", "", "beta"}, // and bypasses their conditions
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "http://app.example.com/", nil)
+		if tt.header != "" {
+			req.Header.Set("X-Canary", tt.header)
+		}
+		if tt.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "canary", Value: tt.cookie})
+		}
+		if tt.tenant != "" {
+			req.Header.Set("X-Tenant", tt.tenant)
+		}
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		if got := w.Header().Get("X-Served-By"); w.Code != http.StatusOK || got != tt.wantBy {
+			t.Errorf("header %q cookie %q tenant %q: %d served by %q; want %s", tt.header, tt.cookie, tt.tenant, w.Code, got, tt.wantBy)
+		}
+	}
+
+	// A pin-only job alone: pinned requests only
+	route, _ = newRoute("preview.example.com", []jobBackends{
+		job("preview", map[string]string{TagPinOnly: "true", TagPinCookie: "canary"}, canary.Listener.Addr().String()),
+	})
+	proxy.routeTable.Update(map[string]*Route{"preview.example.com": route})
+	req := httptest.NewRequest("GET", "http://preview.example.com/", nil)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unpinned request to pin-only host = %d; want 404", w.Code)
+	}
+	req.AddCookie(&http.Cookie{Name: "canary", Value: "preview"})
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("pinned request to pin-only host = %d; want 200", w.Code)
+	}
+}
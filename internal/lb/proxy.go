@@ -1,26 +1,71 @@
 package lb
 
 import (
+	"context"
+	"errors"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
+	"net/netip"
 	"net/url"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"hoplb/internal/metrics"
+	"hoplb/internal/tracing"
 )
 
 // Proxy is a reverse proxy that routes based on the route table and tracks metrics
 type Proxy struct {
 	routeTable *RouteTable
 	metrics    *metrics.Metrics
+	transport  http.RoundTripper
+
+	tlsMu         sync.Mutex
+	tlsTransports map[UpstreamTLS]*tlsTransport // per upstream TLS config
+	tlsGeneration atomic.Uint64                 // route table generation tlsTransports was pruned for
+
+	mirrorSlots chan struct{} // bounds mirror requests in flight
+
+	// TrustedProxies are peers whose X-Forwarded-For is believed when
+	// determining the client IP. Set before serving.
+	TrustedProxies []netip.Prefix
+
+	// ForwardAuthURL is the auth endpoint for routes tagged
+	// hoplb-forward-auth=true. Set before serving.
+	ForwardAuthURL string
+	authClient     *http.Client
+
+	// HTTPSPort is the port of the HTTPS listener, used in redirects to
+	// https. Empty or "443" leaves the port out. Set before serving.
+	HTTPSPort string
+
+	// Maintenance switches routes or all of hoplb to maintenance mode at
+	// runtime, see maintenance.go
+	Maintenance *Maintenance
+
+	// ErrorPages renders the 403, 404, 429, 502, 503 and 504 responses
+	// generated by hoplb; nil uses the built-in pages. Set before serving.
+	ErrorPages *ErrorPages
+
+	// Tracer, if set, records a server span per request and propagates
+	// W3C trace context to backends. Set before serving.
+	Tracer *tracing.Tracer
 }
 
 // NewProxy creates a new proxy with metrics tracking
 func NewProxy(routeTable *RouteTable, m *metrics.Metrics) *Proxy {
 	return &Proxy{
-		routeTable: routeTable,
-		metrics:    m,
+		routeTable:  routeTable,
+		metrics:     m,
+		transport:   newTransport(m),
+		authClient:  newAuthClient(),
+		mirrorSlots: make(chan struct{}, maxMirrorsInFlight),
+		Maintenance: &Maintenance{},
 	}
 }
 
@@ -28,57 +73,288 @@ func NewProxy(routeTable *RouteTable, m *metrics.Metrics) *Proxy {
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
 	domain := r.Host
+	reqID := requestID(r)
+	r.Header.Set(RequestIDHeader, reqID)
+	ip := p.clientIP(r)
+	for _, h := range clientCertHeaders {
+		r.Header.Del(h)
+	}
+
+	// Wrap ResponseWriter to capture status code and response size
+	wrappedWriter := &statusWriter{ResponseWriter: w, statusCode: http.StatusOK}
+	w = wrappedWriter
+
+	exemplar := metrics.Exemplar{Label: "request_id", ID: reqID}
+	var span *tracing.Span
+	if p.Tracer != nil {
+		span = p.Tracer.StartServer(r, r.Method)
+		span.SetAttributes(
+			tracing.String("http.request.method", r.Method),
+			tracing.String("url.path", r.URL.Path),
+			tracing.String("server.address", domain),
+			tracing.String("client.address", ip.String()),
+			tracing.String("hoplb.request_id", reqID),
+		)
+		defer finishSpan(span, wrappedWriter)
+		tracing.Inject(r.Header, span.Context)
+		if span.Context.Sampled {
+			exemplar = metrics.Exemplar{Label: "trace_id", ID: span.Context.TraceID.String()}
+		}
+	}
 
-	route := p.routeTable.Match(domain)
+	route, vars := p.routeTable.MatchVars(domain)
 	if route == nil {
-		p.recordMetrics(domain, "", http.StatusBadGateway, time.Since(start))
-		http.Error(w, "no route for host", http.StatusBadGateway)
+		p.recordMetrics(domain, "", http.StatusBadGateway, time.Since(start), exemplar)
+		p.writeError(w, r, http.StatusBadGateway, "no route for host")
+		return
+	}
+	if span != nil {
+		span.Name = r.Method + " " + route.Pattern
+		span.SetAttributes(tracing.String("hoplb.route", route.Pattern))
+	}
+
+	if p.metrics != nil {
+		p.metrics.IncInFlight(route.Pattern)
+		defer p.metrics.DecInFlight(route.Pattern)
+	}
+	if route.ResponseHeaders != nil {
+		w = &headerWriter{ResponseWriter: w, rules: route.ResponseHeaders}
+	}
+
+	https := p.isHTTPS(r)
+	if route.HTTPSRedirect != 0 && !https {
+		code := p.redirectToHTTPS(w, r, route.HTTPSRedirect)
+		p.recordMetrics(domain, "", code, time.Since(start), exemplar)
+		return
+	}
+	if route.HSTS != nil && https {
+		w.Header().Set(HSTSHeader, route.HSTS.String())
+	}
+	if code := route.redirect(w, r, https, vars); code != 0 {
+		p.recordMetrics(domain, "", code, time.Since(start), exemplar)
+		return
+	}
+
+	if p.inMaintenance(route, ip) {
+		p.reject(domain, route, "maintenance", http.StatusServiceUnavailable, time.Since(start), exemplar)
+		p.writeMaintenance(w, r)
+		return
+	}
+
+	if !route.allowed(ip) {
+		p.reject(domain, route, "acl", http.StatusForbidden, time.Since(start), exemplar)
+		p.writeError(w, r, http.StatusForbidden, "forbidden")
 		return
 	}
 
-	backend := route.GetHealthyBackend()
+	if route.ClientCA != nil {
+		if ok, reason := p.checkClientCert(w, r, route.ClientCA); !ok {
+			p.reject(domain, route, reason, http.StatusForbidden, time.Since(start), exemplar)
+			return
+		}
+	}
+
+	for _, limiter := range route.limiters {
+		if ok, wait := limiter.allow(limiter.key(r, ip), time.Now()); !ok {
+			p.reject(domain, route, "ratelimit", http.StatusTooManyRequests, time.Since(start), exemplar)
+			w.Header().Set("Retry-After", retryAfter(wait))
+			p.writeError(w, r, http.StatusTooManyRequests, "rate limit exceeded")
+			return
+		}
+	}
+
+	if route.ForwardAuth != nil {
+		if ok, reason := p.forwardAuth(w, r, route.ForwardAuth); !ok {
+			p.reject(domain, route, reason, wrappedWriter.statusCode, time.Since(start), exemplar)
+			return
+		}
+	}
+
+	if route.BasicAuth != nil && !route.checkBasicAuth(w, r) {
+		p.reject(domain, route, "basic_auth", http.StatusUnauthorized, time.Since(start), exemplar)
+		return
+	}
+
+	if route.JWT != nil {
+		if ok, reason := p.checkJWT(w, r, route); !ok {
+			p.reject(domain, route, reason, wrappedWriter.statusCode, time.Since(start), exemplar)
+			return
+		}
+	}
+
+	// Shed load before it reaches a struggling backend
+	if limiter := route.concurrency; limiter != nil {
+		if p.metrics != nil {
+			p.metrics.SetConcurrencyLimit(route.Pattern, limiter.limit())
+		}
+		if !limiter.acquire() {
+			p.reject(domain, route, "concurrency", http.StatusServiceUnavailable, time.Since(start), exemplar)
+			p.writeError(w, r, http.StatusServiceUnavailable, "too many requests in flight")
+			return
+		}
+		acquired := time.Now()
+		defer func() {
+			limiter.release(time.Since(acquired), wrappedWriter.statusCode >= 500)
+		}()
+	}
+
+	// Rewrites apply before backend selection. Rules and pins match on
+	// method, headers, query and cookies, which rewrites don't touch; the
+	// route's injected headers come after, so they can't select a backend.
+	route.rewrite(r, vars)
+
+	var backend *Backend
+	if pin := route.pinned(r); pin != nil {
+		backend = pin.GetHealthyBackend()
+	} else if rule := route.matchRule(r); rule != nil {
+		backend = rule.GetHealthyBackend()
+	} else if len(route.Backends) == 0 {
+		// Only rule jobs serve this host, and none wants the request
+		p.recordMetrics(domain, "", http.StatusNotFound, time.Since(start), exemplar)
+		p.writeError(w, r, http.StatusNotFound, "no matching route")
+		return
+	} else {
+		backend = route.GetHealthyBackend()
+	}
 	if backend == nil {
-		p.recordMetrics(domain, "", http.StatusServiceUnavailable, time.Since(start))
-		http.Error(w, "no healthy backend", http.StatusServiceUnavailable)
+		p.recordMetrics(domain, "", http.StatusServiceUnavailable, time.Since(start), exemplar)
+		p.writeError(w, r, http.StatusServiceUnavailable, "no healthy backend")
 		return
 	}
 
-	target, err := url.Parse("http://" + backend.Address)
+	route.setRequestHeaders(r.Header, vars)
+
+	if span != nil {
+		span.SetAttributes(
+			tracing.String("hoplb.job", backend.Job),
+			tracing.String("hoplb.backend", backend.Address),
+		)
+	}
+
+	scheme := "http://"
+	if route.UpstreamTLS != nil {
+		scheme = "https://"
+	}
+	target, err := url.Parse(scheme + backend.Address)
 	if err != nil {
-		p.recordMetrics(domain, backend.Address, http.StatusInternalServerError, time.Since(start))
+		p.recordMetrics(domain, backend.Address, http.StatusInternalServerError, time.Since(start), exemplar)
 		http.Error(w, "invalid backend", http.StatusInternalServerError)
 		return
 	}
 
-	// Wrap ResponseWriter to capture status code
-	wrappedWriter := &statusWriter{ResponseWriter: w, statusCode: http.StatusOK}
+	transport, err := p.transportFor(route)
+	if err != nil {
+		log.Printf("Upstream TLS for %s: %v", route.Pattern, err)
+		p.recordMetrics(domain, backend.Address, http.StatusBadGateway, time.Since(start), exemplar)
+		p.writeError(w, r, http.StatusBadGateway, "backend TLS misconfigured")
+		return
+	}
+
+	p.startMirror(route, r)
+
+	// Count request body bytes as the backend reads them
+	var body *countingReader
+	if r.Body != nil && r.Body != http.NoBody {
+		body = &countingReader{ReadCloser: r.Body}
+		r.Body = body
+	}
+
+	// Trace the upstream round trip for time-to-first-byte and pool reuse
+	var upstreamStart time.Time
+	var ttfb time.Duration
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if p.metrics != nil {
+				p.metrics.BackendConnAcquired(backend.Address, info.Reused)
+			}
+		},
+		GotFirstResponseByte: func() {
+			ttfb = time.Since(upstreamStart)
+		},
+	}
+	r = r.WithContext(httptrace.WithClientTrace(r.Context(), trace))
 
 	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = transport
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if route.HSTS != nil && https {
+			resp.Header.Del(HSTSHeader) // the route's policy wins over the backend's
+		}
+		if route.ResponseHeaders != nil {
+			route.ResponseHeaders.apply(resp.Header) // also covers upgrades, which bypass w
+		}
+		return nil
+	}
 	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
 		log.Printf("Proxy error for %s -> %s: %v", r.Host, backend.Address, err)
-		wrappedWriter.statusCode = http.StatusBadGateway
-		http.Error(w, "backend error", http.StatusBadGateway)
+		if span != nil {
+			span.SetStatus(tracing.StatusError, err.Error())
+		}
+		if isTimeout(err) {
+			p.writeError(w, r, http.StatusGatewayTimeout, "backend timeout")
+			return
+		}
+		p.writeError(w, r, http.StatusBadGateway, "backend error")
 	}
 
 	log.Printf("%s %s -> %s", r.Method, r.Host+r.URL.Path, backend.Address)
-	proxy.ServeHTTP(wrappedWriter, r)
+	upstreamStart = time.Now()
+	proxy.ServeHTTP(w, r)
 
 	// Record metrics after request completes
 	duration := time.Since(start)
-	p.recordMetrics(domain, backend.Address, wrappedWriter.statusCode, duration)
+	p.recordMetrics(domain, backend.Address, wrappedWriter.statusCode, duration, exemplar)
+	if p.metrics != nil {
+		var requestBytes int64
+		if body != nil {
+			requestBytes = body.n
+		}
+		p.metrics.RecordBytes(domain, backend.Address, requestBytes, wrappedWriter.bytes)
+		if ttfb > 0 {
+			p.metrics.RecordTTFB(domain, backend.Address, ttfb)
+		}
+	}
 }
 
 // recordMetrics records request metrics (domain, backend, status code, latency)
-func (p *Proxy) recordMetrics(domain, backend string, statusCode int, duration time.Duration) {
+// with an exemplar linking the latency to this request
+func (p *Proxy) recordMetrics(domain, backend string, statusCode int, duration time.Duration, ex metrics.Exemplar) {
+	if p.metrics != nil {
+		p.metrics.RecordRequestExemplar(domain, backend, statusCode, duration, ex)
+	}
+}
+
+// reject records a request refused by hoplb itself. The caller writes the response.
+func (p *Proxy) reject(domain string, route *Route, reason string, statusCode int, duration time.Duration, ex metrics.Exemplar) {
 	if p.metrics != nil {
-		p.metrics.RecordRequest(domain, backend, statusCode, duration)
+		p.metrics.RecordRejection(route.Pattern, reason)
 	}
+	p.recordMetrics(domain, "", statusCode, duration, ex)
+}
+
+// isTimeout reports whether a proxy error is the backend timing out
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
 }
 
-// statusWriter wraps http.ResponseWriter to capture the status code
+// finishSpan records the response status on span and ends it.
+// 5xx responses mark the span as failed.
+func finishSpan(span *tracing.Span, w *statusWriter) {
+	span.SetAttributes(tracing.Int("http.response.status_code", w.statusCode))
+	if w.statusCode >= 500 {
+		if span.Status != tracing.StatusError {
+			span.SetStatus(tracing.StatusError, http.StatusText(w.statusCode))
+		}
+	}
+	span.Finish()
+}
+
+// statusWriter wraps http.ResponseWriter to capture the status code and body size
 type statusWriter struct {
 	http.ResponseWriter
 	statusCode int
+	bytes      int64
 }
 
 // WriteHeader captures the status code before passing it through
@@ -86,3 +362,28 @@ func (w *statusWriter) WriteHeader(code int) {
 	w.statusCode = code
 	w.ResponseWriter.WriteHeader(code)
 }
+
+// Write counts body bytes before passing them through
+func (w *statusWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap exposes the underlying writer so http.ResponseController can flush
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// countingReader counts bytes read from a request body
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+// Read counts bytes before returning them
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.n += int64(n)
+	return n, err
+}
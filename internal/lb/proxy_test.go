@@ -0,0 +1,136 @@
+package lb
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"hoplb/internal/metrics"
+	"hoplb/internal/tracing"
+)
+
+// newTestProxy starts a backend with handler and routes host to it
+func newTestProxy(t *testing.T, host string, handler http.HandlerFunc) (*Proxy, *metrics.Metrics, string) {
+	t.Helper()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	backend := httptest.NewServer(handler)
+	t.Cleanup(backend.Close)
+	addr := backend.Listener.Addr().String()
+
+	rt := NewRouteTable()
+	rt.Update(map[string]*Route{
+		host: {Pattern: host, Backends: []*Backend{{Address: addr, Healthy: true}}},
+	})
+	m := metrics.New()
+	return NewProxy(rt, m), m, addr
+}
+
+func TestProxyRecordsTraffic(t *testing.T) {
+	proxy, m, addr := newTestProxy(t, "api.example.com", func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write([]byte("hello world"))
+	})
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("POST", "http://api.example.com/upload", strings.NewReader("12345"))
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+	}
+
+	req, resp := m.Bytes()
+	if got := req["api.example.com"][addr]; got != 10 {
+		t.Errorf("request bytes = %d; want 10", got)
+	}
+	if got := resp["api.example.com"][addr]; got != 22 {
+		t.Errorf("response bytes = %d; want 22", got)
+	}
+	if got := m.TTFBCount("api.example.com", addr); got != 2 {
+		t.Errorf("TTFB samples = %d; want 2", got)
+	}
+	if got := m.InFlight()["api.example.com"]; got != 0 {
+		t.Errorf("in-flight = %d; want 0 after completion", got)
+	}
+
+	open, acquired := m.BackendConns()
+	if open[addr] != 1 {
+		t.Errorf("open backend connections = %d; want 1", open[addr])
+	}
+	if acquired[addr][false] != 1 || acquired[addr][true] != 1 {
+		t.Errorf("acquisitions = %v; want 1 new and 1 reused", acquired[addr])
+	}
+}
+
+func TestProxyRequestID(t *testing.T) {
+	var got string
+	proxy, _, _ := newTestProxy(t, "api.example.com", func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get(RequestIDHeader)
+	})
+
+	// Client-supplied ID is passed through
+	req := httptest.NewRequest("GET", "http://api.example.com/", nil)
+	req.Header.Set(RequestIDHeader, "client-id-123")
+	proxy.ServeHTTP(httptest.NewRecorder(), req)
+	if got != "client-id-123" {
+		t.Errorf("backend saw request ID %q; want client-id-123", got)
+	}
+
+	// Missing or malformed IDs are replaced
+	for _, id := range []string{"", "has space", strings.Repeat("x", 200)} {
+		req := httptest.NewRequest("GET", "http://api.example.com/", nil)
+		req.Header.Set(RequestIDHeader, id)
+		proxy.ServeHTTP(httptest.NewRecorder(), req)
+		if len(got) != 32 {
+			t.Errorf("client ID %q: backend saw %q; want a generated 32-char ID", id, got)
+		}
+	}
+}
+
+// spanRecorder collects exported spans
+type spanRecorder struct{ spans []*tracing.Span }
+
+func (r *spanRecorder) Export(s *tracing.Span) { r.spans = append(r.spans, s) }
+
+func TestProxyTracing(t *testing.T) {
+	var traceparent string
+	proxy, _, addr := newTestProxy(t, "api.example.com", func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	rec := &spanRecorder{}
+	proxy.Tracer = tracing.NewTracer(rec)
+
+	req := httptest.NewRequest("GET", "http://api.example.com/", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	proxy.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(rec.spans) != 1 {
+		t.Fatalf("exported %d spans; want 1", len(rec.spans))
+	}
+	span := rec.spans[0]
+
+	// Backend sees the proxy's span as parent, in the caller's trace
+	sc, ok := tracing.ParseTraceparent(traceparent)
+	if !ok || sc.TraceID != span.Context.TraceID || sc.SpanID != span.Context.SpanID {
+		t.Errorf("backend traceparent = %q; want child of proxy span %s", traceparent, span.Context.SpanID)
+	}
+
+	attrs := map[string]any{}
+	for _, a := range span.Attributes() {
+		attrs[a.Key] = a.Value
+	}
+	if attrs["hoplb.route"] != "api.example.com" || attrs["hoplb.backend"] != addr || attrs["http.response.status_code"] != int64(500) {
+		t.Errorf("span attributes = %v", attrs)
+	}
+	if span.Status != tracing.StatusError {
+		t.Errorf("span status = %d; want error for 5xx", span.Status)
+	}
+}
@@ -0,0 +1,164 @@
+package lb
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxRate caps rates in tokens per second; anything faster is no limit
+// in practice and would overflow the burst size
+const maxRate = 1e6
+
+// RateLimit is a token-bucket limit parsed from a hoplb-ratelimit tag, e.g.
+// "100/s", "600/m burst=50 key=ip" or "20/s key=header:X-API-Key".
+// Several limits can be combined with ";" and all must allow a request.
+type RateLimit struct {
+	Rate  float64 // tokens per second
+	Burst int     // bucket size
+	Key   string  // "ip", "route" or "header:<Name>"
+}
+
+// ParseRateLimits parses a hoplb-ratelimit tag value
+func ParseRateLimits(tag string) ([]RateLimit, error) {
+	var limits []RateLimit
+	for _, part := range strings.Split(tag, ";") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		l, err := parseRateLimit(part)
+		if err != nil {
+			return nil, err
+		}
+		limits = append(limits, l)
+	}
+	return limits, nil
+}
+
+func parseRateLimit(s string) (RateLimit, error) {
+	fields := strings.Fields(s)
+	l := RateLimit{Key: "ip"}
+
+	count, unit, _ := strings.Cut(fields[0], "/")
+	n, err := strconv.ParseFloat(count, 64)
+	if err != nil || n <= 0 || math.IsInf(n, 0) || math.IsNaN(n) {
+		return l, fmt.Errorf("invalid rate %q", fields[0])
+	}
+	switch unit {
+	case "", "s":
+		l.Rate = n
+	case "m":
+		l.Rate = n / 60
+	case "h":
+		l.Rate = n / 3600
+	default:
+		return l, fmt.Errorf("invalid rate unit %q (want s, m or h)", unit)
+	}
+	l.Rate = math.Min(l.Rate, maxRate)
+	l.Burst = int(math.Max(1, math.Ceil(l.Rate)))
+
+	for _, opt := range fields[1:] {
+		k, v, _ := strings.Cut(opt, "=")
+		switch k {
+		case "burst":
+			b, err := strconv.Atoi(v)
+			if err != nil || b < 1 {
+				return l, fmt.Errorf("invalid burst %q", v)
+			}
+			l.Burst = b
+		case "key":
+			if v != "ip" && v != "route" && !(strings.HasPrefix(v, "header:") && len(v) > len("header:")) {
+				return l, fmt.Errorf("invalid key %q (want ip, route or header:<Name>)", v)
+			}
+			l.Key = v
+		default:
+			return l, fmt.Errorf("unknown option %q", opt)
+		}
+	}
+	return l, nil
+}
+
+// rateLimiter holds one token bucket per key
+type rateLimiter struct {
+	spec RateLimit
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	calls   int
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(spec RateLimit) *rateLimiter {
+	return &rateLimiter{spec: spec, buckets: make(map[string]*bucket)}
+}
+
+// key returns the bucket key for r. Header keys fall back to the client IP
+// when the header is missing.
+func (l *rateLimiter) key(r *http.Request, clientIP netip.Addr) string {
+	switch {
+	case l.spec.Key == "route":
+		return ""
+	case strings.HasPrefix(l.spec.Key, "header:"):
+		if v := r.Header.Get(l.spec.Key[len("header:"):]); v != "" {
+			return "h:" + v
+		}
+	}
+	return "ip:" + clientIP.String()
+}
+
+// allow takes a token for key. If none is left it returns false and how
+// long until one is available.
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.calls++
+	if l.calls%1024 == 0 {
+		l.evict(now)
+	}
+
+	b := l.buckets[key]
+	if b == nil {
+		b = &bucket{tokens: float64(l.spec.Burst), last: now}
+		l.buckets[key] = b
+	} else {
+		b.tokens = math.Min(float64(l.spec.Burst), b.tokens+now.Sub(b.last).Seconds()*l.spec.Rate)
+		b.last = now
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.spec.Rate * float64(time.Second))
+	return false, wait
+}
+
+// evict drops buckets that have refilled completely; they are
+// indistinguishable from new ones
+func (l *rateLimiter) evict(now time.Time) {
+	full := time.Duration(float64(l.spec.Burst) / l.spec.Rate * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// retryAfter formats a wait as whole seconds for the Retry-After header
+func retryAfter(wait time.Duration) string {
+	secs := int(math.Ceil(wait.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	return strconv.Itoa(secs)
+}
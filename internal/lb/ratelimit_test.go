@@ -0,0 +1,143 @@
+package lb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestParseRateLimits(t *testing.T) {
+	tests := []struct {
+		tag     string
+		want    []RateLimit
+		wantErr bool
+	}{
+		{"100/s", []RateLimit{{Rate: 100, Burst: 100, Key: "ip"}}, false},
+		{"5", []RateLimit{{Rate: 5, Burst: 5, Key: "ip"}}, false},
+		{"120/m burst=10 key=route", []RateLimit{{Rate: 2, Burst: 10, Key: "route"}}, false},
+		{"1/h key=header:X-API-Key", []RateLimit{{Rate: 1.0 / 3600, Burst: 1, Key: "header:X-API-Key"}}, false},
+		{"10/s; 1000/s key=route", []RateLimit{{Rate: 10, Burst: 10, Key: "ip"}, {Rate: 1000, Burst: 1000, Key: "route"}}, false},
+		{"1e300/s", []RateLimit{{Rate: maxRate, Burst: maxRate, Key: "ip"}}, false}, // clamped
+		{"fast", nil, true},
+		{"inf/s", nil, true},
+		{"+Inf/m", nil, true},
+		{"NaN/s", nil, true},
+		{"10/d", nil, true},
+		{"10/s burst=0", nil, true},
+		{"10/s key=cookie", nil, true},
+		{"10/s key=header:", nil, true},
+		{"10/s foo=bar", nil, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseRateLimits(tt.tag)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRateLimits(%q) error = %v; wantErr %v", tt.tag, err, tt.wantErr)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("ParseRateLimits(%q) = %v; want %v", tt.tag, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("ParseRateLimits(%q)[%d] = %+v; want %+v", tt.tag, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestRateLimiterBucket(t *testing.T) {
+	l := newRateLimiter(RateLimit{Rate: 2, Burst: 3, Key: "ip"})
+	now := time.Now()
+
+	// Burst is available immediately
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow("a", now); !ok {
+			t.Fatalf("request %d rejected within burst", i)
+		}
+	}
+	ok, wait := l.allow("a", now)
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("over-limit allow = %v, %v; want false, 500ms", ok, wait)
+	}
+
+	// Other keys have their own bucket
+	if ok, _ := l.allow("b", now); !ok {
+		t.Errorf("key b limited by key a's bucket")
+	}
+
+	// Tokens refill at Rate
+	if ok, _ := l.allow("a", now.Add(500*time.Millisecond)); !ok {
+		t.Errorf("token not refilled after 500ms at 2/s")
+	}
+}
+
+func TestRateLimiterKey(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-API-Key", "k1")
+
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"ip", "ip:192.0.2.1"},
+		{"route", ""},
+		{"header:X-API-Key", "h:k1"},
+		{"header:X-Missing", "ip:192.0.2.1"}, // falls back to client IP
+	}
+	for _, tt := range tests {
+		l := newRateLimiter(RateLimit{Rate: 1, Burst: 1, Key: tt.key})
+		if got := l.key(r, netip.MustParseAddr("192.0.2.1")); got != tt.want {
+			t.Errorf("key(%q) = %q; want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestRouteTableKeepsLimiterState(t *testing.T) {
+	limits := []RateLimit{{Rate: 1, Burst: 1, Key: "route"}}
+	rt := NewRouteTable()
+	rt.Update(map[string]*Route{"api.example.com": {Pattern: "api.example.com", RateLimits: limits}})
+	first := rt.Match("api.example.com").limiters[0]
+
+	// Same policy: limiter (and its buckets) survive a rebuild
+	rt.Update(map[string]*Route{"api.example.com": {Pattern: "api.example.com", RateLimits: limits}})
+	if rt.Match("api.example.com").limiters[0] != first {
+		t.Errorf("limiter replaced although the policy did not change")
+	}
+
+	// Changed policy: fresh limiter
+	rt.Update(map[string]*Route{"api.example.com": {Pattern: "api.example.com", RateLimits: []RateLimit{{Rate: 5, Burst: 5, Key: "route"}}}})
+	if rt.Match("api.example.com").limiters[0] == first {
+		t.Errorf("limiter kept although the policy changed")
+	}
+}
+
+func TestProxyRateLimit(t *testing.T) {
+	proxy, m, _ := newTestProxy(t, "api.example.com", func(w http.ResponseWriter, r *http.Request) {})
+	proxy.routeTable.Update(map[string]*Route{"api.example.com": {
+		Pattern:    "api.example.com",
+		Backends:   proxy.routeTable.Match("api.example.com").Backends,
+		RateLimits: []RateLimit{{Rate: 0.5, Burst: 1, Key: "ip"}},
+	}})
+
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "http://api.example.com/", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("first request = %d; want 200", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "http://api.example.com/", nil))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request = %d; want 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After = %q; want 2", got)
+	}
+	if got := m.Rejections()["api.example.com"]["ratelimit"]; got != 1 {
+		t.Errorf("ratelimit rejections = %d; want 1", got)
+	}
+}
@@ -0,0 +1,39 @@
+package lb
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// RequestIDHeader carries the request ID to backends
+const RequestIDHeader = "X-Request-Id"
+
+// maxRequestIDLen keeps request_id exemplars within OpenMetrics' limit of
+// 128 characters for an exemplar's label names and values together
+const maxRequestIDLen = 128 - len("request_id")
+
+// requestID returns the client's X-Request-Id if it looks sane, otherwise
+// a fresh random ID. The result is used for exemplars and error pages.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(RequestIDHeader); validRequestID(id) {
+		return id
+	}
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// validRequestID accepts 1-118 printable ASCII characters without spaces,
+// so client IDs can't bloat metrics or break header/label quoting
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' || id[i] == '"' || id[i] == '\\' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,31 @@
+package lb
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		id   string
+		keep bool
+	}{
+		{"req-123", true},
+		{strings.Repeat("a", maxRequestIDLen), true},
+		{strings.Repeat("a", 128), false}, // with "request_id", over the exemplar limit
+		{"has space", false},
+		{`quo"te`, false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "http://app.example.com/", nil)
+		req.Header.Set(RequestIDHeader, tt.id)
+		got := requestID(req)
+		if (got == tt.id) != tt.keep {
+			t.Errorf("requestID(%.20q...) = %.20q; keep = %v", tt.id, got, tt.keep)
+		}
+		if len(got) > maxRequestIDLen {
+			t.Errorf("requestID(%.20q...) is %d characters", tt.id, len(got))
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package lb
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Rewrite replaces the parts of the request path matching Regexp, like
+// regexp.ReplaceAllString. Replacement may use $1 / ${name} for the
+// regexp's groups and {name} for host captures.
+type Rewrite struct {
+	Regexp      *regexp.Regexp
+	Replacement string
+}
+
+// Redirect answers requests whose full URL ("https://host/path?query")
+// matches Regexp with a redirect to the URL with the match replaced
+type Redirect struct {
+	Regexp      *regexp.Regexp
+	Replacement string
+	Code        int // 301, 302, 303, 307 or 308
+}
+
+// ParseRewrite parses a hoplb-rewrite-path tag: "<regexp> <replacement>",
+// e.g. "^/v1/(.*) /api/v1/$1"
+func ParseRewrite(tag string) (Rewrite, error) {
+	fields := strings.Fields(tag)
+	if len(fields) != 2 {
+		return Rewrite{}, fmt.Errorf("want \"<regexp> <replacement>\", got %q", tag)
+	}
+	re, err := regexp.Compile(fields[0])
+	if err != nil {
+		return Rewrite{}, fmt.Errorf("invalid regexp %q: %w", fields[0], err)
+	}
+	return Rewrite{Regexp: re, Replacement: fields[1]}, nil
+}
+
+// ParseRedirect parses a hoplb-redirect tag: "<regexp> <replacement> [code]",
+// e.g. "^https?://old\.example\.com/(.*) https://new.example.com/$1 308".
+// The code defaults to 301.
+func ParseRedirect(tag string) (Redirect, error) {
+	fields := strings.Fields(tag)
+	if len(fields) != 2 && len(fields) != 3 {
+		return Redirect{}, fmt.Errorf("want \"<regexp> <replacement> [code]\", got %q", tag)
+	}
+	re, err := regexp.Compile(fields[0])
+	if err != nil {
+		return Redirect{}, fmt.Errorf("invalid regexp %q: %w", fields[0], err)
+	}
+	code := http.StatusMovedPermanently
+	if len(fields) == 3 {
+		code, err = strconv.Atoi(fields[2])
+		switch {
+		case err != nil:
+			return Redirect{}, fmt.Errorf("invalid status %q", fields[2])
+		case code != 301 && code != 302 && code != 303 && code != 307 && code != 308:
+			return Redirect{}, fmt.Errorf("status %d is not a redirect", code)
+		}
+	}
+	return Redirect{Regexp: re, Replacement: fields[1], Code: code}, nil
+}
+
+// replace substitutes host captures into template, then replaces the
+// matches of re in s with it
+func replace(re *regexp.Regexp, template, s string, vars Vars) string {
+	if len(vars) > 0 {
+		escaped := make(Vars, len(vars))
+		for k, v := range vars {
+			escaped[k] = strings.ReplaceAll(v, "$", "$$") // client-controlled
+		}
+		template = expandVars(template, escaped)
+	}
+	return re.ReplaceAllString(s, template)
+}
+
+// redirect writes the first matching redirect and returns its status,
+// or returns 0 if none matches
+func (r *Route) redirect(w http.ResponseWriter, req *http.Request, https bool, vars Vars) int {
+	if len(r.Redirects) == 0 {
+		return 0
+	}
+	scheme := "http://"
+	if https {
+		scheme = "https://"
+	}
+	u := scheme + req.Host + req.URL.RequestURI()
+	for _, rd := range r.Redirects {
+		if rd.Regexp.MatchString(u) {
+			http.Redirect(w, req, replace(rd.Regexp, rd.Replacement, u, vars), rd.Code)
+			return rd.Code
+		}
+	}
+	return 0
+}
+
+// rewrite applies the first matching path rewrite and the host rewrite
+// to the upstream request
+func (r *Route) rewrite(req *http.Request, vars Vars) {
+	for _, rw := range r.PathRewrites {
+		if !rw.Regexp.MatchString(req.URL.Path) {
+			continue
+		}
+		path := replace(rw.Regexp, rw.Replacement, req.URL.Path, vars)
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		req.URL.Path, req.URL.RawPath = path, ""
+		break
+	}
+	if r.HostRewrite != "" {
+		req.Host = expandVars(r.HostRewrite, vars)
+	}
+}
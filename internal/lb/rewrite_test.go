@@ -0,0 +1,186 @@
+package lb
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"hoplib"
+)
+
+func TestParseRedirect(t *testing.T) {
+	tests := []struct {
+		tag      string
+		wantCode int
+		wantErr  bool
+	}{
+		{`^https?://old\.example\.com/(.*) https://new.example.com/$1`, 301, false},
+		{`^/docs/(.*) https://docs.example.com/$1 308`, 308, false},
+		{`^/x /y 302`, 302, false},
+		{`^/x /y 200`, 0, true}, // not a redirect
+		{`^/x /y abc`, 0, true}, // bad code
+		{`^/x`, 0, true},        // no target
+		{`^/(x /y`, 0, true},    // bad regexp
+		{`^/x /y 301 extra`, 0, true},
+	}
+	for _, tt := range tests {
+		rd, err := ParseRedirect(tt.tag)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseRedirect(%q) = %+v; want error", tt.tag, rd)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseRedirect(%q) error: %v", tt.tag, err)
+		} else if rd.Code != tt.wantCode {
+			t.Errorf("ParseRedirect(%q).Code = %d; want %d", tt.tag, rd.Code, tt.wantCode)
+		}
+	}
+}
+
+func TestRouteRedirect(t *testing.T) {
+	redirect := func(tag string) Redirect {
+		rd, err := ParseRedirect(tag)
+		if err != nil {
+			t.Fatalf("ParseRedirect(%q): %v", tag, err)
+		}
+		return rd
+	}
+	route := &Route{Redirects: []Redirect{
+		redirect(`^https?://old\.example\.com(:\d+)?/(.*) https://new.example.com/$2`),
+		redirect(`^https://[a-z]+\.example\.eu/legacy/(.*) https://{tenant}.example.com/${1} 308`),
+	}}
+
+	tests := []struct {
+		url      string
+		https    bool
+		vars     Vars
+		wantCode int
+		wantLoc  string
+	}{
+		{"http://old.example.com/a/b?q=1", false, nil, 301, "https://new.example.com/a/b?q=1"},
+		{"http://old.example.com:8080/", false, nil, 301, "https://new.example.com/"},
+		{"https://acme.example.eu/legacy/x", true, Vars{"tenant": "acme"}, 308, "https://acme.example.com/x"},
+		{"http://acme.example.eu/legacy/x", false, Vars{"tenant": "acme"}, 0, ""}, // scheme doesn't match
+		{"http://other.example.com/", false, nil, 0, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", tt.url, nil)
+		w := httptest.NewRecorder()
+		code := route.redirect(w, req, tt.https, tt.vars)
+		if code != tt.wantCode {
+			t.Errorf("redirect(%s) = %d; want %d", tt.url, code, tt.wantCode)
+			continue
+		}
+		if loc := w.Header().Get("Location"); loc != tt.wantLoc {
+			t.Errorf("redirect(%s) Location = %q; want %q", tt.url, loc, tt.wantLoc)
+		}
+	}
+}
+
+func TestRouteRewrite(t *testing.T) {
+	rewrite := func(tag string) Rewrite {
+		rw, err := ParseRewrite(tag)
+		if err != nil {
+			t.Fatalf("ParseRewrite(%q): %v", tag, err)
+		}
+		return rw
+	}
+	route := &Route{PathRewrites: []Rewrite{
+		rewrite(`^/v1/(.*) /api/v1/$1`),
+		rewrite(`^/(?P<lang>en|de)/docs(/.*)?$ /docs${2}?lang=${lang}`),
+		rewrite(`^/static/ assets/`),
+		rewrite(`^/t/(.*) /{tenant}/$1`),
+	}}
+
+	tests := []struct {
+		path string
+		vars Vars
+		want string
+	}{
+		{"/v1/users/7", nil, "/api/v1/users/7"},
+		{"/v2/users/7", nil, "/v2/users/7"},             // no match
+		{"/de/docs/intro", nil, "/docs/intro?lang=de"},  // path only: "?" is escaped
+		{"/static/app.js", nil, "/assets/app.js"},       // leading slash added
+		{"/t/x", Vars{"tenant": "$1acme"}, "/$1acme/x"}, // captures are literal
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "http://app.example.com"+tt.path+"?keep=1", nil)
+		route.rewrite(req, tt.vars)
+		if req.URL.Path != tt.want {
+			t.Errorf("rewrite(%s) = %q; want %q", tt.path, req.URL.Path, tt.want)
+		}
+		if req.URL.RawQuery != "keep=1" {
+			t.Errorf("rewrite(%s) query = %q; want keep=1", tt.path, req.URL.RawQuery)
+		}
+	}
+}
+
+func TestRewriteTags(t *testing.T) {
+	route := &Route{}
+	errs := applyJobTags(route, &hoplib.Job{Name: "app", Tags: map[string]string{
+		TagRewritePath + ".10": `^/c /z`,
+		TagRewritePath + ".2":  `^/b /y`,
+		TagRewritePath:         `^/a /x`,
+		TagRewritePath + ".3":  `^/(broken /w`,
+		TagRedirect:            `^http://old/ https://new/ 200`,
+		TagRewriteHost:         "{tenant}.internal",
+	}})
+
+	var got []string
+	for _, rw := range route.PathRewrites {
+		got = append(got, rw.Regexp.String())
+	}
+	if len(got) != 3 || got[0] != "^/a" || got[1] != "^/b" || got[2] != "^/c" {
+		t.Errorf("rewrites = %q; want ^/a, ^/b, ^/c in index order", got)
+	}
+	if len(route.Redirects) != 0 || len(errs) != 2 {
+		t.Errorf("redirects = %d, errors = %v; want the bad rewrite and redirect rejected", len(route.Redirects), errs)
+	}
+	if route.HostRewrite != "{tenant}.internal" {
+		t.Errorf("HostRewrite = %q", route.HostRewrite)
+	}
+}
+
+func TestProxyRewriteAndRedirect(t *testing.T) {
+	var gotHost, gotURI string
+	proxy, m, addr := newTestProxy(t, "unused.example.com", func(w http.ResponseWriter, r *http.Request) {
+		gotHost, gotURI = r.Host, r.RequestURI
+	})
+	rewrite, _ := ParseRewrite(`^/v1/(.*) /api/v1/$1`)
+	redirect, _ := ParseRedirect(`^http://old\.example\.com/(.*) https://app.example.com/$1`)
+	proxy.routeTable.Update(map[string]*Route{
+		"~(?P<tenant>[a-z]+)\\.example\\.com": {
+			Pattern:      "~(?P<tenant>[a-z]+)\\.example\\.com",
+			Backends:     []*Backend{{Address: addr, Healthy: true}},
+			Redirects:    []Redirect{redirect},
+			PathRewrites: []Rewrite{rewrite},
+			HostRewrite:  "{tenant}.internal",
+		},
+	})
+
+	req := httptest.NewRequest("GET", "http://acme.example.com/v1/users?id=7", nil)
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want 200", w.Code)
+	}
+	if gotURI != "/api/v1/users?id=7" || gotHost != "acme.internal" {
+		t.Errorf("backend got %s %s; want acme.internal /api/v1/users?id=7", gotHost, gotURI)
+	}
+
+	gotURI = ""
+	req = httptest.NewRequest("GET", "http://old.example.com/v1/users", nil)
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "https://app.example.com/v1/users" {
+		t.Errorf("redirect = %d %q; want 301 to https://app.example.com/v1/users", w.Code, w.Header().Get("Location"))
+	}
+	if gotURI != "" {
+		t.Error("redirected request reached the backend")
+	}
+	if n := m.RequestCounts()["old.example.com"][""][http.StatusMovedPermanently]; n != 1 {
+		t.Errorf("301 responses recorded = %d; want 1", n)
+	}
+}
@@ -1,6 +1,10 @@
 package lb
 
 import (
+	"log"
+	"net/netip"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -9,14 +13,47 @@ import (
 // Backend represents a single backend server
 type Backend struct {
 	Address string // host:port
+	Job     string // hop job the task belongs to
 	Healthy bool
 }
 
 // Route represents a routing rule
 type Route struct {
 	Pattern  string     // e.g., "*.haas.eu" or "api.haas.eu"
-	Backends []*Backend
-	next     uint64 // round-robin counter
+	Backends []*Backend // default backends, for requests no rule matches
+	Rules    []*Rule    // sorted by priority, see rules.go
+	next     uint64     // round-robin counter
+
+	// Policy from job tags (see tags.go)
+	RateLimits      []RateLimit
+	MaxInFlight     int               // 0 = unlimited
+	AdaptiveLimit   AdaptiveLimit     // zero = off
+	AllowCIDRs      []netip.Prefix    // if set, only these clients may connect
+	DenyCIDRs       []netip.Prefix    // these clients are always refused
+	ForwardAuth     *ForwardAuth      // nil = no external auth
+	BasicAuth       *BasicAuth        // nil = no Basic auth
+	JWT             *JWTAuth          // nil = no JWT validation
+	UpstreamTLS     *UpstreamTLS      // nil = plain HTTP to backends
+	ClientCA        *ClientCA         // nil = no client certificates required
+	HTTPSRedirect   int               // 0 = off, 301/308, or -1 = 301 for GET/HEAD and 308 otherwise
+	HSTS            *HSTS             // nil = no Strict-Transport-Security header
+	ResponseHeaders *HeaderRules      // nil = backend response headers untouched
+	RequestHeaders  map[string]string // set on upstream requests; values may use {captures}
+	Redirects       []Redirect        // first match answers the request, see rewrite.go
+	PathRewrites    []Rewrite         // first match rewrites the upstream path
+	HostRewrite     string            // "" = client's Host; may use {captures}
+	Maintenance     *MaintenanceMode  // nil = serving; see also Proxy.Maintenance
+	Mirror          *Mirror           // nil = no shadow traffic
+	PinHeader       string            // request header naming a job to pin to, see pin.go
+	PinCookie       string            // cookie naming a job to pin to
+	Pins            map[string]*Pin   // job name or hoplb-pin-alias -> job sharing the host
+
+	// Runtime state, carried over across Update when the policy is unchanged
+	limiters    []*rateLimiter
+	concurrency concurrencyLimiter // nil = unlimited
+	htpasswd    *htpasswdFile
+	jwks        *keySet
+	hostRegexp  *regexp.Regexp // compiled regex/template Pattern
 }
 
 // RouteTable manages all routes
@@ -24,6 +61,11 @@ type RouteTable struct {
 	mu        sync.RWMutex
 	exact     map[string]*Route // "api.example.com" -> route
 	wildcards map[string]*Route // "*.example.com" -> route
+	multi     map[string]*Route // ".example.com" -> route for "**.example.com"
+	regexps   []*Route          // regex/template patterns, tried in order
+	catchAll  *Route            // "*", or nil
+
+	generation atomic.Uint64 // incremented by every Update
 }
 
 // NewRouteTable creates a new route table
@@ -31,29 +73,115 @@ func NewRouteTable() *RouteTable {
 	return &RouteTable{
 		exact:     make(map[string]*Route),
 		wildcards: make(map[string]*Route),
+		multi:     make(map[string]*Route),
 	}
 }
 
-// Update replaces all routes atomically
+// Update replaces all routes atomically. Limiter state of routes whose
+// pattern and policy are unchanged is kept.
 func (rt *RouteTable) Update(routes map[string]*Route) {
 	rt.mu.Lock()
 	defer rt.mu.Unlock()
 
 	exact := make(map[string]*Route, len(routes))
 	wildcards := make(map[string]*Route)
+	multi := make(map[string]*Route)
+	var regexps []*Route
+	var catchAll *Route
 	for pattern, route := range routes {
-		if strings.HasPrefix(pattern, "*.") {
+		route.carryOver(rt.lookup(pattern))
+
+		switch {
+		case isHostRegexp(pattern):
+			if route.hostRegexp == nil {
+				re, err := compileHostPattern(pattern)
+				if err != nil {
+					log.Printf("Skipping route: %v", err)
+					continue
+				}
+				route.hostRegexp = re
+			}
+			regexps = append(regexps, route)
+		case pattern == "*":
+			catchAll = route
+		case strings.HasPrefix(pattern, "**."):
+			multi[pattern[2:]] = route
+		case strings.HasPrefix(pattern, "*."):
 			wildcards[pattern] = route
-		} else {
+		default:
 			exact[pattern] = route
 		}
 	}
 	rt.exact = exact
 	rt.wildcards = wildcards
+	rt.multi = multi
+	rt.regexps = sortRegexpRoutes(regexps)
+	rt.catchAll = catchAll
+	rt.generation.Add(1)
 }
 
-// Match finds a route for the given host
+// routes returns all routes in the table
+func (rt *RouteTable) routes() []*Route {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+
+	routes := make([]*Route, 0, len(rt.exact)+len(rt.wildcards)+len(rt.multi)+len(rt.regexps)+1)
+	for _, m := range []map[string]*Route{rt.exact, rt.wildcards, rt.multi} {
+		for _, route := range m {
+			routes = append(routes, route)
+		}
+	}
+	routes = append(routes, rt.regexps...)
+	if rt.catchAll != nil {
+		routes = append(routes, rt.catchAll)
+	}
+	return routes
+}
+
+// sortRegexpRoutes orders regex routes deterministically: longer patterns
+// (usually more specific) first, then by pattern
+func sortRegexpRoutes(routes []*Route) []*Route {
+	sort.Slice(routes, func(i, j int) bool {
+		a, b := routes[i].Pattern, routes[j].Pattern
+		if len(a) != len(b) {
+			return len(a) > len(b)
+		}
+		return a < b
+	})
+	return routes
+}
+
+// lookup returns the route registered under pattern, or nil
+func (rt *RouteTable) lookup(pattern string) *Route {
+	switch {
+	case isHostRegexp(pattern):
+		for _, route := range rt.regexps {
+			if route.Pattern == pattern {
+				return route
+			}
+		}
+		return nil
+	case pattern == "*":
+		return rt.catchAll
+	case strings.HasPrefix(pattern, "**."):
+		return rt.multi[pattern[2:]]
+	case strings.HasPrefix(pattern, "*."):
+		return rt.wildcards[pattern]
+	}
+	return rt.exact[pattern]
+}
+
+// Match finds a route for the given host. The most specific pattern wins:
+// exact, then *.domain (one label), then **.domain from the longest suffix
+// to the shortest, then regex and template patterns, then the catch-all *.
 func (rt *RouteTable) Match(host string) *Route {
+	route, _ := rt.MatchVars(host)
+	return route
+}
+
+// MatchVars is Match that also returns the captures of a regex or template
+// pattern (nil for other patterns)
+func (rt *RouteTable) MatchVars(host string) (*Route, Vars) {
 	rt.mu.RLock()
 	defer rt.mu.RUnlock()
 
@@ -64,7 +192,7 @@ func (rt *RouteTable) Match(host string) *Route {
 
 	// Exact match first (O(1))
 	if route, ok := rt.exact[host]; ok {
-		return route
+		return route, nil
 	}
 
 	// Wildcard match (O(1)): *.domain.com matches app.domain.com
@@ -73,29 +201,113 @@ func (rt *RouteTable) Match(host string) *Route {
 	if idx := strings.Index(host, "."); idx != -1 {
 		wildcard := "*" + host[idx:]
 		if route, ok := rt.wildcards[wildcard]; ok {
-			return route
+			return route, nil
 		}
 	}
 
-	return nil
+	// Multi-level wildcards (O(1) per label): **.domain.com matches any
+	// depth below domain.com. Suffixes are tried longest first, so
+	// **.b.domain.com wins over **.domain.com for a.b.domain.com.
+	if len(rt.multi) > 0 {
+		for idx := strings.Index(host, "."); idx != -1; {
+			if route, ok := rt.multi[host[idx:]]; ok {
+				return route, nil
+			}
+			next := strings.Index(host[idx+1:], ".")
+			if next == -1 {
+				break
+			}
+			idx += 1 + next
+		}
+	}
+
+	// Regex patterns only when the map lookups miss
+	for _, route := range rt.regexps {
+		if vars, ok := captures(route.hostRegexp, host); ok {
+			return route, vars
+		}
+	}
+
+	return rt.catchAll, nil
+}
+
+// carryOver sets up runtime state, reusing old's where the policy matches
+func (r *Route) carryOver(old *Route) {
+	r.limiters = make([]*rateLimiter, len(r.RateLimits))
+	for i, spec := range r.RateLimits {
+		if old != nil && i < len(old.limiters) && old.limiters[i].spec == spec {
+			r.limiters[i] = old.limiters[i]
+		} else {
+			r.limiters[i] = newRateLimiter(spec)
+		}
+	}
+
+	if old != nil && old.MaxInFlight == r.MaxInFlight && old.AdaptiveLimit == r.AdaptiveLimit {
+		r.concurrency = old.concurrency
+	} else {
+		r.concurrency = newConcurrencyLimiter(r.MaxInFlight, r.AdaptiveLimit)
+	}
+
+	// Keep loaded credentials and keys instead of re-reading them every sync
+	if old != nil {
+		r.hostRegexp = old.hostRegexp // same pattern, same regexp
+	}
+
+	if r.BasicAuth != nil {
+		if old != nil && old.BasicAuth != nil && old.BasicAuth.File == r.BasicAuth.File {
+			r.htpasswd = old.htpasswd
+		} else {
+			r.htpasswd = newHtpasswdFile(r.BasicAuth.File)
+		}
+	}
+	if r.ClientCA != nil && r.ClientCA.Pool == nil {
+		var prev *ClientCA
+		if old != nil && old.ClientCA != nil && old.ClientCA.File == r.ClientCA.File {
+			prev = old.ClientCA
+		}
+		r.ClientCA.load(prev)
+	}
+	if r.JWT != nil && !r.JWT.invalid {
+		if old != nil && old.JWT != nil && old.JWT.JWKS == r.JWT.JWKS && old.jwks != nil {
+			r.jwks = old.jwks
+		} else {
+			r.jwks = newKeySet(r.JWT.JWKS)
+		}
+	}
 }
 
 // GetHealthyBackend returns a healthy backend using round-robin
 func (r *Route) GetHealthyBackend() *Backend {
+	return pickHealthy(r.Backends, &r.next)
+}
+
+// backendCount returns the number of backends, including those of rules
+func (r *Route) backendCount() int {
 	n := len(r.Backends)
+	for _, rule := range r.Rules {
+		n += len(rule.Backends)
+	}
+	for name, pin := range r.Pins {
+		if pin.Only && name == pin.Job { // skip aliases
+			n += len(pin.Backends)
+		}
+	}
+	return n
+}
+
+// pickHealthy round-robins through backends, skipping unhealthy ones
+func pickHealthy(backends []*Backend, next *uint64) *Backend {
+	n := len(backends)
 	if n == 0 {
 		return nil
 	}
 
-	// Round-robin through backends, skipping unhealthy ones
-	start := atomic.AddUint64(&r.next, 1)
+	start := atomic.AddUint64(next, 1)
 	for i := 0; i < n; i++ {
 		idx := (int(start) + i) % n
-		if r.Backends[idx].Healthy {
-			return r.Backends[idx]
+		if backends[idx].Healthy {
+			return backends[idx]
 		}
 	}
 	return nil
 }
-
-
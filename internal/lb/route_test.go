@@ -136,3 +136,119 @@ func TestRouteNoHealthyBackends(t *testing.T) {
 		t.Errorf("GetHealthyBackend = %v; want nil", b)
 	}
 }
+
+func TestRouteTableWildcardPrecedence(t *testing.T) {
+	rt := NewRouteTable()
+	routes := map[string]*Route{}
+	for _, p := range []string{
+		"api.example.com",
+		"*.example.com",
+		"**.example.com",
+		"*.b.example.com",
+		"**.b.example.com",
+		"**.deep.org",
+		"*",
+	} {
+		routes[p] = &Route{Pattern: p}
+	}
+	rt.Update(routes)
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"api.example.com", "api.example.com"},       // exact beats wildcards
+		{"web.example.com", "*.example.com"},         // single label beats multi
+		{"a.web.example.com", "**.example.com"},      // too deep for *.example.com
+		{"x.y.z.example.com:8080", "**.example.com"}, // port stripped
+		{"a.b.example.com", "*.b.example.com"},       // single label on the longer suffix
+		{"x.a.b.example.com", "**.b.example.com"},    // longest multi-level suffix wins
+		{"b.example.com", "*.example.com"},           // **.b.example.com needs a label below b
+		{"example.com", "*"},                         // **.example.com needs at least one label
+		{"a.deep.org", "**.deep.org"},
+		{"1.2.3.4.deep.org", "**.deep.org"},
+		{"unknown.net", "*"},
+		{"localhost", "*"},
+	}
+	for _, tt := range tests {
+		route := rt.Match(tt.host)
+		if route == nil || route.Pattern != tt.want {
+			t.Errorf("Match(%q) = %v; want %q", tt.host, route, tt.want)
+		}
+	}
+
+	// Without a catch-all, unknown hosts have no route
+	delete(routes, "*")
+	rt.Update(routes)
+	if route := rt.Match("unknown.net"); route != nil {
+		t.Errorf("Match(unknown.net) = %q; want nil", route.Pattern)
+	}
+}
+
+func TestRouteTableRegexpPatterns(t *testing.T) {
+	rt := NewRouteTable()
+	routes := map[string]*Route{}
+	for _, p := range []string{
+		"cust-vip.app.eu",
+		"*.app.eu",
+		`~cust-(?P<customer>[0-9]+)\.app\.eu`,
+		"{tenant}.{region}.shop.eu",
+		"**.shop.io",
+		"*",
+		`~bad(`,
+	} {
+		routes[p] = &Route{Pattern: p}
+	}
+	rt.Update(routes)
+
+	tests := []struct {
+		host     string
+		want     string
+		wantVars Vars
+	}{
+		{"cust-vip.app.eu", "cust-vip.app.eu", nil},                 // exact stays on the fast path
+		{"cust-123.app.eu", "*.app.eu", nil},                        // wildcard wins over regex
+		{"acme.eu-west.shop.eu:443", "{tenant}.{region}.shop.eu", Vars{"tenant": "acme", "region": "eu-west"}},
+		{"a.b.shop.io", "**.shop.io", nil},
+		{"x.cust-1.app.eu", "*", nil}, // regex must match the whole host
+		{"unknown.net", "*", nil},
+	}
+	for _, tt := range tests {
+		route, vars := rt.MatchVars(tt.host)
+		if route == nil || route.Pattern != tt.want {
+			t.Errorf("MatchVars(%q) = %v; want %q", tt.host, route, tt.want)
+			continue
+		}
+		if len(vars) != len(tt.wantVars) {
+			t.Errorf("MatchVars(%q) vars = %v; want %v", tt.host, vars, tt.wantVars)
+		}
+		for k, v := range tt.wantVars {
+			if vars[k] != v {
+				t.Errorf("MatchVars(%q)[%s] = %q; want %q", tt.host, k, vars[k], v)
+			}
+		}
+	}
+
+	// Without the wildcard, the regex catches customer hosts
+	delete(routes, "*.app.eu")
+	rt.Update(routes)
+	route, vars := rt.MatchVars("cust-123.app.eu")
+	if route == nil || vars["customer"] != "123" {
+		t.Errorf("MatchVars(cust-123.app.eu) = %v, %v; want customer 123", route, vars)
+	}
+}
+
+func TestExpandVars(t *testing.T) {
+	vars := Vars{"customer": "123", "region": "eu"}
+	tests := []struct{ in, want string }{
+		{"{customer}", "123"},
+		{"/tenants/{customer}/{region}/", "/tenants/123/eu/"},
+		{"{unknown} {customer", "{unknown} {customer"},
+		{`{"json": true}`, `{"json": true}`},
+	}
+	for _, tt := range tests {
+		if got := expandVars(tt.in, vars); got != tt.want {
+			t.Errorf("expandVars(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package lb
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Rule sends requests matching all its matchers to the backends of one
+// job sharing the route's host. Rules come from the hoplb-match tag.
+type Rule struct {
+	Job      string
+	Priority int    // higher is tried first
+	Expr     string // the hoplb-match tag, for logs
+	Matchers []Matcher
+	Backends []*Backend
+	next     uint64 // round-robin counter
+}
+
+// Matcher is one condition of a rule
+type Matcher struct {
+	Kind   string         // "method", "header", "query" or "cookie"
+	Name   string         // header/query/cookie name; empty for method
+	Values []string       // any of these; empty = present (or regexp)
+	Regexp *regexp.Regexp // value must match instead
+	Negate bool           // != : the condition must not hold
+}
+
+// ParseMatch parses a hoplb-match tag. Conditions are joined by "&&" and
+// all must hold:
+//
+//	method=GET|HEAD
+//	header:X-Tenant=beta|gamma   header:X-Debug   header:User-Agent~(?i)bot
+//	query:preview=1              cookie:canary!=never
+//
+// "=" matches any of the "|"-separated values, "!=" none of them, "~" a
+// regular expression, and a bare name that the header, query parameter or
+// cookie is present.
+func ParseMatch(expr string) ([]Matcher, error) {
+	var matchers []Matcher
+	for _, cond := range strings.Split(expr, "&&") {
+		cond = strings.TrimSpace(cond)
+		if cond == "" {
+			return nil, fmt.Errorf("empty condition in %q", expr)
+		}
+		m, err := parseMatcher(cond)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	return matchers, nil
+}
+
+func parseMatcher(cond string) (Matcher, error) {
+	var m Matcher
+	subject, op, value := cond, "", ""
+	if i := strings.IndexAny(cond, "=~!"); i >= 0 {
+		subject = cond[:i]
+		switch {
+		case strings.HasPrefix(cond[i:], "!="):
+			op, value = "!=", cond[i+2:]
+		case cond[i] == '=' || cond[i] == '~':
+			op, value = cond[i:i+1], cond[i+1:]
+		default:
+			return m, fmt.Errorf("invalid operator in %q", cond)
+		}
+	}
+	subject, value = strings.TrimSpace(subject), strings.TrimSpace(value)
+
+	kind, name, _ := strings.Cut(subject, ":")
+	m.Kind = strings.ToLower(kind)
+	switch m.Kind {
+	case "method":
+		if name != "" || op != "=" && op != "!=" {
+			return m, fmt.Errorf("want method=GET|POST, got %q", cond)
+		}
+	case "header", "query", "cookie":
+		if name == "" {
+			return m, fmt.Errorf("missing %s name in %q", m.Kind, cond)
+		}
+		m.Name = name
+		if m.Kind == "header" {
+			m.Name = http.CanonicalHeaderKey(name)
+		}
+	default:
+		return m, fmt.Errorf("unknown condition %q (want method, header:, query: or cookie:)", cond)
+	}
+
+	switch op {
+	case "~":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return m, fmt.Errorf("invalid regexp in %q: %w", cond, err)
+		}
+		m.Regexp = re
+	case "=", "!=":
+		m.Negate = op == "!="
+		for _, v := range strings.Split(value, "|") {
+			if m.Kind == "method" {
+				v = strings.ToUpper(strings.TrimSpace(v))
+			}
+			m.Values = append(m.Values, v)
+		}
+	}
+	return m, nil
+}
+
+// match reports whether r satisfies the condition
+func (m *Matcher) match(r *http.Request) bool {
+	var values []string
+	present := true
+	switch m.Kind {
+	case "method":
+		values = []string{r.Method}
+	case "header":
+		values, present = r.Header[m.Name]
+	case "query":
+		values, present = r.URL.Query()[m.Name]
+	case "cookie":
+		c, err := r.Cookie(m.Name)
+		if present = err == nil; present {
+			values = []string{c.Value}
+		}
+	}
+
+	var ok bool
+	switch {
+	case m.Regexp != nil:
+		for _, v := range values {
+			if ok = m.Regexp.MatchString(v); ok {
+				break
+			}
+		}
+	case m.Values != nil:
+		for _, v := range values {
+			for _, want := range m.Values {
+				if v == want {
+					ok = true
+				}
+			}
+		}
+	default:
+		ok = present
+	}
+	return ok != m.Negate
+}
+
+// match reports whether r satisfies every condition of the rule
+func (rule *Rule) match(r *http.Request) bool {
+	for i := range rule.Matchers {
+		if !rule.Matchers[i].match(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// GetHealthyBackend returns a healthy backend of the rule's job using round-robin
+func (rule *Rule) GetHealthyBackend() *Backend {
+	return pickHealthy(rule.Backends, &rule.next)
+}
+
+// matchRule returns the first rule, by priority, that matches r
+func (r *Route) matchRule(req *http.Request) *Rule {
+	for _, rule := range r.Rules {
+		if rule.match(req) {
+			return rule
+		}
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+package lb
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"hoplib"
+)
+
+func TestParseMatch(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr bool
+	}{
+		{"method=GET|HEAD", false},
+		{"header:X-Tenant=beta && method=POST", false},
+		{"header:X-Debug", false},
+		{"query:preview=1", false},
+		{"cookie:canary!=never", false},
+		{"header:User-Agent~(?i)bot", false},
+		{"method", true},
+		{"method:x=GET", true},
+		{"path=/api", true},
+		{"header:=x", true},
+		{"header:X-A~(", true},
+		{"header:X-A && ", true},
+		{"header:X-A!x", true},
+	}
+	for _, tt := range tests {
+		_, err := ParseMatch(tt.expr)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseMatch(%q) error = %v; wantErr %v", tt.expr, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRuleMatch(t *testing.T) {
+	tests := []struct {
+		expr   string
+		method string
+		url    string
+		header map[string]string
+		want   bool
+	}{
+		{"method=GET|HEAD", "GET", "/", nil, true},
+		{"method=get", "POST", "/", nil, false},
+		{"method!=GET", "POST", "/", nil, true},
+		{"header:X-Tenant=beta|gamma", "GET", "/", map[string]string{"X-Tenant": "gamma"}, true},
+		{"header:x-tenant=beta", "GET", "/", map[string]string{"X-Tenant": "prod"}, false},
+		{"header:X-Tenant", "GET", "/", map[string]string{"X-Tenant": ""}, true},
+		{"header:X-Tenant", "GET", "/", nil, false},
+		{"header:X-Tenant!=beta", "GET", "/", nil, true},
+		{"header:User-Agent~(?i)bot", "GET", "/", map[string]string{"User-Agent": "Googlebot/2.1"}, true},
+		{"query:preview=1", "GET", "/?preview=1&x=2", nil, true},
+		{"query:preview", "GET", "/?x=2", nil, false},
+		{"cookie:canary=always", "GET", "/", map[string]string{"Cookie": "a=b; canary=always"}, true},
+		{"cookie:canary=always", "GET", "/", map[string]string{"Cookie": "canary=never"}, false},
+		{"header:X-Tenant=beta && method=POST", "GET", "/", map[string]string{"X-Tenant": "beta"}, false},
+		{"header:X-Tenant=beta && method=POST", "POST", "/", map[string]string{"X-Tenant": "beta"}, true},
+	}
+	for _, tt := range tests {
+		matchers, err := ParseMatch(tt.expr)
+		if err != nil {
+			t.Fatalf("ParseMatch(%q): %v", tt.expr, err)
+		}
+		req := httptest.NewRequest(tt.method, "http://app.example.com"+tt.url, nil)
+		for k, v := range tt.header {
+			req.Header.Set(k, v)
+		}
+		if got := (&Rule{Matchers: matchers}).match(req); got != tt.want {
+			t.Errorf("%q on %s %s %v = %v; want %v", tt.expr, tt.method, tt.url, tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestNewRouteRules(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	job := func(name string, tags map[string]string, addrs ...string) jobBackends {
+		jb := jobBackends{job: &hoplib.Job{Name: name, Tags: tags}}
+		for _, a := range addrs {
+			jb.backends = append(jb.backends, &Backend{Address: a, Job: name, Healthy: true})
+		}
+		return jb
+	}
+	route, _ := newRoute("app.example.com", []jobBackends{
+		job("app-beta", map[string]string{TagMatch: "header:X-Tenant=beta", TagMatchPriority: "10", TagMaxInFlight: "5"}, "10.0.0.2:80"),
+		job("app", map[string]string{TagMaxInFlight: "100"}, "10.0.0.1:80"),
+		job("app-writes", map[string]string{TagMatch: "method=POST|PUT|DELETE"}, "10.0.0.3:80"),
+		job("app-broken", map[string]string{TagMatch: "header:"}, "10.0.0.4:80"),
+	})
+
+	if len(route.Backends) != 1 || route.Backends[0].Job != "app" {
+		t.Errorf("default backends = %v; want app's only (broken rule must not become a default)", route.Backends)
+	}
+	if len(route.Rules) != 2 || route.Rules[0].Job != "app-beta" || route.Rules[1].Job != "app-writes" {
+		t.Fatalf("rules = %+v; want app-beta then app-writes", route.Rules)
+	}
+	if route.MaxInFlight != 100 {
+		t.Errorf("MaxInFlight = %d; want the default job's 100", route.MaxInFlight)
+	}
+}
+
+func TestProxyRules(t *testing.T) {
+	hit := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) { w.Header().Set("X-Served-By", name) }
+	}
+	proxy, _, prodAddr := newTestProxy(t, "app.example.com", hit("prod"))
+	beta := httptest.NewServer(hit("beta"))
+	defer beta.Close()
+	writes := httptest.NewServer(hit("writes"))
+	defer writes.Close()
+
+	betaRule, _ := ParseMatch("header:X-Tenant=beta")
+	writeRule, _ := ParseMatch("method=POST")
+	rules := []*Rule{
+		{Job: "beta", Priority: 10, Matchers: betaRule, Backends: []*Backend{{Address: beta.Listener.Addr().String(), Healthy: true}}},
+		{Job: "writes", Matchers: writeRule, Backends: []*Backend{{Address: writes.Listener.Addr().String(), Healthy: true}}},
+	}
+	proxy.routeTable.Update(map[string]*Route{
+		"app.example.com": {
+			Pattern:  "app.example.com",
+			Backends: []*Backend{{Address: prodAddr, Healthy: true}},
+			Rules:    rules,
+		},
+		"rules-only.example.com": {Pattern: "rules-only.example.com", Rules: rules[:1]},
+	})
+
+	tests := []struct {
+		host, method, tenant string
+		wantCode             int
+		wantBy               string
+	}{
+		{"app.example.com", "GET", "", 200, "prod"},
+		{"app.example.com", "POST", "", 200, "writes"},
+		{"app.example.com", "POST", "beta", 200, "beta"}, // higher priority wins
+		{"app.example.com", "GET", "beta", 200, "beta"},
+		{"rules-only.example.com", "GET", "beta", 200, "beta"},
+		{"rules-only.example.com", "GET", "", 404, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "http://"+tt.host+"/", nil)
+		if tt.tenant != "" {
+			req.Header.Set("X-Tenant", tt.tenant)
+		}
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		if w.Code != tt.wantCode || w.Header().Get("X-Served-By") != tt.wantBy {
+			t.Errorf("%s %s tenant=%q: got %d from %q; want %d from %q", tt.method, tt.host, tt.tenant, w.Code, w.Header().Get("X-Served-By"), tt.wantCode, tt.wantBy)
+		}
+	}
+
+	// A matching rule whose job is down doesn't fall through to the default
+	rules[0].Backends[0].Healthy = false
+	req := httptest.NewRequest("GET", "http://app.example.com/", nil)
+	req.Header.Set("X-Tenant", "beta")
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("rule with no healthy backend = %d; want 503", w.Code)
+	}
+}
+
+func TestProxyRulesSeeClientRequest(t *testing.T) {
+	var gotTenant, gotPath string
+	proxy, _, prodAddr := newTestProxy(t, "app.example.com", func(w http.ResponseWriter, r *http.Request) {
+		gotTenant, gotPath = r.Header.Get("X-Tenant"), r.URL.Path
+	})
+	beta := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("injected headers must not select rules or pins")
+	}))
+	defer beta.Close()
+
+	tenantRule, _ := ParseMatch("header:X-Tenant=beta")
+	rewrite, _ := ParseRewrite(`^/old/(.*) /beta/$1`)
+	betaBackends := []*Backend{{Address: beta.Listener.Addr().String(), Healthy: true}}
+	proxy.routeTable.Update(map[string]*Route{"app.example.com": {
+		Pattern:        "app.example.com",
+		Backends:       []*Backend{{Address: prodAddr, Healthy: true}},
+		RequestHeaders: map[string]string{"X-Tenant": "beta", "X-Canary": "beta"},
+		PathRewrites:   []Rewrite{rewrite},
+		Rules:          []*Rule{{Job: "beta", Matchers: tenantRule, Backends: betaBackends}},
+		PinHeader:      "X-Canary",
+		Pins:           map[string]*Pin{"beta": {Job: "beta", Backends: betaBackends}},
+	}})
+
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "http://app.example.com/old/x", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want 200", w.Code)
+	}
+	if gotTenant != "beta" || gotPath != "/beta/x" {
+		t.Errorf("default backend got X-Tenant=%q path=%q; want the header set and the path rewritten", gotTenant, gotPath)
+	}
+}
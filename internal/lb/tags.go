@@ -0,0 +1,358 @@
+package lb
+
+import (
+	"fmt"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+
+	"hoplib"
+)
+
+// Job tags read by hoplb
+const (
+	TagURLPrefix = "hoplb-urlprefix" // host patterns, e.g. "*.example.com"; see JobPatterns
+	TagPort      = "hoplb-port"      // named task port to route to
+
+	TagRoutePriority = "hoplb-route-priority" // higher wins a host claimed by several jobs (default 0)
+	TagRouteMerge    = "hoplb-route-merge"    // "true": share a host with other merge jobs
+
+	TagMatch         = "hoplb-match"          // request conditions for this job, see ParseMatch
+	TagMatchPriority = "hoplb-match-priority" // higher rules are tried first (default 0)
+	TagRateLimit     = "hoplb-ratelimit"      // token-bucket limits, see ParseRateLimits
+
+	TagMaxInFlight   = "hoplb-max-inflight"   // max concurrent requests to the route
+	TagAdaptiveLimit = "hoplb-adaptive-limit" // latency-driven limit, see ParseAdaptiveLimit
+
+	TagAllowCIDR = "hoplb-allow-cidr" // comma-separated client CIDRs/IPs admitted
+	TagDenyCIDR  = "hoplb-deny-cidr"  // comma-separated client CIDRs/IPs refused
+
+	TagForwardAuth        = "hoplb-forward-auth"         // "true" (global endpoint) or an auth URL
+	TagForwardAuthHeaders = "hoplb-forward-auth-headers" // auth response headers passed upstream
+
+	TagBasicAuth      = "hoplb-basic-auth"       // htpasswd file path
+	TagBasicAuthRealm = "hoplb-basic-auth-realm" // realm in the login prompt
+
+	TagJWTJWKS     = "hoplb-jwt-jwks"     // JWKS file path or URL; enables JWT validation
+	TagJWTIssuer   = "hoplb-jwt-issuer"   // required iss claim
+	TagJWTAudience = "hoplb-jwt-audience" // required aud claim
+	TagJWTClaims   = "hoplb-jwt-claims"   // claims passed upstream, see ParseClaimHeaders
+
+	TagUpstreamTLS  = "hoplb-upstream-tls"  // "true": HTTPS to the tasks
+	TagUpstreamCA   = "hoplb-upstream-ca"   // CA bundle file to verify tasks
+	TagUpstreamSNI  = "hoplb-upstream-sni"  // server name sent and verified
+	TagUpstreamCert = "hoplb-upstream-cert" // client certificate file for mTLS
+	TagUpstreamKey  = "hoplb-upstream-key"  // client key file for mTLS
+
+	TagClientCA = "hoplb-client-ca" // CA bundle file; clients must present a cert from it
+
+	TagHTTPSRedirect = "hoplb-https-redirect" // redirect plain HTTP to https, see ParseHTTPSRedirect
+	TagHSTS          = "hoplb-hsts"           // HSTS policy for HTTPS responses, see ParseHSTS
+
+	TagSecurityHeaders       = "hoplb-security-headers"        // "secure-defaults" preset, see SecureDefaults
+	TagResponseHeaderPrefix  = "hoplb-response-header."        // hoplb-response-header.<Name>: value to set
+	TagRemoveResponseHeaders = "hoplb-remove-response-headers" // comma-separated headers to drop
+	TagRequestHeaderPrefix   = "hoplb-request-header."         // hoplb-request-header.<Name>: value for the backend; may use {captures}
+
+	TagRedirect    = "hoplb-redirect"     // "<regexp> <url> [code]", see ParseRedirect; indexed .<n> for more
+	TagRewritePath = "hoplb-rewrite-path" // "<regexp> <path>", see ParseRewrite; indexed .<n> for more
+	TagRewriteHost = "hoplb-rewrite-host" // Host sent to the backend; may use {captures}
+
+	TagMaintenance      = "hoplb-maintenance"       // "true": answer with a 503 maintenance page
+	TagMaintenanceAllow = "hoplb-maintenance-allow" // comma-separated client CIDRs/IPs still let through
+
+	TagMirror        = "hoplb-mirror"          // job receiving a copy of the traffic
+	TagMirrorPercent = "hoplb-mirror-percent"  // share of requests copied (default 100)
+	TagMirrorMaxBody = "hoplb-mirror-max-body" // bytes; larger request bodies are not copied (default 1 MiB)
+
+	TagPinHeader = "hoplb-pin-header" // request header whose value names a job to pin to
+	TagPinCookie = "hoplb-pin-cookie" // cookie whose value names a job to pin to
+	TagPinAlias  = "hoplb-pin-alias"  // comma-separated extra pin values for this job, e.g. "always"
+	TagPinOnly   = "hoplb-pin-only"   // "true": this job gets pinned requests only
+)
+
+// jobTags are read from every job sharing a host. The other hoplb tags set
+// the route's policy and are read from its owner only, see newRoute.
+var jobTags = map[string]bool{
+	TagURLPrefix: true, TagPort: true, TagRoutePriority: true, TagRouteMerge: true,
+	TagMatch: true, TagMatchPriority: true, TagPinAlias: true, TagPinOnly: true,
+}
+
+// policyTags returns the job's route policy tags, sorted
+func policyTags(job *hoplib.Job) []string {
+	var tags []string
+	for tag := range job.Tags {
+		if strings.HasPrefix(tag, "hoplb-") && !jobTags[tag] && !strings.HasPrefix(tag, TagURLPrefix+".") {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// indexedTags returns tag and its indexed variants tag.<n> present in
+// tags, in index order
+func indexedTags(tags map[string]string, tag string) []string {
+	keys := []string{tag}
+	var indexed []string
+	for key := range tags {
+		if suffix, ok := strings.CutPrefix(key, tag+"."); ok && suffix != "" {
+			indexed = append(indexed, key)
+		}
+	}
+	sort.Slice(indexed, func(i, j int) bool {
+		a, errA := strconv.Atoi(indexed[i][len(tag)+1:])
+		b, errB := strconv.Atoi(indexed[j][len(tag)+1:])
+		if errA == nil && errB == nil && a != b {
+			return a < b
+		}
+		return indexed[i] < indexed[j]
+	})
+	return append(keys, indexed...)
+}
+
+// JobPatterns returns the host patterns a job claims: the comma-separated
+// hoplb-urlprefix plus indexed hoplb-urlprefix.<n> tags, in index order,
+// without duplicates. A value starting with "~" is a single regex and is
+// not split, since regexes may contain commas.
+func JobPatterns(job *hoplib.Job) []string {
+	var patterns []string
+	seen := make(map[string]bool)
+	for _, key := range indexedTags(job.Tags, TagURLPrefix) {
+		v := strings.TrimSpace(job.Tags[key])
+		values := []string{v}
+		if !strings.HasPrefix(v, "~") {
+			values = strings.Split(v, ",")
+		}
+		for _, p := range values {
+			if p = strings.TrimSpace(p); p != "" && !seen[p] {
+				seen[p] = true
+				patterns = append(patterns, p)
+			}
+		}
+	}
+	return patterns
+}
+
+// applyJobTags sets the route policy from a job's tags. Invalid tags are
+// reported and skipped so one typo doesn't take the route down.
+func applyJobTags(route *Route, job *hoplib.Job) []error {
+	var errs []error
+
+	if v := job.Tags[TagRateLimit]; v != "" {
+		limits, err := ParseRateLimits(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("job %s: %s: %w", job.Name, TagRateLimit, err))
+		} else {
+			route.RateLimits = limits
+		}
+	}
+
+	if v := job.Tags[TagMaxInFlight]; v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			errs = append(errs, fmt.Errorf("job %s: %s: invalid limit %q", job.Name, TagMaxInFlight, v))
+		} else {
+			route.MaxInFlight = n
+		}
+	}
+
+	if v := job.Tags[TagAdaptiveLimit]; v != "" {
+		limit, err := ParseAdaptiveLimit(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("job %s: %s: %w", job.Name, TagAdaptiveLimit, err))
+		} else {
+			route.AdaptiveLimit = limit
+		}
+	}
+
+	if v := job.Tags[TagAllowCIDR]; v != "" {
+		prefixes, err := ParseCIDRs(v)
+		if err != nil {
+			// Fail closed: a broken allow list must not open the route up
+			errs = append(errs, fmt.Errorf("job %s: %s: %w (denying all clients)", job.Name, TagAllowCIDR, err))
+			prefixes = []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")}
+			route.DenyCIDRs = append(route.DenyCIDRs, prefixes...)
+		} else {
+			route.AllowCIDRs = prefixes
+		}
+	}
+
+	if v := job.Tags[TagDenyCIDR]; v != "" {
+		// Keep the entries that parse: dropping the whole list would
+		// admit the clients it blocks
+		for _, part := range strings.Split(v, ",") {
+			prefixes, err := ParseCIDRs(part)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("job %s: %s: %w", job.Name, TagDenyCIDR, err))
+				continue
+			}
+			route.DenyCIDRs = append(route.DenyCIDRs, prefixes...)
+		}
+	}
+
+	if v := job.Tags[TagForwardAuth]; v != "" {
+		fa, err := ParseForwardAuth(v)
+		if err != nil {
+			// Fail closed: an auth endpoint we can't parse denies everything
+			errs = append(errs, fmt.Errorf("job %s: %s: %w (denying all requests)", job.Name, TagForwardAuth, err))
+			fa = &ForwardAuth{invalid: true}
+		}
+		fa.ResponseHeaders = ParseHeaderList(job.Tags[TagForwardAuthHeaders])
+		route.ForwardAuth = fa
+	}
+
+	if v := job.Tags[TagBasicAuth]; v != "" {
+		route.BasicAuth = &BasicAuth{File: v, Realm: job.Tags[TagBasicAuthRealm]}
+	}
+
+	if v := job.Tags[TagJWTJWKS]; v != "" {
+		jwt := &JWTAuth{JWKS: v, Issuer: job.Tags[TagJWTIssuer], Audience: job.Tags[TagJWTAudience]}
+		claims, err := ParseClaimHeaders(job.Tags[TagJWTClaims])
+		if err != nil {
+			// Fail closed, as with forward auth
+			errs = append(errs, fmt.Errorf("job %s: %s: %w (denying all requests)", job.Name, TagJWTClaims, err))
+			jwt.invalid = true
+		}
+		jwt.Claims = claims
+		route.JWT = jwt
+	}
+
+	upstream := UpstreamTLS{
+		CAFile:     job.Tags[TagUpstreamCA],
+		ServerName: job.Tags[TagUpstreamSNI],
+		CertFile:   job.Tags[TagUpstreamCert],
+		KeyFile:    job.Tags[TagUpstreamKey],
+	}
+	if v := job.Tags[TagUpstreamTLS]; v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			// Err on the side of encryption
+			errs = append(errs, fmt.Errorf("job %s: %s: invalid value %q (using TLS)", job.Name, TagUpstreamTLS, v))
+			enabled = true
+		}
+		if enabled {
+			route.UpstreamTLS = &upstream
+		}
+	}
+	if route.UpstreamTLS == nil && upstream != (UpstreamTLS{}) {
+		errs = append(errs, fmt.Errorf("job %s: upstream TLS tags have no effect without %s=true", job.Name, TagUpstreamTLS))
+	}
+
+	if v := job.Tags[TagClientCA]; v != "" {
+		route.ClientCA = &ClientCA{File: v} // loaded by carryOver
+	}
+
+	if v := job.Tags[TagHTTPSRedirect]; v != "" {
+		code, err := ParseHTTPSRedirect(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("job %s: %s: %w", job.Name, TagHTTPSRedirect, err))
+		} else {
+			route.HTTPSRedirect = code
+		}
+	}
+
+	if v := job.Tags[TagHSTS]; v != "" {
+		hsts, err := ParseHSTS(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("job %s: %s: %w", job.Name, TagHSTS, err))
+		} else {
+			route.HSTS = &hsts
+		}
+	}
+
+	rules, ruleErrs := parseHeaderRules(job.Tags)
+	for _, err := range ruleErrs {
+		errs = append(errs, fmt.Errorf("job %s: %w", job.Name, err))
+	}
+	route.ResponseHeaders = rules
+
+	requestHeaders, reqErrs := parseRequestHeaders(job.Tags)
+	for _, err := range reqErrs {
+		errs = append(errs, fmt.Errorf("job %s: %w", job.Name, err))
+	}
+	route.RequestHeaders = requestHeaders
+
+	for _, key := range indexedTags(job.Tags, TagRedirect) {
+		if v := job.Tags[key]; v != "" {
+			rd, err := ParseRedirect(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("job %s: %s: %w", job.Name, key, err))
+				continue
+			}
+			route.Redirects = append(route.Redirects, rd)
+		}
+	}
+	for _, key := range indexedTags(job.Tags, TagRewritePath) {
+		if v := job.Tags[key]; v != "" {
+			rw, err := ParseRewrite(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("job %s: %s: %w", job.Name, key, err))
+				continue
+			}
+			route.PathRewrites = append(route.PathRewrites, rw)
+		}
+	}
+	if v := strings.TrimSpace(job.Tags[TagRewriteHost]); v != "" {
+		if strings.ContainsAny(v, " \t/") {
+			errs = append(errs, fmt.Errorf("job %s: %s: invalid host %q", job.Name, TagRewriteHost, v))
+		} else {
+			route.HostRewrite = v
+		}
+	}
+
+	if v := job.Tags[TagMaintenance]; v != "" {
+		on, err := strconv.ParseBool(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("job %s: %s: invalid value %q", job.Name, TagMaintenance, v))
+		} else if on {
+			allow, err := ParseCIDRs(job.Tags[TagMaintenanceAllow])
+			if err != nil {
+				// Fail closed: nobody gets through
+				errs = append(errs, fmt.Errorf("job %s: %s: %w (allowing no clients)", job.Name, TagMaintenanceAllow, err))
+				allow = nil
+			}
+			route.Maintenance = &MaintenanceMode{Allow: allow}
+		}
+	}
+
+	if v := strings.TrimSpace(job.Tags[TagMirror]); v != "" && v == job.Name {
+		errs = append(errs, fmt.Errorf("job %s: %s: a job can't mirror itself", job.Name, TagMirror))
+	} else if v != "" {
+		mirror := &Mirror{Job: v, Percent: 100, MaxBody: defaultMirrorMaxBody}
+		if p := job.Tags[TagMirrorPercent]; p != "" {
+			pct, err := ParseMirrorPercent(p)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("job %s: %s: %w (mirroring nothing)", job.Name, TagMirrorPercent, err))
+			}
+			mirror.Percent = pct
+		}
+		if b := job.Tags[TagMirrorMaxBody]; b != "" {
+			n, err := strconv.ParseInt(b, 10, 64)
+			if err != nil || n < 0 {
+				errs = append(errs, fmt.Errorf("job %s: %s: invalid size %q", job.Name, TagMirrorMaxBody, b))
+			} else {
+				mirror.MaxBody = n
+			}
+		}
+		route.Mirror = mirror
+	}
+
+	if v := strings.TrimSpace(job.Tags[TagPinHeader]); v != "" {
+		if validHeaderName(v) {
+			route.PinHeader = v
+		} else {
+			errs = append(errs, fmt.Errorf("job %s: %s: invalid header name %q", job.Name, TagPinHeader, v))
+		}
+	}
+	if v := strings.TrimSpace(job.Tags[TagPinCookie]); v != "" {
+		if validHeaderName(v) { // cookie names are tokens too
+			route.PinCookie = v
+		} else {
+			errs = append(errs, fmt.Errorf("job %s: %s: invalid cookie name %q", job.Name, TagPinCookie, v))
+		}
+	}
+
+	return errs
+}
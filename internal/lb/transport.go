@@ -0,0 +1,45 @@
+package lb
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"hoplb/internal/metrics"
+)
+
+// newTransport returns the backend transport shared by all requests.
+// Dialed connections are counted per backend so pool usage shows up in metrics.
+func newTransport(m *metrics.Metrics) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil || m == nil {
+			return conn, err
+		}
+		m.BackendConnOpened(addr)
+		return &countedConn{Conn: conn, backend: addr, metrics: m}, nil
+	}
+	return t
+}
+
+// countedConn reports its close to metrics exactly once
+type countedConn struct {
+	net.Conn
+	backend string
+	metrics *metrics.Metrics
+	once    sync.Once
+}
+
+// Close closes the connection and decrements the open count
+func (c *countedConn) Close() error {
+	c.once.Do(func() { c.metrics.BackendConnClosed(c.backend) })
+	return c.Conn.Close()
+}
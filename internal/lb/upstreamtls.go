@@ -0,0 +1,141 @@
+package lb
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// UpstreamTLS makes hoplb talk HTTPS to a route's backends
+type UpstreamTLS struct {
+	CAFile     string // PEM bundle to verify backends; empty = system roots
+	ServerName string // SNI and verified name; empty = the backend address
+	CertFile   string // client certificate for mTLS; empty = none
+	KeyFile    string
+}
+
+// config builds the client TLS config, reading the files
+func (u UpstreamTLS) config() (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName: u.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if u.CAFile != "" {
+		pool, err := LoadCertPool(u.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+
+	if u.CertFile != "" || u.KeyFile != "" {
+		if u.CertFile == "" || u.KeyFile == "" {
+			return nil, errors.New("client certificate needs both a cert and a key file")
+		}
+		cert, err := tls.LoadX509KeyPair(u.CertFile, u.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// upstreamTLSRecheck is how often the files of a cached transport are
+// checked for changes
+const upstreamTLSRecheck = 5 * time.Second
+
+// tlsTransport is a cached transport with the files it was built from
+type tlsTransport struct {
+	*http.Transport
+	modTimes [3]time.Time // CAFile, CertFile, KeyFile
+	checked  time.Time
+}
+
+// modTimes returns the modification times of the files; missing or unset
+// files give the zero time
+func (u UpstreamTLS) modTimes() [3]time.Time {
+	var times [3]time.Time
+	for i, path := range []string{u.CAFile, u.CertFile, u.KeyFile} {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			times[i] = info.ModTime()
+		}
+	}
+	return times
+}
+
+// transportFor returns the transport for route's backends. Routes with the
+// same upstream TLS settings share a transport, and with it a connection
+// pool, across route table updates. The transport is rebuilt when one of
+// its files changes; transports no route uses anymore are dropped.
+func (p *Proxy) transportFor(route *Route) (http.RoundTripper, error) {
+	if gen := p.routeTable.generation.Load(); gen != p.tlsGeneration.Load() {
+		p.pruneTransports(gen)
+	}
+	if route.UpstreamTLS == nil {
+		return p.transport, nil
+	}
+
+	p.tlsMu.Lock()
+	defer p.tlsMu.Unlock()
+	now := time.Now()
+	cached := p.tlsTransports[*route.UpstreamTLS]
+	if cached != nil && now.Sub(cached.checked) < upstreamTLSRecheck {
+		return cached, nil
+	}
+	modTimes := route.UpstreamTLS.modTimes()
+	if cached != nil && modTimes == cached.modTimes {
+		cached.checked = now
+		return cached, nil
+	}
+
+	// Failures aren't cached, so fixing the files takes effect right away.
+	// A transport that worked is kept until the new files load.
+	cfg, err := route.UpstreamTLS.config()
+	if err != nil {
+		if cached != nil {
+			log.Printf("Upstream TLS for %s: %v (keeping the previous certificates)", route.Pattern, err)
+			cached.checked = now
+			return cached, nil
+		}
+		return nil, err
+	}
+	t := &tlsTransport{Transport: newTransport(p.metrics), modTimes: modTimes, checked: now}
+	t.TLSClientConfig = cfg
+	if cached != nil {
+		cached.CloseIdleConnections()
+	}
+	if p.tlsTransports == nil {
+		p.tlsTransports = make(map[UpstreamTLS]*tlsTransport)
+	}
+	p.tlsTransports[*route.UpstreamTLS] = t
+	return t, nil
+}
+
+// pruneTransports drops the cached transports that no route of the route
+// table generation gen uses
+func (p *Proxy) pruneTransports(gen uint64) {
+	used := make(map[UpstreamTLS]bool)
+	for _, route := range p.routeTable.routes() {
+		if route.UpstreamTLS != nil {
+			used[*route.UpstreamTLS] = true
+		}
+	}
+
+	p.tlsMu.Lock()
+	defer p.tlsMu.Unlock()
+	for key, t := range p.tlsTransports {
+		if !used[key] {
+			t.CloseIdleConnections()
+			delete(p.tlsTransports, key)
+		}
+	}
+	p.tlsGeneration.Store(gen)
+}
@@ -0,0 +1,160 @@
+package lb
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate and key, written out as PEM files on demand
+type testCert struct {
+	tls.Certificate
+	leaf *x509.Certificate
+}
+
+// newTestCert issues a certificate for names, signed by parent (self-signed if nil)
+func newTestCert(t *testing.T, cn string, names []string, parent *testCert) *testCert {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn, Organization: []string{"Example Partner"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:              names,
+	}
+	signer, signerKey := tmpl, any(key)
+	if parent != nil {
+		signer, signerKey = parent.leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return &testCert{Certificate: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, leaf: leaf}
+}
+
+// pool returns a cert pool trusting c
+func (c *testCert) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(c.leaf)
+	return pool
+}
+
+// writeFiles writes c as PEM files into dir and returns their paths
+func (c *testCert) writeFiles(t *testing.T, dir, name string) (certFile, keyFile string) {
+	t.Helper()
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	keyDER, _ := x509.MarshalPKCS8PrivateKey(c.PrivateKey)
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Certificate.Certificate[0]}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+func TestProxyUpstreamTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "Test CA", nil, nil)
+	caFile, _ := ca.writeFiles(t, dir, "ca")
+	serverCert := newTestCert(t, "api.internal", []string{"api.internal"}, ca)
+	clientCert := newTestCert(t, "hoplb", []string{"hoplb"}, ca)
+	clientCertFile, clientKeyFile := clientCert.writeFiles(t, dir, "client")
+
+	// Backend requires HTTPS with a client certificate from our CA
+	var sawClient string
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sawClient = r.TLS.PeerCertificates[0].Subject.CommonName
+	}))
+	backend.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert.Certificate},
+		ClientCAs:    ca.pool(),
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	backend.StartTLS()
+	defer backend.Close()
+
+	proxy, _, _ := newTestProxy(t, "api.example.com", nil)
+	serve := func(upstream *UpstreamTLS) int {
+		proxy.routeTable.Update(map[string]*Route{"api.example.com": {
+			Pattern:     "api.example.com",
+			Backends:    []*Backend{{Address: backend.Listener.Addr().String(), Healthy: true}},
+			UpstreamTLS: upstream,
+		}})
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, httptest.NewRequest("GET", "http://api.example.com/", nil))
+		return w.Code
+	}
+
+	full := &UpstreamTLS{CAFile: caFile, ServerName: "api.internal", CertFile: clientCertFile, KeyFile: clientKeyFile}
+	if code := serve(full); code != http.StatusOK {
+		t.Fatalf("mTLS upstream = %d; want 200", code)
+	}
+	if sawClient != "hoplb" {
+		t.Errorf("backend saw client cert %q; want hoplb", sawClient)
+	}
+
+	tests := []struct {
+		name     string
+		upstream *UpstreamTLS
+	}{
+		{"no client certificate", &UpstreamTLS{CAFile: caFile, ServerName: "api.internal"}},
+		{"untrusted server", &UpstreamTLS{ServerName: "api.internal", CertFile: clientCertFile, KeyFile: clientKeyFile}},
+		{"wrong server name", &UpstreamTLS{CAFile: caFile, ServerName: "db.internal", CertFile: clientCertFile, KeyFile: clientKeyFile}},
+		{"missing CA file", &UpstreamTLS{CAFile: filepath.Join(dir, "nope.pem")}},
+		{"cert without key", &UpstreamTLS{CAFile: caFile, CertFile: clientCertFile}},
+	}
+	for _, tt := range tests {
+		if code := serve(tt.upstream); code != http.StatusBadGateway {
+			t.Errorf("%s = %d; want 502", tt.name, code)
+		}
+	}
+
+	// Same settings share one transport
+	t1, _ := proxy.transportFor(&Route{UpstreamTLS: full})
+	copied := *full
+	t2, _ := proxy.transportFor(&Route{UpstreamTLS: &copied})
+	if t1 != t2 {
+		t.Error("identical upstream TLS settings got separate transports")
+	}
+
+	// A rotated client certificate is picked up once the files are rechecked
+	if code := serve(full); code != http.StatusOK {
+		t.Fatalf("mTLS upstream = %d; want 200", code)
+	}
+	rotated := newTestCert(t, "hoplb-rotated", []string{"hoplb"}, ca)
+	rotated.writeFiles(t, dir, "client")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(clientCertFile, future, future)
+	os.Chtimes(clientKeyFile, future, future)
+	proxy.tlsMu.Lock()
+	proxy.tlsTransports[*full].checked = time.Time{}
+	proxy.tlsMu.Unlock()
+	if code := serve(full); code != http.StatusOK || sawClient != "hoplb-rotated" {
+		t.Errorf("after rotation = %d with client cert %q; want 200 with hoplb-rotated", code, sawClient)
+	}
+
+	// Transports of settings no route uses anymore are dropped
+	serve(nil)
+	proxy.tlsMu.Lock()
+	cached := len(proxy.tlsTransports)
+	proxy.tlsMu.Unlock()
+	if cached != 0 {
+		t.Errorf("%d transports cached after the TLS route went away; want 0", cached)
+	}
+}
@@ -7,11 +7,15 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"hoplib"
+
+	"hoplb/internal/metrics"
 )
 
 // Watcher watches local hop agent for task changes
@@ -19,22 +23,35 @@ type Watcher struct {
 	agentAddr  string
 	routeTable *RouteTable
 	client     *hoplib.Client
+	metrics    *metrics.Metrics
 	interval   time.Duration
 	tagFilter  string // e.g., "lb:haas" means only jobs with tag lb=haas
 
+	// FallbackJob, if set, serves hosts no route matches, as if it were
+	// tagged hoplb-urlprefix="*". Set before Run.
+	FallbackJob string
+
 	// Cached state for incremental updates
 	agentHosts map[string]string                        // agentID → hostname
 	jobs       map[string]*hoplib.Job                  // jobName → job
 	relevant   map[string]struct{}                      // job names that contribute routes
 	tasks      map[string]map[string][]*hoplib.Task    // jobName → agentID → tasks
+
+	// Registration order for resolving hosts claimed by several jobs
+	firstSeen map[string]uint64 // jobName → sequence number
+	nextSeq   uint64
+
+	mu        sync.Mutex
+	conflicts []Conflict // from the last build, sorted by pattern
 }
 
 // NewWatcher creates a new watcher
-func NewWatcher(agentAddr string, routeTable *RouteTable, tagFilter string, apiKey string) *Watcher {
+func NewWatcher(agentAddr string, routeTable *RouteTable, tagFilter string, apiKey string, m *metrics.Metrics) *Watcher {
 	return &Watcher{
 		agentAddr:  agentAddr,
 		routeTable: routeTable,
 		client:     hoplib.NewClient(apiKey),
+		metrics:    m,
 		interval:   5 * time.Second,
 		tagFilter:  tagFilter,
 	}
@@ -48,10 +65,16 @@ func (w *Watcher) Run(ctx context.Context) {
 			return
 		}
 		err := w.watchSSE(ctx)
+		if w.metrics != nil {
+			w.metrics.SetSSEConnected(false)
+		}
 		if ctx.Err() != nil {
 			return
 		}
 		log.Printf("SSE disconnected: %v, reconnecting in %v", err, w.interval)
+		if w.metrics != nil {
+			w.metrics.IncSSEReconnects()
+		}
 		select {
 		case <-time.After(w.interval):
 		case <-ctx.Done():
@@ -82,6 +105,9 @@ func (w *Watcher) watchSSE(ctx context.Context) error {
 	}
 
 	log.Printf("SSE connected to %s/v1/events, seeding routes", w.agentAddr)
+	if w.metrics != nil {
+		w.metrics.SetSSEConnected(true)
+	}
 	w.sync() // seed routes — SSE stream already open, events buffered
 
 	lineCh := make(chan string)
@@ -144,15 +170,19 @@ func (w *Watcher) watchSSE(ctx context.Context) error {
 
 // sync does a full fetch of agents, jobs, and per-job task status for relevant jobs.
 func (w *Watcher) sync() {
+	start := time.Now()
+
 	agents, err := hoplib.Fetch[[]hoplib.Agent](w.client, w.agentAddr+"/v1/agents")
 	if err != nil {
 		log.Printf("Failed to fetch agents: %v", err)
+		w.recordFetchError("/v1/agents")
 		return
 	}
 
 	jobs, err := hoplib.Fetch[[]hoplib.Job](w.client, w.agentAddr+"/v1/jobs")
 	if err != nil {
 		log.Printf("Failed to fetch jobs: %v", err)
+		w.recordFetchError("/v1/jobs")
 		return
 	}
 
@@ -169,30 +199,63 @@ func (w *Watcher) sync() {
 	w.relevant = make(map[string]struct{})
 	for i := range jobs {
 		w.jobs[jobs[i].Name] = &jobs[i]
-		if w.jobMatchesFilter(&jobs[i]) && jobs[i].Tags["hoplb-urlprefix"] != "" {
+		w.register(jobs[i].Name)
+		if w.jobMatchesFilter(&jobs[i]) && len(w.jobPatterns(&jobs[i])) > 0 {
 			w.relevant[jobs[i].Name] = struct{}{}
 		}
 	}
+	// Mirror jobs need their tasks even without hosts of their own
+	for name := range w.relevant {
+		if target := strings.TrimSpace(w.jobs[name].Tags[TagMirror]); w.jobs[target] != nil {
+			w.relevant[target] = struct{}{}
+		}
+	}
+
+	for name := range w.firstSeen {
+		if _, ok := w.jobs[name]; !ok {
+			delete(w.firstSeen, name) // re-registering later counts as new
+		}
+	}
 
 	// Fetch tasks only for relevant jobs
 	w.tasks = make(map[string]map[string][]*hoplib.Task)
 	for jobName := range w.relevant {
-		w.syncJob(jobName)
+		if !w.fetchJob(jobName) {
+			w.sync()
+			return
+		}
 	}
 
 	w.buildRoutes()
+	if w.metrics != nil {
+		w.metrics.RecordSync(metrics.SyncFull, time.Since(start))
+	}
 }
 
 // syncJob fetches only the tasks for a single job and rebuilds routes from cache.
 func (w *Watcher) syncJob(jobName string) {
+	start := time.Now()
+	if !w.fetchJob(jobName) {
+		w.sync()
+		return
+	}
+	w.buildRoutes()
+	if w.metrics != nil {
+		w.metrics.RecordSync(metrics.SyncJob, time.Since(start))
+	}
+}
+
+// fetchJob replaces the cached tasks of a single job. It reports false
+// if the job status couldn't be fetched.
+func (w *Watcher) fetchJob(jobName string) bool {
 	status, err := hoplib.Fetch[struct {
 		Agents       []hoplib.Agent            `json:"agents"`
 		TasksByAgent map[string][]*hoplib.Task  `json:"tasks_by_agent"`
 	}](w.client, fmt.Sprintf("%s/v1/jobs/%s/status", w.agentAddr, jobName))
 	if err != nil {
 		log.Printf("Failed to fetch job status for %s: %v", jobName, err)
-		w.sync()
-		return
+		w.recordFetchError("/v1/jobs/{job}/status")
+		return false
 	}
 
 	// Update agent hosts from response
@@ -204,12 +267,42 @@ func (w *Watcher) syncJob(jobName string) {
 
 	// Replace cached tasks for this job
 	w.tasks[jobName] = status.TasksByAgent
-	w.buildRoutes()
+	return true
+}
+
+// register records the order in which jobs are first seen. Jobs seen in
+// the same sync keep the agent's listing order.
+func (w *Watcher) register(jobName string) {
+	if w.firstSeen == nil {
+		w.firstSeen = make(map[string]uint64)
+	}
+	if _, ok := w.firstSeen[jobName]; !ok {
+		w.nextSeq++
+		w.firstSeen[jobName] = w.nextSeq
+	}
+}
+
+// Conflicts returns the hosts claimed by several jobs in the last route
+// build where some jobs were left out
+func (w *Watcher) Conflicts() []Conflict {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]Conflict(nil), w.conflicts...)
+}
+
+// recordFetchError counts a failed fetch; endpoint is a path template
+func (w *Watcher) recordFetchError(endpoint string) {
+	if w.metrics != nil {
+		w.metrics.RecordFetchError(endpoint)
+	}
 }
 
 // buildRoutes rebuilds the route table from cached state.
 func (w *Watcher) buildRoutes() {
 	routes := make(map[string]*Route, len(w.relevant))
+	claims := make(map[string][]jobBackends)
+	backendsByJob := make(map[string][]*Backend, len(w.relevant))
+	skippedNoHost, skippedNoPort := 0, 0
 
 	for jobName := range w.relevant {
 		job := w.jobs[jobName]
@@ -217,15 +310,18 @@ func (w *Watcher) buildRoutes() {
 			continue
 		}
 
-		pattern := job.Tags["hoplb-urlprefix"]
-		if pattern == "" {
-			continue
-		}
+		patterns := w.jobPatterns(job)
 
+		jb := jobBackends{job: job, seq: w.firstSeen[jobName]}
 		portName := job.Tags["hoplb-port"]
 		for agentID, tasks := range w.tasks[jobName] {
 			host := w.agentHosts[agentID]
 			if host == "" {
+				for _, task := range tasks {
+					if task.State == "running" {
+						skippedNoHost++
+					}
+				}
 				continue
 			}
 
@@ -236,36 +332,50 @@ func (w *Watcher) buildRoutes() {
 
 				port := taskPort(task, portName)
 				if port == 0 {
+					skippedNoPort++
 					continue
 				}
 
-				backend := &Backend{
+				jb.backends = append(jb.backends, &Backend{
 					Address: host + ":" + strconv.Itoa(port),
+					Job:     jobName,
 					Healthy: true,
-				}
-
-				if route, ok := routes[pattern]; ok {
-					route.Backends = append(route.Backends, backend)
-				} else {
-					routes[pattern] = &Route{
-						Pattern:  pattern,
-						Backends: []*Backend{backend},
-					}
-				}
+				})
 			}
 		}
+		backendsByJob[jobName] = jb.backends
+
+		// Every host of the job maps to the same backends
+		for _, pattern := range patterns {
+			claims[pattern] = append(claims[pattern], jb)
+		}
 	}
 
+	var conflicts []Conflict
+	for pattern, jobs := range claims {
+		route, conflict := newRoute(pattern, jobs)
+		if conflict != nil {
+			conflicts = append(conflicts, *conflict)
+		}
+		if route.Mirror != nil {
+			route.Mirror.Backends = backendsByJob[route.Mirror.Job]
+		}
+		if route.backendCount() > 0 {
+			routes[pattern] = route
+		}
+	}
+	w.setConflicts(conflicts)
+
 	// Debug: log what we're building
 	for jobName := range w.relevant {
 		job := w.jobs[jobName]
 		if job == nil {
 			continue
 		}
-		pattern := job.Tags["hoplb-urlprefix"]
+		patterns := w.jobPatterns(job)
 		portName := job.Tags["hoplb-port"]
 		tasksByAgent := w.tasks[jobName]
-		log.Printf("[debug] job=%s pattern=%q portName=%q agents=%d", jobName, pattern, portName, len(tasksByAgent))
+		log.Printf("[debug] job=%s patterns=%q portName=%q agents=%d", jobName, patterns, portName, len(tasksByAgent))
 		for agentID, tasks := range tasksByAgent {
 			host := w.agentHosts[agentID]
 			log.Printf("[debug]   agent=%s host=%q tasks=%d", agentID, host, len(tasks))
@@ -277,8 +387,140 @@ func (w *Watcher) buildRoutes() {
 	}
 
 	w.routeTable.Update(routes)
+	if w.metrics != nil {
+		backends := make(map[string]int, len(routes))
+		for pattern, route := range routes {
+			backends[pattern] = route.backendCount()
+		}
+		w.metrics.SetRoutes(backends)
+		w.metrics.SetSkippedTasks(skippedNoHost, skippedNoPort)
+		ignored := make(map[string]int, len(conflicts))
+		for _, c := range conflicts {
+			ignored[c.Pattern] = len(c.Ignored)
+		}
+		w.metrics.SetRouteConflicts(ignored)
+	}
 	log.Printf("Updated routes: %d patterns, %d total backends",
-		len(routes), func() int { n := 0; for _, r := range routes { n += len(r.Backends) }; return n }())
+		len(routes), func() int { n := 0; for _, r := range routes { n += r.backendCount() }; return n }())
+}
+
+// setConflicts stores the conflicts of a build, logging them when they change
+func (w *Watcher) setConflicts(conflicts []Conflict) {
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].Pattern < conflicts[j].Pattern })
+
+	w.mu.Lock()
+	previous := make(map[string]string, len(w.conflicts))
+	for i := range w.conflicts {
+		previous[w.conflicts[i].Pattern] = w.conflicts[i].String()
+	}
+	w.conflicts = conflicts
+	w.mu.Unlock()
+
+	for i := range conflicts {
+		desc := conflicts[i].String()
+		if previous[conflicts[i].Pattern] != desc {
+			log.Printf("Route conflict on %s", desc)
+		}
+		delete(previous, conflicts[i].Pattern)
+	}
+	for pattern := range previous {
+		log.Printf("Route conflict on %s resolved", pattern)
+	}
+}
+
+// jobPatterns returns the host patterns of job, adding the catch-all
+// for the fallback job
+func (w *Watcher) jobPatterns(job *hoplib.Job) []string {
+	patterns := JobPatterns(job)
+	if w.FallbackJob == "" || job.Name != w.FallbackJob {
+		return patterns
+	}
+	for _, p := range patterns {
+		if p == "*" {
+			return patterns
+		}
+	}
+	return append(patterns, "*")
+}
+
+// jobBackends are the running backends of one job
+type jobBackends struct {
+	job      *hoplib.Job
+	seq      uint64 // registration order, see Watcher.register
+	backends []*Backend
+}
+
+// newRoute builds the route for pattern from the jobs claiming it. Jobs
+// tagged hoplb-match become rules, jobs tagged hoplb-pin-only only serve
+// pinned requests, and the others compete for the host, see
+// resolveClaims. Host-level policy tags are read from the winning job,
+// or from the first rule job by name if there is none.
+func newRoute(pattern string, jobs []jobBackends) (*Route, *Conflict) {
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].job.Name < jobs[j].job.Name })
+
+	route := &Route{Pattern: pattern}
+	owner := jobs[0].job
+	var defaults, ruleJobs, pinOnlyJobs []jobBackends
+	for _, jb := range jobs {
+		if pinOnly(jb) {
+			pinOnlyJobs = append(pinOnlyJobs, jb)
+			continue
+		}
+		expr := jb.job.Tags[TagMatch]
+		if expr == "" {
+			defaults = append(defaults, jb)
+			continue
+		}
+
+		// A broken rule must not turn its job into a default for all traffic
+		matchers, err := ParseMatch(expr)
+		if err != nil {
+			log.Printf("Ignoring job %s: %s: %v", jb.job.Name, TagMatch, err)
+			continue
+		}
+		priority := 0
+		if v := jb.job.Tags[TagMatchPriority]; v != "" {
+			if priority, err = strconv.Atoi(v); err != nil {
+				log.Printf("Ignoring tag: job %s: %s: invalid priority %q", jb.job.Name, TagMatchPriority, v)
+			}
+		}
+		ruleJobs = append(ruleJobs, jb)
+		route.Rules = append(route.Rules, &Rule{
+			Job:      jb.job.Name,
+			Priority: priority,
+			Expr:     expr,
+			Matchers: matchers,
+			Backends: jb.backends,
+		})
+	}
+	sort.SliceStable(route.Rules, func(i, j int) bool { return route.Rules[i].Priority > route.Rules[j].Priority })
+
+	served, conflict := resolveClaims(pattern, defaults)
+	for _, jb := range served {
+		route.Backends = append(route.Backends, jb.backends...)
+	}
+	if len(served) > 0 {
+		owner = served[0].job
+	} else if len(ruleJobs) > 0 {
+		owner = ruleJobs[0].job
+	}
+	pinnable := append(append(served, ruleJobs...), pinOnlyJobs...)
+	route.Pins = newPins(pattern, pinnable)
+
+	for _, err := range applyJobTags(route, owner) {
+		log.Printf("Ignoring tag: %v", err)
+	}
+	for _, jobs := range [][]jobBackends{ruleJobs, pinOnlyJobs} {
+		for _, jb := range jobs {
+			if jb.job == owner {
+				continue
+			}
+			for _, tag := range policyTags(jb.job) {
+				log.Printf("Ignoring tag: job %s: %s: %s takes its policy from job %s", jb.job.Name, tag, pattern, owner.Name)
+			}
+		}
+	}
+	return route, conflict
 }
 
 // taskPort returns the named port (from job's "port" tag) or first available.
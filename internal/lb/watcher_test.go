@@ -0,0 +1,299 @@
+package lb
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"hoplib"
+
+	"hoplb/internal/metrics"
+)
+
+// newTestWatcher returns a watcher with cached state and no agent connection
+func newTestWatcher(t *testing.T, m *metrics.Metrics) *Watcher {
+	t.Helper()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	return &Watcher{
+		routeTable: NewRouteTable(),
+		metrics:    m,
+		agentHosts: make(map[string]string),
+		jobs:       make(map[string]*hoplib.Job),
+		relevant:   make(map[string]struct{}),
+		tasks:      make(map[string]map[string][]*hoplib.Task),
+	}
+}
+
+// addJob registers a relevant job with tags and tasks per agent
+func (w *Watcher) addJob(name string, tags map[string]string, tasks map[string][]*hoplib.Task) {
+	w.jobs[name] = &hoplib.Job{ID: name, Name: name, Tags: tags}
+	w.register(name)
+	w.relevant[name] = struct{}{}
+	w.tasks[name] = tasks
+}
+
+func TestBuildRoutesMetrics(t *testing.T) {
+	m := metrics.New()
+	w := newTestWatcher(t, m)
+	w.agentHosts["agent-1"] = "10.0.0.1"
+
+	w.addJob("api", map[string]string{"hoplb-urlprefix": "api.example.com"}, map[string][]*hoplib.Task{
+		"agent-1": {
+			{ID: "task-0001", State: "running", Ports: map[string]int{"http": 8080}},
+			{ID: "task-0002", State: "running", Ports: map[string]int{}}, // no port
+			{ID: "task-0003", State: "stopped", Ports: map[string]int{}}, // not running, not counted
+		},
+		"agent-2": {
+			{ID: "task-0004", State: "running", Ports: map[string]int{"http": 8080}}, // unknown agent host
+		},
+	})
+
+	w.buildRoutes()
+
+	s := m.Watcher()
+	if s.Routes["api.example.com"] != 1 {
+		t.Errorf("backends for api.example.com = %d; want 1", s.Routes["api.example.com"])
+	}
+	if s.Skipped[metrics.SkipNoPort] != 1 {
+		t.Errorf("skipped no_port = %d; want 1", s.Skipped[metrics.SkipNoPort])
+	}
+	if s.Skipped[metrics.SkipNoHost] != 1 {
+		t.Errorf("skipped no_host = %d; want 1", s.Skipped[metrics.SkipNoHost])
+	}
+}
+
+func TestBuildRoutesAppliesTags(t *testing.T) {
+	w := newTestWatcher(t, nil)
+	w.agentHosts["agent-1"] = "10.0.0.1"
+	running := map[string][]*hoplib.Task{
+		"agent-1": {{ID: "task-0001", State: "running", Ports: map[string]int{"http": 8080}}},
+	}
+
+	w.addJob("api", map[string]string{
+		TagURLPrefix: "api.example.com",
+		TagRateLimit: "10/s burst=20",
+	}, running)
+	w.addJob("web", map[string]string{
+		TagURLPrefix: "web.example.com",
+		TagRateLimit: "lots", // invalid: route still served, tag ignored
+	}, running)
+	w.addJob("dash", map[string]string{
+		TagURLPrefix:   "dash.example.com",
+		TagBasicAuth:   "/etc/hoplb/dash.htpasswd",
+		TagJWTJWKS:     "https://sso.example.com/jwks.json",
+		TagJWTAudience: "dash",
+		TagJWTClaims:   "sub", // invalid: JWT route denies everything
+	}, running)
+
+	w.buildRoutes()
+
+	api := w.routeTable.Match("api.example.com")
+	if api == nil || len(api.RateLimits) != 1 || api.RateLimits[0].Burst != 20 {
+		t.Errorf("api route rate limits = %+v; want 10/s burst=20", api)
+	}
+	web := w.routeTable.Match("web.example.com")
+	if web == nil || len(web.Backends) != 1 || len(web.RateLimits) != 0 {
+		t.Errorf("web route = %+v; want served without rate limits", web)
+	}
+	dash := w.routeTable.Match("dash.example.com")
+	if dash == nil || dash.BasicAuth == nil || dash.BasicAuth.File != "/etc/hoplb/dash.htpasswd" {
+		t.Errorf("dash route basic auth = %+v; want htpasswd file", dash)
+	}
+	if dash == nil || dash.JWT == nil || dash.JWT.Audience != "dash" || !dash.JWT.invalid {
+		t.Errorf("dash route JWT = %+v; want audience dash, failing closed", dash)
+	}
+}
+
+func TestJobPatterns(t *testing.T) {
+	tests := []struct {
+		tags map[string]string
+		want []string
+	}{
+		{map[string]string{TagURLPrefix: "example.com"}, []string{"example.com"}},
+		{map[string]string{TagURLPrefix: "example.com, www.example.com,"}, []string{"example.com", "www.example.com"}},
+		{map[string]string{
+			TagURLPrefix + ".10": "ten.example.com",
+			TagURLPrefix + ".2":  "two.example.com, example.com",
+			TagURLPrefix:         "example.com",
+		}, []string{"example.com", "two.example.com", "ten.example.com"}},
+		{map[string]string{TagURLPrefix: `~t-[0-9]{2,4}\.example\.com`}, []string{`~t-[0-9]{2,4}\.example\.com`}},
+		{map[string]string{TagURLPrefix + ".1": "a.example.com"}, []string{"a.example.com"}},
+		{map[string]string{TagPort: "http"}, nil},
+	}
+	for _, tt := range tests {
+		got := JobPatterns(&hoplib.Job{Tags: tt.tags})
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("JobPatterns(%v) = %q; want %q", tt.tags, got, tt.want)
+		}
+	}
+}
+
+func TestBuildRoutesMultipleHosts(t *testing.T) {
+	w := newTestWatcher(t, nil)
+	w.agentHosts["agent-1"] = "10.0.0.1"
+	w.agentHosts["agent-2"] = "10.0.0.2"
+
+	w.addJob("site", map[string]string{
+		TagURLPrefix:        "example.com, www.example.com",
+		TagURLPrefix + ".1": "example.org",
+		TagMaxInFlight:      "50",
+		TagRouteMerge:       "true",
+	}, map[string][]*hoplib.Task{
+		"agent-1": {{ID: "task-0001", State: "running", Ports: map[string]int{"http": 8080}}},
+	})
+	w.addJob("landing", map[string]string{
+		TagURLPrefix:  "example.org",
+		TagRouteMerge: "true",
+	}, map[string][]*hoplib.Task{
+		"agent-2": {{ID: "task-0002", State: "running", Ports: map[string]int{"http": 9090}}},
+	})
+
+	w.buildRoutes()
+
+	for _, host := range []string{"example.com", "www.example.com"} {
+		route := w.routeTable.Match(host)
+		if route == nil || len(route.Backends) != 1 || route.Backends[0].Address != "10.0.0.1:8080" || route.MaxInFlight != 50 {
+			t.Errorf("%s route = %+v; want site's backend and policy", host, route)
+		}
+	}
+	// Two merge jobs claiming one host: both serve it
+	if route := w.routeTable.Match("example.org"); route == nil || len(route.Backends) != 2 {
+		t.Errorf("example.org route = %+v; want backends of both jobs", route)
+	}
+}
+
+func TestBuildRoutesConflicts(t *testing.T) {
+	m := metrics.New()
+	w := newTestWatcher(t, m)
+	w.agentHosts["agent-1"] = "10.0.0.1"
+	task := func(port int) map[string][]*hoplib.Task {
+		return map[string][]*hoplib.Task{
+			"agent-1": {{ID: "task-0001", State: "running", Ports: map[string]int{"http": port}}},
+		}
+	}
+
+	// First registered wins, whatever the names
+	w.addJob("zz-old", map[string]string{TagURLPrefix: "first.example.com", TagMaxInFlight: "7"}, task(8001))
+	w.addJob("aa-new", map[string]string{TagURLPrefix: "first.example.com", TagMaxInFlight: "9"}, task(8002))
+	// Explicit priority beats registration order
+	w.addJob("prio-low", map[string]string{TagURLPrefix: "prio.example.com"}, task(8003))
+	w.addJob("prio-high", map[string]string{TagURLPrefix: "prio.example.com", TagRoutePriority: "10"}, task(8004))
+	// Merging needs both sides to opt in
+	w.addJob("merge-a", map[string]string{TagURLPrefix: "merge.example.com", TagRouteMerge: "true"}, task(8005))
+	w.addJob("merge-b", map[string]string{TagURLPrefix: "merge.example.com", TagRouteMerge: "true"}, task(8006))
+	w.addJob("merge-c", map[string]string{TagURLPrefix: "merge.example.com"}, task(8007))
+	// Rule jobs share a host by design
+	w.addJob("rule", map[string]string{TagURLPrefix: "first.example.com", TagMatch: "method=POST"}, task(8008))
+
+	w.buildRoutes()
+
+	backends := func(host string) string {
+		route := w.routeTable.Match(host)
+		if route == nil {
+			return ""
+		}
+		var addrs []string
+		for _, b := range route.Backends {
+			addrs = append(addrs, b.Address)
+		}
+		return strings.Join(addrs, " ")
+	}
+	if got := backends("first.example.com"); got != "10.0.0.1:8001" {
+		t.Errorf("first.example.com backends = %q; want zz-old's only", got)
+	}
+	if route := w.routeTable.Match("first.example.com"); route.MaxInFlight != 7 || len(route.Rules) != 1 {
+		t.Errorf("first.example.com MaxInFlight = %d, rules = %d; want the winner's 7 and 1 rule", route.MaxInFlight, len(route.Rules))
+	}
+	if got := backends("prio.example.com"); got != "10.0.0.1:8004" {
+		t.Errorf("prio.example.com backends = %q; want prio-high's only", got)
+	}
+	if got := backends("merge.example.com"); got != "10.0.0.1:8005 10.0.0.1:8006" {
+		t.Errorf("merge.example.com backends = %q; want merge-a and merge-b", got)
+	}
+
+	want := []Conflict{
+		{Pattern: "first.example.com", Owner: "zz-old", Ignored: []string{"aa-new"}, Reason: ConflictFirstRegistered},
+		{Pattern: "merge.example.com", Owner: "merge-a", Merged: []string{"merge-b"}, Ignored: []string{"merge-c"}, Reason: ConflictFirstRegistered},
+		{Pattern: "prio.example.com", Owner: "prio-high", Ignored: []string{"prio-low"}, Reason: ConflictPriority},
+	}
+	got := w.Conflicts()
+	if len(got) != len(want) {
+		t.Fatalf("conflicts = %+v; want %+v", got, want)
+	}
+	for i := range want {
+		if got[i].String() != want[i].String() {
+			t.Errorf("conflict %d = %s; want %s", i, got[i].String(), want[i].String())
+		}
+	}
+	if n := m.Watcher().Conflicts["merge.example.com"]; n != 1 {
+		t.Errorf("conflicts metric for merge.example.com = %d; want 1", n)
+	}
+
+	// Removing the loser resolves the conflict
+	delete(w.relevant, "aa-new")
+	w.buildRoutes()
+	if len(w.Conflicts()) != 2 {
+		t.Errorf("conflicts after removing aa-new = %+v; want 2", w.Conflicts())
+	}
+	if _, ok := m.Watcher().Conflicts["first.example.com"]; ok {
+		t.Error("conflicts metric still reports first.example.com")
+	}
+}
+
+func TestBuildRoutesFallbackJob(t *testing.T) {
+	w := newTestWatcher(t, nil)
+	w.FallbackJob = "not-found"
+	w.agentHosts["agent-1"] = "10.0.0.1"
+
+	w.addJob("api", map[string]string{TagURLPrefix: "api.example.com"}, map[string][]*hoplib.Task{
+		"agent-1": {{ID: "task-0001", State: "running", Ports: map[string]int{"http": 8080}}},
+	})
+	w.addJob("not-found", nil, map[string][]*hoplib.Task{
+		"agent-1": {{ID: "task-0002", State: "running", Ports: map[string]int{"http": 9000}}},
+	})
+
+	w.buildRoutes()
+
+	if route := w.routeTable.Match("api.example.com"); route == nil || route.Pattern != "api.example.com" {
+		t.Errorf("api.example.com route = %+v; want its own", route)
+	}
+	route := w.routeTable.Match("unknown.example.org")
+	if route == nil || route.Pattern != "*" || route.Backends[0].Address != "10.0.0.1:9000" {
+		t.Errorf("unknown host route = %+v; want the fallback job", route)
+	}
+}
+
+func TestSyncMetrics(t *testing.T) {
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/agents":
+			fmt.Fprint(w, `[{"id":"agent-1","endpoint":"http://10.0.0.1:4646"}]`)
+		case "/v1/jobs":
+			fmt.Fprint(w, `[{"id":"api","name":"api","tags":{"hoplb-urlprefix":"api.example.com"}},
+				{"id":"web","name":"web","tags":{"hoplb-urlprefix":"www.example.com"}}]`)
+		default:
+			fmt.Fprint(w, `{"agents":[],"tasks_by_agent":{"agent-1":[{"id":"task-0001","state":"running","ports":{"http":8080}}]}}`)
+		}
+	}))
+	defer agent.Close()
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	m := metrics.New()
+	w := NewWatcher(agent.URL, NewRouteTable(), "", "", m)
+	w.sync()
+	if s := m.Watcher(); s.SyncCount[metrics.SyncFull] != 1 || s.SyncCount[metrics.SyncJob] != 0 {
+		t.Errorf("after full sync: syncs = %v; want 1 full, 0 job", s.SyncCount)
+	}
+	w.syncJob("api")
+	if s := m.Watcher(); s.SyncCount[metrics.SyncFull] != 1 || s.SyncCount[metrics.SyncJob] != 1 {
+		t.Errorf("after job sync: syncs = %v; want 1 full, 1 job", s.SyncCount)
+	}
+}
@@ -3,7 +3,10 @@ package metrics
 import (
 	"fmt"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 // Exporter exposes metrics in Prometheus format
@@ -16,57 +19,417 @@ func NewExporter(m *Metrics) *Exporter {
 	return &Exporter{metrics: m}
 }
 
-// ServeHTTP handles /metrics requests
-func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+// quantiles reported for every summary
+var quantiles = []float64{0.5, 0.9, 0.95, 0.99}
+
+// label is a single name="value" pair
+type label struct {
+	name, value string
+}
+
+// sample is one exposed line of a family. suffix is appended to the family
+// name (e.g. "_count").
+type sample struct {
+	suffix   string
+	labels   []label
+	value    float64
+	exemplar *Exemplar // OpenMetrics only
+}
+
+// family is a metric family: one HELP/TYPE header and its samples
+type family struct {
+	name    string
+	typ     string // counter, gauge, summary, histogram
+	help    string
+	samples []sample
+}
 
+// ServeHTTP handles /metrics requests. Scrapers that accept OpenMetrics
+// get it, with exemplars; everyone else gets the Prometheus text format.
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var b strings.Builder
+	if acceptsOpenMetrics(r.Header.Get("Accept")) {
+		w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+		writeOpenMetrics(&b, gather(e.metrics))
+	} else {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeText(&b, gather(e.metrics))
+	}
+	w.Write([]byte(b.String()))
+}
+
+// acceptsOpenMetrics reports whether an Accept header lists OpenMetrics
+// with a non-zero quality
+func acceptsOpenMetrics(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		if strings.TrimSpace(params[0]) != "application/openmetrics-text" {
+			continue
+		}
+		for _, p := range params[1:] {
+			if q, ok := strings.CutPrefix(strings.TrimSpace(p), "q="); ok {
+				if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gather snapshots all metrics into families, in exposition order
+func gather(m *Metrics) []family {
+	domains := m.AllDomains()
 
 	// Request counters per domain/backend/status
-	b.WriteString("# HELP hoplb_requests_total Total HTTP requests\n")
-	b.WriteString("# TYPE hoplb_requests_total counter\n")
-
-	counts := e.metrics.RequestCounts()
-	for _, domain := range e.metrics.AllDomains() {
-		backends := counts[domain]
-		for _, backend := range e.metrics.AllBackends(domain) {
-			codes := backends[backend]
-			for code, count := range codes {
-				fmt.Fprintf(&b, "hoplb_requests_total{domain=%q,backend=%q,code=\"%d\"} %d\n",
-					domain, backend, code, count)
+	requests := family{name: "hoplb_requests_total", typ: "counter", help: "Total HTTP requests"}
+	counts := m.RequestCounts()
+	for _, domain := range domains {
+		for _, backend := range m.AllBackends(domain) {
+			codes := counts[domain][backend]
+			for _, code := range sortedCodes(codes) {
+				requests.samples = append(requests.samples, sample{
+					labels: []label{{"domain", domain}, {"backend", backend}, {"code", strconv.Itoa(code)}},
+					value:  float64(codes[code]),
+				})
 			}
 		}
 	}
-	b.WriteString("\n")
 
 	// Request duration percentiles
-	b.WriteString("# HELP hoplb_request_duration_seconds Request duration percentiles\n")
-	b.WriteString("# TYPE hoplb_request_duration_seconds summary\n")
-
-	quantiles := []float64{0.5, 0.9, 0.95, 0.99}
-	for _, domain := range e.metrics.AllDomains() {
-		for _, backend := range e.metrics.AllBackends(domain) {
-			sampleCount := e.metrics.SampleCount(domain, backend)
+	duration := family{name: "hoplb_request_duration_seconds", typ: "summary", help: "Request duration percentiles"}
+	for _, domain := range domains {
+		for _, backend := range m.AllBackends(domain) {
+			sampleCount := m.SampleCount(domain, backend)
 			if sampleCount == 0 {
 				continue
 			}
-
 			// Calculate all percentiles from a single copy+sort
-			values := e.metrics.Percentiles(domain, backend, quantiles)
+			values := m.Percentiles(domain, backend, quantiles)
+			duration.samples = appendSummary(duration.samples, domain, backend, values, sampleCount, m.LatencySum(domain, backend))
+		}
+	}
 
-			for i, q := range quantiles {
-				fmt.Fprintf(&b, "hoplb_request_duration_seconds{domain=%q,backend=%q,quantile=\"%.2f\"} %.6f\n",
-					domain, backend, q, values[i])
+	// Request duration histogram, with exemplars for OpenMetrics
+	latency := family{name: "hoplb_request_latency_seconds", typ: "histogram", help: "Request duration histogram"}
+	for _, domain := range domains {
+		for _, backend := range m.AllBackends(domain) {
+			h, ok := m.Histogram(domain, backend)
+			if !ok {
+				continue
 			}
+			latency.samples = appendHistogram(latency.samples, domain, backend, h)
+		}
+	}
 
-			// Add _count and _sum for summary type
-			fmt.Fprintf(&b, "hoplb_request_duration_seconds_count{domain=%q,backend=%q} %d\n",
-				domain, backend, sampleCount)
+	// Upstream time-to-first-byte percentiles
+	ttfb := family{name: "hoplb_upstream_ttfb_seconds", typ: "summary", help: "Time from sending the request upstream to the first response byte"}
+	for _, domain := range domains {
+		for _, backend := range m.AllBackends(domain) {
+			n := m.TTFBCount(domain, backend)
+			if n == 0 {
+				continue
+			}
+			values := m.TTFBPercentiles(domain, backend, quantiles)
+			ttfb.samples = appendSummary(ttfb.samples, domain, backend, values, n, m.TTFBSum(domain, backend))
+		}
+	}
 
-			fmt.Fprintf(&b, "hoplb_request_duration_seconds_sum{domain=%q,backend=%q} %.6f\n",
-				domain, backend, e.metrics.LatencySum(domain, backend))
+	// Body bytes per domain/backend
+	reqBytes, respBytes := m.Bytes()
+	requestBytes := family{name: "hoplb_request_bytes_total", typ: "counter", help: "Request body bytes received from clients"}
+	responseBytes := family{name: "hoplb_response_bytes_total", typ: "counter", help: "Response body bytes sent to clients"}
+	for _, domain := range domains {
+		for _, backend := range m.AllBackends(domain) {
+			labels := []label{{"domain", domain}, {"backend", backend}}
+			requestBytes.samples = append(requestBytes.samples, sample{labels: labels, value: float64(reqBytes[domain][backend])})
+			responseBytes.samples = append(responseBytes.samples, sample{labels: labels, value: float64(respBytes[domain][backend])})
 		}
 	}
 
-	w.Write([]byte(b.String()))
+	// In-flight requests per route
+	inFlight := family{name: "hoplb_requests_in_flight", typ: "gauge", help: "Requests currently being proxied"}
+	current := m.InFlight()
+	for _, route := range sortedKeys(current) {
+		inFlight.samples = append(inFlight.samples, sample{
+			labels: []label{{"route", route}},
+			value:  float64(current[route]),
+		})
+	}
+
+	// Requests refused by hoplb (rate limits, load shedding, ...)
+	rejected := family{name: "hoplb_rejected_requests_total", typ: "counter", help: "Requests refused by hoplb before reaching a backend"}
+	rejections := m.Rejections()
+	for _, route := range sortedKeys(rejections) {
+		for _, reason := range sortedKeys(rejections[route]) {
+			rejected.samples = append(rejected.samples, sample{
+				labels: []label{{"route", route}, {"reason", reason}},
+				value:  float64(rejections[route][reason]),
+			})
+		}
+	}
+
+	// Requests copied to mirror jobs
+	mirrored := family{name: "hoplb_mirror_requests_total", typ: "counter", help: "Sampled requests copied to a mirror job, by result"}
+	mirrors := m.Mirrors()
+	for _, route := range sortedKeys(mirrors) {
+		for _, result := range sortedKeys(mirrors[route]) {
+			mirrored.samples = append(mirrored.samples, sample{
+				labels: []label{{"route", route}, {"result", result}},
+				value:  float64(mirrors[route][result]),
+			})
+		}
+	}
+
+	// Concurrency limits per route
+	concurrency := family{name: "hoplb_concurrency_limit", typ: "gauge", help: "Current max in-flight requests per route (static or adaptive)"}
+	limits := m.ConcurrencyLimits()
+	for _, route := range sortedKeys(limits) {
+		concurrency.samples = append(concurrency.samples, sample{
+			labels: []label{{"route", route}},
+			value:  float64(limits[route]),
+		})
+	}
+
+	// Client connections on the traffic listener
+	clientConns := family{name: "hoplb_client_connections_active", typ: "gauge", help: "Open client connections",
+		samples: []sample{{value: float64(m.ActiveConnections())}}}
+
+	// Backend connection pool
+	open, acquired := m.BackendConns()
+	backendOpen := family{name: "hoplb_backend_connections_open", typ: "gauge", help: "Open connections to backends"}
+	for _, backend := range sortedKeys(open) {
+		backendOpen.samples = append(backendOpen.samples, sample{
+			labels: []label{{"backend", backend}},
+			value:  float64(open[backend]),
+		})
+	}
+	backendAcquired := family{name: "hoplb_backend_connections_acquired_total", typ: "counter", help: "Backend connections handed to requests, by whether an idle connection was reused"}
+	for _, backend := range sortedKeys(acquired) {
+		for _, reused := range []bool{false, true} {
+			backendAcquired.samples = append(backendAcquired.samples, sample{
+				labels: []label{{"backend", backend}, {"reused", strconv.FormatBool(reused)}},
+				value:  float64(acquired[backend][reused]),
+			})
+		}
+	}
+
+	families := []family{
+		requests, duration, latency, ttfb, requestBytes, responseBytes,
+		inFlight, rejected, mirrored, concurrency, clientConns, backendOpen, backendAcquired,
+	}
+	return append(families, gatherWatcher(m.Watcher())...)
+}
+
+// gatherWatcher builds the control-plane families
+func gatherWatcher(s WatcherSnapshot) []family {
+	connected := 0.0
+	if s.SSEConnected {
+		connected = 1
+	}
+	lastSync := 0.0
+	if !s.LastSync.IsZero() {
+		lastSync = float64(s.LastSync.UnixMilli()) / 1000
+	}
+
+	sync := family{name: "hoplb_watcher_sync_duration_seconds", typ: "summary", help: "Time spent syncing state from the hop agent"}
+	for _, kind := range sortedKeys(s.SyncCount) {
+		labels := []label{{"kind", kind}}
+		sync.samples = append(sync.samples,
+			sample{suffix: "_count", labels: labels, value: float64(s.SyncCount[kind])},
+			sample{suffix: "_sum", labels: labels, value: s.SyncSeconds[kind]},
+		)
+	}
+
+	fetchErrors := family{name: "hoplb_watcher_fetch_errors_total", typ: "counter", help: "Failed fetches from the hop agent per endpoint"}
+	for _, endpoint := range sortedKeys(s.FetchErrors) {
+		fetchErrors.samples = append(fetchErrors.samples, sample{
+			labels: []label{{"endpoint", endpoint}},
+			value:  float64(s.FetchErrors[endpoint]),
+		})
+	}
+
+	backends := family{name: "hoplb_route_backends", typ: "gauge", help: "Backends per route"}
+	for _, route := range sortedKeys(s.Routes) {
+		backends.samples = append(backends.samples, sample{
+			labels: []label{{"route", route}},
+			value:  float64(s.Routes[route]),
+		})
+	}
+
+	skipped := family{name: "hoplb_watcher_skipped_tasks", typ: "gauge", help: "Running tasks left out of the last route build"}
+	for _, reason := range sortedKeys(s.Skipped) {
+		skipped.samples = append(skipped.samples, sample{
+			labels: []label{{"reason", reason}},
+			value:  float64(s.Skipped[reason]),
+		})
+	}
+
+	conflicts := family{name: "hoplb_route_conflicts", typ: "gauge", help: "Jobs claiming a route but left out of it by conflict resolution"}
+	for _, route := range sortedKeys(s.Conflicts) {
+		conflicts.samples = append(conflicts.samples, sample{
+			labels: []label{{"route", route}},
+			value:  float64(s.Conflicts[route]),
+		})
+	}
+
+	return []family{
+		{name: "hoplb_watcher_sse_connected", typ: "gauge", help: "Whether the hop agent event stream is connected (1) or not (0)",
+			samples: []sample{{value: connected}}},
+		{name: "hoplb_watcher_sse_reconnects_total", typ: "counter", help: "Event stream reconnect attempts",
+			samples: []sample{{value: float64(s.SSEReconnects)}}},
+		{name: "hoplb_watcher_last_sync_timestamp_seconds", typ: "gauge", help: "Unix time of the last successful sync (0 if never)",
+			samples: []sample{{value: lastSync}}},
+		sync,
+		fetchErrors,
+		{name: "hoplb_routes", typ: "gauge", help: "Number of routes in the route table",
+			samples: []sample{{value: float64(len(s.Routes))}}},
+		backends,
+		skipped,
+		conflicts,
+	}
+}
+
+// appendSummary adds quantile, _count and _sum samples for one domain/backend
+func appendSummary(samples []sample, domain, backend string, values []float64, count int, sum float64) []sample {
+	for i, q := range quantiles {
+		samples = append(samples, sample{
+			labels: []label{{"domain", domain}, {"backend", backend}, {"quantile", fmt.Sprintf("%.2f", q)}},
+			value:  values[i],
+		})
+	}
+	labels := []label{{"domain", domain}, {"backend", backend}}
+	return append(samples,
+		sample{suffix: "_count", labels: labels, value: float64(count)},
+		sample{suffix: "_sum", labels: labels, value: sum},
+	)
+}
+
+// appendHistogram adds _bucket, _count and _sum samples for one domain/backend
+func appendHistogram(samples []sample, domain, backend string, h HistogramSnapshot) []sample {
+	for i, n := range h.Cumulative {
+		le := "+Inf"
+		if i < len(LatencyBuckets) {
+			le = strconv.FormatFloat(LatencyBuckets[i], 'f', -1, 64)
+		}
+		samples = append(samples, sample{
+			suffix:   "_bucket",
+			labels:   []label{{"domain", domain}, {"backend", backend}, {"le", le}},
+			value:    float64(n),
+			exemplar: h.Exemplars[i],
+		})
+	}
+	labels := []label{{"domain", domain}, {"backend", backend}}
+	return append(samples,
+		sample{suffix: "_count", labels: labels, value: float64(h.Count)},
+		sample{suffix: "_sum", labels: labels, value: h.Sum},
+	)
+}
+
+// writeText renders families in the Prometheus text format (0.0.4)
+func writeText(b *strings.Builder, families []family) {
+	for i, f := range families {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(b, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(b, "# TYPE %s %s\n", f.name, f.typ)
+		for _, s := range f.samples {
+			b.WriteString(f.name)
+			b.WriteString(s.suffix)
+			writeLabels(b, s.labels)
+			b.WriteByte(' ')
+			b.WriteString(formatValue(s.value))
+			b.WriteByte('\n')
+		}
+	}
+}
+
+// writeOpenMetrics renders families in the OpenMetrics 1.0 text format.
+// Counter families drop the _total suffix in metadata, samples carry
+// exemplars, and the output ends with # EOF.
+func writeOpenMetrics(b *strings.Builder, families []family) {
+	for _, f := range families {
+		name := f.name
+		if f.typ == "counter" {
+			name = strings.TrimSuffix(name, "_total")
+		}
+		fmt.Fprintf(b, "# TYPE %s %s\n", name, f.typ)
+		fmt.Fprintf(b, "# HELP %s %s\n", name, f.help)
+		for _, s := range f.samples {
+			b.WriteString(f.name)
+			b.WriteString(s.suffix)
+			writeLabels(b, s.labels)
+			b.WriteByte(' ')
+			b.WriteString(formatValue(s.value))
+			if ex := s.exemplar; ex != nil && exemplarFits(ex) {
+				b.WriteString(" # ")
+				writeLabels(b, []label{{ex.Label, ex.ID}})
+				b.WriteByte(' ')
+				b.WriteString(strconv.FormatFloat(ex.Value, 'f', -1, 64))
+				b.WriteByte(' ')
+				b.WriteString(strconv.FormatFloat(float64(ex.Time.UnixMilli())/1000, 'f', 3, 64))
+			}
+			b.WriteByte('\n')
+		}
+	}
+	b.WriteString("# EOF\n")
+}
+
+// maxExemplarLabelChars is OpenMetrics' limit for an exemplar's label
+// names and values together; longer exemplars make scrapes fail
+const maxExemplarLabelChars = 128
+
+// exemplarFits reports whether ex is within the OpenMetrics limit
+func exemplarFits(ex *Exemplar) bool {
+	return utf8.RuneCountInString(ex.Label)+utf8.RuneCountInString(ex.ID) <= maxExemplarLabelChars
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeLabels renders {a="x",b="y"}, or nothing for no labels
+func writeLabels(b *strings.Builder, labels []label) {
+	if len(labels) == 0 {
+		return
+	}
+	b.WriteByte('{')
+	for i, l := range labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(l.name)
+		b.WriteString(`="`)
+		labelEscaper.WriteString(b, l.value)
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+}
+
+// formatValue prints integers without a fraction and floats with up to 6 decimals
+func formatValue(v float64) string {
+	if v == float64(int64(v)) {
+		return strconv.FormatInt(int64(v), 10)
+	}
+	return strconv.FormatFloat(v, 'f', 6, 64)
+}
+
+// sortedCodes returns status codes in ascending order
+func sortedCodes(codes map[int]int64) []int {
+	result := make([]int, 0, len(codes))
+	for code := range codes {
+		result = append(result, code)
+	}
+	sort.Ints(result)
+	return result
+}
+
+// sortedKeys returns map keys in ascending order
+func sortedKeys[V any](m map[string]V) []string {
+	result := make([]string, 0, len(m))
+	for k := range m {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
 }
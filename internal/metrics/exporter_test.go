@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExporterOutput(t *testing.T) {
+	m := New()
+	m.RecordRequest("api.example.com", "10.0.1.5:8080", 200, 20*time.Millisecond)
+	m.RecordRequest("api.example.com", "10.0.1.5:8080", 500, 40*time.Millisecond)
+	m.RecordTTFB("api.example.com", "10.0.1.5:8080", 5*time.Millisecond)
+	m.RecordBytes("api.example.com", "10.0.1.5:8080", 10, 20)
+	m.IncInFlight("api.example.com")
+	m.BackendConnOpened("10.0.1.5:8080")
+
+	w := httptest.NewRecorder()
+	NewExporter(m).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+
+	want := []string{
+		"# TYPE hoplb_requests_total counter\n",
+		`hoplb_requests_total{domain="api.example.com",backend="10.0.1.5:8080",code="200"} 1`,
+		`hoplb_requests_total{domain="api.example.com",backend="10.0.1.5:8080",code="500"} 1`,
+		`hoplb_request_duration_seconds_count{domain="api.example.com",backend="10.0.1.5:8080"} 2`,
+		`hoplb_upstream_ttfb_seconds{domain="api.example.com",backend="10.0.1.5:8080",quantile="0.50"} 0.005000`,
+		`hoplb_request_bytes_total{domain="api.example.com",backend="10.0.1.5:8080"} 10`,
+		`hoplb_response_bytes_total{domain="api.example.com",backend="10.0.1.5:8080"} 20`,
+		`hoplb_requests_in_flight{route="api.example.com"} 1`,
+		"hoplb_client_connections_active 0\n",
+		`hoplb_backend_connections_open{backend="10.0.1.5:8080"} 1`,
+	}
+	for _, s := range want {
+		if !strings.Contains(body, s) {
+			t.Errorf("output missing %q", s)
+		}
+	}
+}
+
+func TestExporterSkipsOversizeExemplars(t *testing.T) {
+	m := New()
+	m.RecordRequestExemplar("api.example.com", "10.0.1.5:8080", 200, 30*time.Millisecond,
+		Exemplar{Label: "request_id", ID: strings.Repeat("a", 128)})
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	w := httptest.NewRecorder()
+	NewExporter(m).ServeHTTP(w, req)
+	if strings.Contains(w.Body.String(), "# {") {
+		t.Error("exemplar over 128 characters was exported")
+	}
+}
+
+func TestExporterOpenMetrics(t *testing.T) {
+	m := New()
+	m.RecordRequestExemplar("api.example.com", "10.0.1.5:8080", 200, 30*time.Millisecond,
+		Exemplar{Label: "trace_id", ID: "4bf92f3577b34da6a3ce929d0e0e4736"})
+	m.RecordRequest("api.example.com", "10.0.1.5:8080", 200, 2*time.Second)
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0,text/plain;q=0.5")
+	w := httptest.NewRecorder()
+	NewExporter(m).ServeHTTP(w, req)
+	body := w.Body.String()
+
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/openmetrics-text") {
+		t.Errorf("Content-Type = %q; want OpenMetrics", ct)
+	}
+	want := []string{
+		"# TYPE hoplb_requests counter\n",
+		`hoplb_requests_total{domain="api.example.com",backend="10.0.1.5:8080",code="200"} 2`,
+		"# TYPE hoplb_request_latency_seconds histogram\n",
+		`hoplb_request_latency_seconds_bucket{domain="api.example.com",backend="10.0.1.5:8080",le="0.05"} 1 # {trace_id="4bf92f3577b34da6a3ce929d0e0e4736"} 0.03 `,
+		`hoplb_request_latency_seconds_bucket{domain="api.example.com",backend="10.0.1.5:8080",le="2.5"} 2` + "\n",
+		`hoplb_request_latency_seconds_bucket{domain="api.example.com",backend="10.0.1.5:8080",le="+Inf"} 2` + "\n",
+		`hoplb_request_latency_seconds_count{domain="api.example.com",backend="10.0.1.5:8080"} 2`,
+	}
+	for _, s := range want {
+		if !strings.Contains(body, s) {
+			t.Errorf("output missing %q", s)
+		}
+	}
+	if !strings.HasSuffix(body, "# EOF\n") {
+		t.Errorf("OpenMetrics output must end with # EOF")
+	}
+}
+
+func TestExporterNegotiation(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"text/plain", false},
+		{"application/openmetrics-text", true},
+		{"application/openmetrics-text;version=1.0.0;q=0.9,text/plain;q=0.1", true},
+		{"application/openmetrics-text;q=0,text/plain", false},
+	}
+	for _, tt := range tests {
+		if got := acceptsOpenMetrics(tt.accept); got != tt.want {
+			t.Errorf("acceptsOpenMetrics(%q) = %v; want %v", tt.accept, got, tt.want)
+		}
+	}
+
+	// Prometheus text format never carries exemplars
+	m := New()
+	m.RecordRequestExemplar("api.example.com", "10.0.1.5:8080", 200, 30*time.Millisecond,
+		Exemplar{Label: "request_id", ID: "abc"})
+	w := httptest.NewRecorder()
+	NewExporter(m).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if strings.Contains(w.Body.String(), "# {") {
+		t.Errorf("text format output contains an exemplar")
+	}
+}
@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"sort"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds (seconds) of the latency histogram.
+// An implicit +Inf bucket follows the last one.
+var LatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Exemplar links an observation to the request that produced it, e.g. a
+// trace ID, so a dashboard can jump from a bucket to a concrete request.
+type Exemplar struct {
+	Label string    // label name, e.g. "trace_id" or "request_id"
+	ID    string    // label value; empty means no exemplar
+	Value float64   // observed value (set by the histogram)
+	Time  time.Time // observation time (set by the histogram)
+}
+
+// histogram counts observations per bucket and keeps the most recent
+// exemplar for each bucket
+type histogram struct {
+	counts    []int64    // per bucket, not cumulative; last is +Inf
+	exemplars []Exemplar // most recent exemplar per bucket, empty ID if none
+	count     int64
+	sum       float64
+}
+
+func newHistogram() *histogram {
+	return &histogram{
+		counts:    make([]int64, len(LatencyBuckets)+1),
+		exemplars: make([]Exemplar, len(LatencyBuckets)+1),
+	}
+}
+
+// observe adds v to its bucket and replaces that bucket's exemplar
+func (h *histogram) observe(v float64, ex Exemplar) {
+	i := sort.SearchFloat64s(LatencyBuckets, v) // first bound >= v
+	h.counts[i]++
+	h.count++
+	h.sum += v
+
+	if ex.ID != "" {
+		ex.Value = v
+		ex.Time = time.Now()
+		h.exemplars[i] = ex
+	}
+}
+
+// HistogramSnapshot is a copy of one latency histogram
+type HistogramSnapshot struct {
+	Cumulative []int64     // cumulative count per bucket, last is +Inf
+	Exemplars  []*Exemplar // per bucket, nil if none
+	Count      int64
+	Sum        float64
+}
+
+// Histogram returns the latency histogram for a domain/backend
+func (m *Metrics) Histogram(domain, backend string) (HistogramSnapshot, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	h := m.histograms[domain][backend]
+	if h == nil {
+		return HistogramSnapshot{}, false
+	}
+
+	s := HistogramSnapshot{
+		Cumulative: make([]int64, len(h.counts)),
+		Exemplars:  make([]*Exemplar, len(h.exemplars)),
+		Count:      h.count,
+		Sum:        h.sum,
+	}
+	var total int64
+	for i, n := range h.counts {
+		total += n
+		s.Cumulative[i] = total
+	}
+	for i := range h.exemplars {
+		if h.exemplars[i].ID != "" {
+			ex := h.exemplars[i]
+			s.Exemplars[i] = &ex
+		}
+	}
+	return s, true
+}
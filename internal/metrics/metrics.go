@@ -1,8 +1,11 @@
 package metrics
 
 import (
+	"net"
+	"net/http"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,6 +26,41 @@ type Metrics struct {
 	// Invalidated on write, reused on read (O(1) percentile lookups between writes)
 	sortedCache map[string]map[string][]float64
 
+	// Latency histograms with exemplars: domain -> backend -> histogram
+	histograms map[string]map[string]*histogram
+
+	// Upstream time-to-first-byte, same layout as the latency maps above
+	ttfbSamples     map[string]map[string][]float64
+	ttfbSum         map[string]map[string]float64
+	ttfbSortedCache map[string]map[string][]float64
+
+	// Body sizes: domain -> backend -> bytes
+	requestBytes  map[string]map[string]int64
+	responseBytes map[string]map[string]int64
+
+	// In-flight requests: route pattern -> current count
+	inFlight map[string]int64
+
+	// Requests hoplb refused itself: route -> reason -> count
+	rejections map[string]map[string]int64
+
+	// Mirrored (shadow) requests: route -> result -> count
+	mirrors map[string]map[string]int64
+
+	// Current concurrency limit per route (static or adaptive)
+	concurrencyLimits map[string]int64
+
+	// Backend connection pool: backend -> open connections,
+	// backend -> reused -> acquisitions
+	backendConnsOpen     map[string]int64
+	backendConnsAcquired map[string]map[bool]int64
+
+	// Open client connections on the traffic listener (atomic)
+	activeConns int64
+
+	// Watcher (control plane) state, see watcher.go
+	watcher watcherStats
+
 	// Max samples to keep per domain/backend (rolling window)
 	maxSamples int
 }
@@ -34,12 +72,43 @@ func New() *Metrics {
 		latencySamples: make(map[string]map[string][]float64),
 		latencySum:     make(map[string]map[string]float64),
 		sortedCache:    make(map[string]map[string][]float64),
-		maxSamples:     10000, // Keep last 10k samples for percentiles
+
+		histograms: make(map[string]map[string]*histogram),
+
+		ttfbSamples:     make(map[string]map[string][]float64),
+		ttfbSum:         make(map[string]map[string]float64),
+		ttfbSortedCache: make(map[string]map[string][]float64),
+
+		requestBytes:         make(map[string]map[string]int64),
+		responseBytes:        make(map[string]map[string]int64),
+		inFlight:             make(map[string]int64),
+		rejections:           make(map[string]map[string]int64),
+		mirrors:              make(map[string]map[string]int64),
+		concurrencyLimits:    make(map[string]int64),
+		backendConnsOpen:     make(map[string]int64),
+		backendConnsAcquired: make(map[string]map[bool]int64),
+
+		watcher: watcherStats{
+			syncCount:   make(map[string]int64),
+			syncSeconds: make(map[string]float64),
+			fetchErrors: make(map[string]int64),
+			routes:      make(map[string]int),
+			skipped:     make(map[string]int),
+			conflicts:   make(map[string]int),
+		},
+
+		maxSamples: 10000, // Keep last 10k samples for percentiles
 	}
 }
 
 // RecordRequest records a request with its status code and duration
 func (m *Metrics) RecordRequest(domain, backend string, statusCode int, duration time.Duration) {
+	m.RecordRequestExemplar(domain, backend, statusCode, duration, Exemplar{})
+}
+
+// RecordRequestExemplar is RecordRequest that also attaches ex to the
+// latency histogram bucket the request falls into. An empty ex.ID only counts.
+func (m *Metrics) RecordRequestExemplar(domain, backend string, statusCode int, duration time.Duration, ex Exemplar) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -77,6 +146,17 @@ func (m *Metrics) RecordRequest(domain, backend string, statusCode int, duration
 	if m.sortedCache[domain] != nil {
 		delete(m.sortedCache[domain], backend)
 	}
+
+	// Latency histogram
+	if m.histograms[domain] == nil {
+		m.histograms[domain] = make(map[string]*histogram)
+	}
+	h := m.histograms[domain][backend]
+	if h == nil {
+		h = newHistogram()
+		m.histograms[domain][backend] = h
+	}
+	h.observe(duration.Seconds(), ex)
 }
 
 // RequestCounts returns all request counts
@@ -109,32 +189,27 @@ func (m *Metrics) Percentile(domain, backend string, p float64) float64 {
 // Uses a sorted cache that persists between calls — repeated reads (e.g.,
 // Prometheus scrapes) are O(1) with zero allocations until new samples arrive.
 func (m *Metrics) Percentiles(domain, backend string, ps []float64) []float64 {
+	return m.percentiles(m.latencySamples, m.sortedCache, domain, backend, ps)
+}
+
+// percentiles implements Percentiles over any samples/cache pair.
+func (m *Metrics) percentiles(samplesBy, cacheBy map[string]map[string][]float64, domain, backend string, ps []float64) []float64 {
 	results := make([]float64, len(ps))
 
 	// Try read lock first for cached path
 	m.mu.RLock()
 
-	samples, ok := m.latencySamples[domain][backend]
+	samples, ok := samplesBy[domain][backend]
 	if !ok || len(samples) == 0 {
 		m.mu.RUnlock()
 		return results
 	}
 
 	// Check if we have a valid cached sort
-	sorted := m.sortedCache[domain][backend]
+	sorted := cacheBy[domain][backend]
 	if sorted != nil && len(sorted) == len(samples) {
 		// Cache hit — use cached sorted snapshot
-		n := len(sorted)
-		for i, p := range ps {
-			idx := int(float64(n-1) * p)
-			if idx < 0 {
-				idx = 0
-			}
-			if idx >= n {
-				idx = n - 1
-			}
-			results[i] = sorted[idx]
-		}
+		pickQuantiles(sorted, ps, results)
 		m.mu.RUnlock()
 		return results
 	}
@@ -144,24 +219,30 @@ func (m *Metrics) Percentiles(domain, backend string, ps []float64) []float64 {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	samples = m.latencySamples[domain][backend]
+	samples = samplesBy[domain][backend]
 	if len(samples) == 0 {
 		return results
 	}
 
 	// Double-check: another goroutine may have populated the cache
-	sorted = m.sortedCache[domain][backend]
+	sorted = cacheBy[domain][backend]
 	if sorted == nil || len(sorted) != len(samples) {
 		sorted = make([]float64, len(samples))
 		copy(sorted, samples)
 		sort.Float64s(sorted)
 
-		if m.sortedCache[domain] == nil {
-			m.sortedCache[domain] = make(map[string][]float64)
+		if cacheBy[domain] == nil {
+			cacheBy[domain] = make(map[string][]float64)
 		}
-		m.sortedCache[domain][backend] = sorted
+		cacheBy[domain][backend] = sorted
 	}
 
+	pickQuantiles(sorted, ps, results)
+	return results
+}
+
+// pickQuantiles fills results with the values at quantiles ps of sorted
+func pickQuantiles(sorted, ps, results []float64) {
 	n := len(sorted)
 	for i, p := range ps {
 		idx := int(float64(n-1) * p)
@@ -173,8 +254,6 @@ func (m *Metrics) Percentiles(domain, backend string, ps []float64) []float64 {
 		}
 		results[i] = sorted[idx]
 	}
-
-	return results
 }
 
 // AllDomains returns all tracked domains
@@ -225,3 +304,232 @@ func (m *Metrics) SampleCount(domain, backend string) int {
 	}
 	return 0
 }
+
+// RecordTTFB records the upstream time-to-first-byte for a domain/backend.
+// Kept separate from RecordRequest so slow clients don't hide fast backends.
+func (m *Metrics) RecordTTFB(domain, backend string, ttfb time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.ttfbSamples[domain] == nil {
+		m.ttfbSamples[domain] = make(map[string][]float64)
+	}
+	if m.ttfbSum[domain] == nil {
+		m.ttfbSum[domain] = make(map[string]float64)
+	}
+	m.ttfbSum[domain][backend] += ttfb.Seconds()
+
+	samples := append(m.ttfbSamples[domain][backend], ttfb.Seconds())
+	if len(samples) > m.maxSamples {
+		samples = samples[len(samples)-m.maxSamples:]
+	}
+	m.ttfbSamples[domain][backend] = samples
+
+	if m.ttfbSortedCache[domain] != nil {
+		delete(m.ttfbSortedCache[domain], backend)
+	}
+}
+
+// TTFBPercentiles is Percentiles for upstream time-to-first-byte
+func (m *Metrics) TTFBPercentiles(domain, backend string, ps []float64) []float64 {
+	return m.percentiles(m.ttfbSamples, m.ttfbSortedCache, domain, backend, ps)
+}
+
+// TTFBSum returns the total time-to-first-byte for a domain/backend
+func (m *Metrics) TTFBSum(domain, backend string) float64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.ttfbSum[domain][backend]
+}
+
+// TTFBCount returns the number of time-to-first-byte samples for a domain/backend
+func (m *Metrics) TTFBCount(domain, backend string) int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.ttfbSamples[domain][backend])
+}
+
+// RecordBytes adds request and response body sizes for a domain/backend
+func (m *Metrics) RecordBytes(domain, backend string, requestBytes, responseBytes int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.requestBytes[domain] == nil {
+		m.requestBytes[domain] = make(map[string]int64)
+	}
+	if m.responseBytes[domain] == nil {
+		m.responseBytes[domain] = make(map[string]int64)
+	}
+	m.requestBytes[domain][backend] += requestBytes
+	m.responseBytes[domain][backend] += responseBytes
+}
+
+// Bytes returns request and response byte totals
+// Returns: domain -> backend -> bytes (one map per direction)
+func (m *Metrics) Bytes() (request, response map[string]map[string]int64) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return copyNested(m.requestBytes), copyNested(m.responseBytes)
+}
+
+// IncInFlight marks a request to route as started
+func (m *Metrics) IncInFlight(route string) {
+	m.mu.Lock()
+	m.inFlight[route]++
+	m.mu.Unlock()
+}
+
+// DecInFlight marks a request to route as finished
+func (m *Metrics) DecInFlight(route string) {
+	m.mu.Lock()
+	m.inFlight[route]--
+	m.mu.Unlock()
+}
+
+// InFlight returns the current in-flight request count per route
+func (m *Metrics) InFlight() map[string]int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	result := make(map[string]int64, len(m.inFlight))
+	for route, n := range m.inFlight {
+		result[route] = n
+	}
+	return result
+}
+
+// RecordRejection counts a request hoplb refused before proxying
+// (e.g. reason "ratelimit")
+func (m *Metrics) RecordRejection(route, reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.rejections[route] == nil {
+		m.rejections[route] = make(map[string]int64)
+	}
+	m.rejections[route][reason]++
+}
+
+// Rejections returns rejection counts
+// Returns: route -> reason -> count
+func (m *Metrics) Rejections() map[string]map[string]int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return copyNested(m.rejections)
+}
+
+// Mirror results
+const (
+	MirrorOK       = "ok"        // the mirror answered (any status)
+	MirrorError    = "error"     // the mirror failed or timed out
+	MirrorDropped  = "dropped"   // too many mirror requests in flight
+	MirrorTooLarge = "too_large" // request body over the buffer limit
+)
+
+// RecordMirror counts a sampled request copied to a route's mirror job
+func (m *Metrics) RecordMirror(route, result string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.mirrors[route] == nil {
+		m.mirrors[route] = make(map[string]int64)
+	}
+	m.mirrors[route][result]++
+}
+
+// Mirrors returns mirror counts
+// Returns: route -> result -> count
+func (m *Metrics) Mirrors() map[string]map[string]int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return copyNested(m.mirrors)
+}
+
+// SetConcurrencyLimit records the current concurrency limit of a route
+func (m *Metrics) SetConcurrencyLimit(route string, limit int) {
+	m.mu.Lock()
+	m.concurrencyLimits[route] = int64(limit)
+	m.mu.Unlock()
+}
+
+// ConcurrencyLimits returns the last recorded concurrency limit per route
+func (m *Metrics) ConcurrencyLimits() map[string]int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	result := make(map[string]int64, len(m.concurrencyLimits))
+	for route, n := range m.concurrencyLimits {
+		result[route] = n
+	}
+	return result
+}
+
+// ConnState tracks open client connections. Use it as http.Server.ConnState.
+func (m *Metrics) ConnState(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		atomic.AddInt64(&m.activeConns, 1)
+	case http.StateClosed, http.StateHijacked:
+		atomic.AddInt64(&m.activeConns, -1)
+	}
+}
+
+// ActiveConnections returns the number of open client connections
+func (m *Metrics) ActiveConnections() int64 {
+	return atomic.LoadInt64(&m.activeConns)
+}
+
+// BackendConnOpened records a new connection dialed to backend
+func (m *Metrics) BackendConnOpened(backend string) {
+	m.mu.Lock()
+	m.backendConnsOpen[backend]++
+	m.mu.Unlock()
+}
+
+// BackendConnClosed records a backend connection being closed
+func (m *Metrics) BackendConnClosed(backend string) {
+	m.mu.Lock()
+	m.backendConnsOpen[backend]--
+	m.mu.Unlock()
+}
+
+// BackendConnAcquired records a request getting a connection from the pool,
+// either a reused idle one or a freshly dialed one
+func (m *Metrics) BackendConnAcquired(backend string, reused bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.backendConnsAcquired[backend] == nil {
+		m.backendConnsAcquired[backend] = make(map[bool]int64)
+	}
+	m.backendConnsAcquired[backend][reused]++
+}
+
+// BackendConns returns open connections per backend and acquisitions per
+// backend split by whether the connection was reused
+func (m *Metrics) BackendConns() (open map[string]int64, acquired map[string]map[bool]int64) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	open = make(map[string]int64, len(m.backendConnsOpen))
+	for backend, n := range m.backendConnsOpen {
+		open[backend] = n
+	}
+	acquired = make(map[string]map[bool]int64, len(m.backendConnsAcquired))
+	for backend, byReuse := range m.backendConnsAcquired {
+		acquired[backend] = map[bool]int64{true: byReuse[true], false: byReuse[false]}
+	}
+	return open, acquired
+}
+
+// copyNested deep-copies a two-level counter map
+func copyNested(src map[string]map[string]int64) map[string]map[string]int64 {
+	result := make(map[string]map[string]int64, len(src))
+	for k, inner := range src {
+		result[k] = make(map[string]int64, len(inner))
+		for k2, v := range inner {
+			result[k][k2] = v
+		}
+	}
+	return result
+}
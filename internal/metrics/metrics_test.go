@@ -1,6 +1,7 @@
 package metrics
 
 import (
+	"net/http"
 	"testing"
 	"time"
 )
@@ -98,3 +99,98 @@ func TestMetricsNoSamples(t *testing.T) {
 		t.Errorf("Expected 0 samples, got %d", count)
 	}
 }
+
+func TestMetricsBytesAndTTFB(t *testing.T) {
+	m := New()
+
+	m.RecordBytes("api.example.com", "10.0.1.5:8080", 100, 2000)
+	m.RecordBytes("api.example.com", "10.0.1.5:8080", 50, 1000)
+	for i := 1; i <= 100; i++ {
+		m.RecordTTFB("api.example.com", "10.0.1.5:8080", time.Duration(i)*time.Millisecond)
+	}
+
+	req, resp := m.Bytes()
+	if req["api.example.com"]["10.0.1.5:8080"] != 150 {
+		t.Errorf("Expected 150 request bytes, got %d", req["api.example.com"]["10.0.1.5:8080"])
+	}
+	if resp["api.example.com"]["10.0.1.5:8080"] != 3000 {
+		t.Errorf("Expected 3000 response bytes, got %d", resp["api.example.com"]["10.0.1.5:8080"])
+	}
+
+	if n := m.TTFBCount("api.example.com", "10.0.1.5:8080"); n != 100 {
+		t.Errorf("Expected 100 TTFB samples, got %d", n)
+	}
+	p50 := m.TTFBPercentiles("api.example.com", "10.0.1.5:8080", []float64{0.5})[0]
+	if p50 < 0.050 || p50 > 0.051 {
+		t.Errorf("TTFB p50 should be ~0.050s, got %.6f", p50)
+	}
+
+	// TTFB must not leak into the request duration summary
+	if m.SampleCount("api.example.com", "10.0.1.5:8080") != 0 {
+		t.Errorf("TTFB samples should not count as request samples")
+	}
+}
+
+func TestMetricsConnections(t *testing.T) {
+	m := New()
+
+	m.IncInFlight("*.example.com")
+	m.IncInFlight("*.example.com")
+	m.DecInFlight("*.example.com")
+	if n := m.InFlight()["*.example.com"]; n != 1 {
+		t.Errorf("Expected 1 in-flight request, got %d", n)
+	}
+
+	m.ConnState(nil, http.StateNew)
+	m.ConnState(nil, http.StateNew)
+	m.ConnState(nil, http.StateActive)
+	m.ConnState(nil, http.StateClosed)
+	if n := m.ActiveConnections(); n != 1 {
+		t.Errorf("Expected 1 active connection, got %d", n)
+	}
+
+	m.BackendConnOpened("10.0.1.5:8080")
+	m.BackendConnAcquired("10.0.1.5:8080", false)
+	m.BackendConnAcquired("10.0.1.5:8080", true)
+	m.BackendConnAcquired("10.0.1.5:8080", true)
+	open, acquired := m.BackendConns()
+	if open["10.0.1.5:8080"] != 1 {
+		t.Errorf("Expected 1 open backend connection, got %d", open["10.0.1.5:8080"])
+	}
+	if acquired["10.0.1.5:8080"][true] != 2 || acquired["10.0.1.5:8080"][false] != 1 {
+		t.Errorf("Expected 2 reused and 1 new acquisition, got %v", acquired["10.0.1.5:8080"])
+	}
+}
+
+func TestMetricsWatcher(t *testing.T) {
+	m := New()
+
+	if !m.Watcher().LastSync.IsZero() {
+		t.Errorf("LastSync should be zero before any sync")
+	}
+
+	m.SetSSEConnected(true)
+	m.IncSSEReconnects()
+	m.RecordSync(SyncFull, 200*time.Millisecond)
+	m.RecordSync(SyncJob, 10*time.Millisecond)
+	m.RecordSync(SyncJob, 30*time.Millisecond)
+	m.RecordFetchError("/v1/jobs")
+	m.SetRoutes(map[string]int{"api.example.com": 3, "*.example.com": 0})
+
+	s := m.Watcher()
+	if !s.SSEConnected || s.SSEReconnects != 1 {
+		t.Errorf("SSE state = %v/%d; want connected/1", s.SSEConnected, s.SSEReconnects)
+	}
+	if s.LastSync.IsZero() {
+		t.Errorf("LastSync should be set after a sync")
+	}
+	if s.SyncCount[SyncJob] != 2 || s.SyncSeconds[SyncJob] < 0.039 || s.SyncSeconds[SyncJob] > 0.041 {
+		t.Errorf("job syncs = %d (%.3fs); want 2 (0.040s)", s.SyncCount[SyncJob], s.SyncSeconds[SyncJob])
+	}
+	if s.FetchErrors["/v1/jobs"] != 1 {
+		t.Errorf("fetch errors for /v1/jobs = %d; want 1", s.FetchErrors["/v1/jobs"])
+	}
+	if len(s.Routes) != 2 || s.Routes["api.example.com"] != 3 {
+		t.Errorf("routes = %v; want 2 routes, 3 backends for api.example.com", s.Routes)
+	}
+}
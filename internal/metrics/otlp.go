@@ -0,0 +1,225 @@
+package metrics
+
+import (
+	"strconv"
+	"time"
+)
+
+// OTLP/JSON metrics payload (opentelemetry-proto, JSON mapping)
+type (
+	otlpMetricsRequest struct {
+		ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+	}
+	otlpResourceMetrics struct {
+		Resource     otlpResource       `json:"resource"`
+		ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeMetrics struct {
+		Scope   otlpScope    `json:"scope"`
+		Metrics []otlpMetric `json:"metrics"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpMetric struct {
+		Name        string         `json:"name"`
+		Description string         `json:"description,omitempty"`
+		Gauge       *otlpGauge     `json:"gauge,omitempty"`
+		Sum         *otlpSum       `json:"sum,omitempty"`
+		Summary     *otlpSummary   `json:"summary,omitempty"`
+		Histogram   *otlpHistogram `json:"histogram,omitempty"`
+	}
+	otlpGauge struct {
+		DataPoints []otlpNumberPoint `json:"dataPoints"`
+	}
+	otlpSum struct {
+		DataPoints             []otlpNumberPoint `json:"dataPoints"`
+		AggregationTemporality int               `json:"aggregationTemporality"` // 2 = cumulative
+		IsMonotonic            bool              `json:"isMonotonic"`
+	}
+	otlpSummary struct {
+		DataPoints []otlpSummaryPoint `json:"dataPoints"`
+	}
+	otlpHistogram struct {
+		DataPoints             []otlpHistogramPoint `json:"dataPoints"`
+		AggregationTemporality int                  `json:"aggregationTemporality"`
+	}
+	otlpNumberPoint struct {
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano,omitempty"`
+		TimeUnixNano      string         `json:"timeUnixNano"`
+		AsDouble          float64        `json:"asDouble"`
+	}
+	otlpSummaryPoint struct {
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano,omitempty"`
+		TimeUnixNano      string         `json:"timeUnixNano"`
+		Count             string         `json:"count"` // uint64 as decimal string
+		Sum               float64        `json:"sum"`
+		QuantileValues    []otlpQuantile `json:"quantileValues,omitempty"`
+	}
+	otlpQuantile struct {
+		Quantile float64 `json:"quantile"`
+		Value    float64 `json:"value"`
+	}
+	otlpHistogramPoint struct {
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano,omitempty"`
+		TimeUnixNano      string         `json:"timeUnixNano"`
+		Count             string         `json:"count"`
+		Sum               float64        `json:"sum"`
+		BucketCounts      []string       `json:"bucketCounts"` // per bucket, not cumulative
+		ExplicitBounds    []float64      `json:"explicitBounds"`
+	}
+	otlpKeyValue struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue string `json:"stringValue"`
+	}
+)
+
+// encodeOTLP converts families to an OTLP metrics request. start is the
+// start time of cumulative series (process start).
+func encodeOTLP(families []family, serviceName string, start, now time.Time) otlpMetricsRequest {
+	startNano := strconv.FormatInt(start.UnixNano(), 10)
+	nowNano := strconv.FormatInt(now.UnixNano(), 10)
+
+	metrics := make([]otlpMetric, 0, len(families))
+	for _, f := range families {
+		om := otlpMetric{Name: f.name, Description: f.help}
+
+		switch f.typ {
+		case "counter":
+			sum := &otlpSum{AggregationTemporality: 2, IsMonotonic: true}
+			for _, s := range f.samples {
+				sum.DataPoints = append(sum.DataPoints, otlpNumberPoint{
+					Attributes: attributes(s.labels), StartTimeUnixNano: startNano, TimeUnixNano: nowNano, AsDouble: s.value,
+				})
+			}
+			om.Sum = sum
+
+		case "gauge":
+			gauge := &otlpGauge{}
+			for _, s := range f.samples {
+				gauge.DataPoints = append(gauge.DataPoints, otlpNumberPoint{
+					Attributes: attributes(s.labels), TimeUnixNano: nowNano, AsDouble: s.value,
+				})
+			}
+			om.Gauge = gauge
+
+		case "summary":
+			summary := &otlpSummary{}
+			for _, g := range groupSamples(f.samples, "quantile") {
+				p := otlpSummaryPoint{Attributes: attributes(g.labels), StartTimeUnixNano: startNano, TimeUnixNano: nowNano}
+				for _, s := range g.samples {
+					switch s.suffix {
+					case "_count":
+						p.Count = strconv.FormatInt(int64(s.value), 10)
+					case "_sum":
+						p.Sum = s.value
+					default:
+						q, _ := strconv.ParseFloat(labelValue(s.labels, "quantile"), 64)
+						p.QuantileValues = append(p.QuantileValues, otlpQuantile{Quantile: q, Value: s.value})
+					}
+				}
+				summary.DataPoints = append(summary.DataPoints, p)
+			}
+			om.Summary = summary
+
+		case "histogram":
+			hist := &otlpHistogram{AggregationTemporality: 2}
+			for _, g := range groupSamples(f.samples, "le") {
+				p := otlpHistogramPoint{Attributes: attributes(g.labels), StartTimeUnixNano: startNano, TimeUnixNano: nowNano}
+				var prev float64
+				for _, s := range g.samples {
+					switch s.suffix {
+					case "_count":
+						p.Count = strconv.FormatInt(int64(s.value), 10)
+					case "_sum":
+						p.Sum = s.value
+					case "_bucket":
+						p.BucketCounts = append(p.BucketCounts, strconv.FormatInt(int64(s.value-prev), 10))
+						prev = s.value
+						if le := labelValue(s.labels, "le"); le != "+Inf" {
+							bound, _ := strconv.ParseFloat(le, 64)
+							p.ExplicitBounds = append(p.ExplicitBounds, bound)
+						}
+					}
+				}
+				hist.DataPoints = append(hist.DataPoints, p)
+			}
+			om.Histogram = hist
+		}
+
+		metrics = append(metrics, om)
+	}
+
+	return otlpMetricsRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{
+			{Key: "service.name", Value: otlpValue{StringValue: serviceName}},
+		}},
+		ScopeMetrics: []otlpScopeMetrics{{
+			Scope:   otlpScope{Name: "hoplb"},
+			Metrics: metrics,
+		}},
+	}}}
+}
+
+// sampleGroup is the samples of one series of a summary or histogram
+type sampleGroup struct {
+	labels  []label
+	samples []sample
+}
+
+// groupSamples groups samples by their labels minus the per-line label
+// (quantile or le), keeping first-seen order
+func groupSamples(samples []sample, lineLabel string) []*sampleGroup {
+	var groups []*sampleGroup
+	byKey := make(map[string]*sampleGroup)
+	for _, s := range samples {
+		var key []byte
+		var labels []label
+		for _, l := range s.labels {
+			if l.name == lineLabel {
+				continue
+			}
+			labels = append(labels, l)
+			key = append(key, l.name...)
+			key = append(key, 0)
+			key = append(key, l.value...)
+			key = append(key, 0)
+		}
+		g := byKey[string(key)]
+		if g == nil {
+			g = &sampleGroup{labels: labels}
+			byKey[string(key)] = g
+			groups = append(groups, g)
+		}
+		g.samples = append(g.samples, s)
+	}
+	return groups
+}
+
+// attributes converts labels to OTLP attributes
+func attributes(labels []label) []otlpKeyValue {
+	var kvs []otlpKeyValue
+	for _, l := range labels {
+		kvs = append(kvs, otlpKeyValue{Key: l.name, Value: otlpValue{StringValue: l.value}})
+	}
+	return kvs
+}
+
+// labelValue returns the value of the named label, or ""
+func labelValue(labels []label, name string) string {
+	for _, l := range labels {
+		if l.name == name {
+			return l.value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,161 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Push formats
+const (
+	PushOTLP        = "otlp"         // OTLP/HTTP JSON to <url> (e.g. http://collector:4318/v1/metrics)
+	PushRemoteWrite = "remote-write" // Prometheus remote-write v1 to <url> (e.g. http://prom:9090/api/v1/write)
+)
+
+// Pusher periodically sends all metrics to a push endpoint, for instances
+// Prometheus can't scrape. Failed pushes are retried with exponential
+// back-off until the next interval is due.
+type Pusher struct {
+	metrics *Metrics
+	format  string
+	url     string
+	client  *http.Client
+	start   time.Time // start of cumulative series
+
+	// Interval between pushes
+	Interval time.Duration
+
+	// MinBackoff and MaxBackoff bound the retry delay after a failed push
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// Headers are added to every push request (e.g. Authorization)
+	Headers map[string]string
+
+	// ServiceName is reported as the OTLP service.name resource attribute
+	ServiceName string
+}
+
+// NewPusher creates a pusher for format (PushOTLP or PushRemoteWrite)
+func NewPusher(m *Metrics, format, url string) (*Pusher, error) {
+	if format != PushOTLP && format != PushRemoteWrite {
+		return nil, fmt.Errorf("unknown push format %q (want %q or %q)", format, PushOTLP, PushRemoteWrite)
+	}
+	return &Pusher{
+		metrics:     m,
+		format:      format,
+		url:         url,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		start:       time.Now(),
+		Interval:    15 * time.Second,
+		MinBackoff:  500 * time.Millisecond,
+		MaxBackoff:  5 * time.Second,
+		ServiceName: "hoplb",
+	}, nil
+}
+
+// Run pushes every Interval until ctx is done, then pushes once more so the
+// final counts aren't lost
+func (p *Pusher) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			deadline, cancel := context.WithTimeout(ctx, p.Interval)
+			if err := p.PushWithRetry(deadline); err != nil {
+				log.Printf("Metrics push to %s failed: %v", p.url, err)
+			}
+			cancel()
+		case <-ctx.Done():
+			final, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			if err := p.Push(final); err != nil {
+				log.Printf("Final metrics push to %s failed: %v", p.url, err)
+			}
+			cancel()
+			return
+		}
+	}
+}
+
+// PushWithRetry pushes, retrying retryable failures with exponential
+// back-off until it succeeds or ctx is done
+func (p *Pusher) PushWithRetry(ctx context.Context) error {
+	backoff := p.MinBackoff
+	for {
+		err := p.Push(ctx)
+		if err == nil {
+			return nil
+		}
+		if perm, ok := err.(*permanentError); ok {
+			return perm.err
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return fmt.Errorf("%w (gave up: %v)", err, ctx.Err())
+		}
+		backoff *= 2
+		if backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
+
+// permanentError marks a push failure that retrying won't fix (4xx)
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+
+// Push sends one snapshot of all metrics
+func (p *Pusher) Push(ctx context.Context) error {
+	now := time.Now()
+	families := gather(p.metrics)
+
+	var body []byte
+	contentType := "application/json"
+	if p.format == PushRemoteWrite {
+		body = encodeRemoteWrite(families, now)
+		contentType = "application/x-protobuf"
+	} else {
+		var err error
+		body, err = json.Marshal(encodeOTLP(families, p.ServiceName, p.start, now))
+		if err != nil {
+			return &permanentError{err}
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", p.url, bytes.NewReader(body))
+	if err != nil {
+		return &permanentError{err}
+	}
+	req.Header.Set("Content-Type", contentType)
+	if p.format == PushRemoteWrite {
+		req.Header.Set("Content-Encoding", "snappy")
+		req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	}
+	for k, v := range p.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode/100 == 2:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5:
+		return fmt.Errorf("push endpoint returned %s", resp.Status)
+	default:
+		return &permanentError{fmt.Errorf("push endpoint returned %s", resp.Status)}
+	}
+}
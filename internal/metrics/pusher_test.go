@@ -0,0 +1,231 @@
+package metrics
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPusherOTLP(t *testing.T) {
+	m := New()
+	m.RecordRequest("api.example.com", "10.0.1.5:8080", 200, 30*time.Millisecond)
+	m.RecordRequest("api.example.com", "10.0.1.5:8080", 200, 2*time.Second)
+
+	var got otlpMetricsRequest
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("decode: %v", err)
+		}
+	}))
+	defer receiver.Close()
+
+	p, err := NewPusher(m, PushOTLP, receiver.URL+"/v1/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Push(context.Background()); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+
+	byName := map[string]otlpMetric{}
+	for _, om := range got.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+		byName[om.Name] = om
+	}
+
+	requests := byName["hoplb_requests_total"]
+	if requests.Sum == nil || !requests.Sum.IsMonotonic || requests.Sum.DataPoints[0].AsDouble != 2 {
+		t.Errorf("hoplb_requests_total = %+v; want monotonic sum of 2", requests.Sum)
+	}
+
+	hist := byName["hoplb_request_latency_seconds"].Histogram
+	if hist == nil || len(hist.DataPoints) != 1 {
+		t.Fatalf("latency histogram missing")
+	}
+	hp := hist.DataPoints[0]
+	if hp.Count != "2" || len(hp.BucketCounts) != len(LatencyBuckets)+1 || len(hp.ExplicitBounds) != len(LatencyBuckets) {
+		t.Errorf("histogram point = %+v", hp)
+	}
+	var total int
+	for _, c := range hp.BucketCounts {
+		if c != "0" && c != "1" {
+			t.Errorf("bucket counts must not be cumulative, got %v", hp.BucketCounts)
+			break
+		}
+		if c == "1" {
+			total++
+		}
+	}
+	if total != 2 {
+		t.Errorf("bucket counts %v; want two buckets with one observation each", hp.BucketCounts)
+	}
+
+	summary := byName["hoplb_request_duration_seconds"].Summary
+	if summary == nil || len(summary.DataPoints[0].QuantileValues) != len(quantiles) || summary.DataPoints[0].Count != "2" {
+		t.Errorf("summary = %+v", summary)
+	}
+}
+
+func TestPusherRemoteWrite(t *testing.T) {
+	m := New()
+	m.RecordRequest("api.example.com", "10.0.1.5:8080", 200, 30*time.Millisecond)
+
+	var series []map[string]string
+	var values []float64
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+		compressed, _ := io.ReadAll(r.Body)
+		series, values = decodeWriteRequest(t, snappyDecodeLiterals(t, compressed))
+	}))
+	defer receiver.Close()
+
+	p, _ := NewPusher(m, PushRemoteWrite, receiver.URL)
+	if err := p.Push(context.Background()); err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+
+	found := false
+	for i, labels := range series {
+		if labels["__name__"] == "hoplb_requests_total" && labels["domain"] == "api.example.com" && labels["code"] == "200" {
+			found = true
+			if values[i] != 1 {
+				t.Errorf("hoplb_requests_total = %v; want 1", values[i])
+			}
+		}
+	}
+	if !found {
+		t.Errorf("hoplb_requests_total series not pushed (got %d series)", len(series))
+	}
+}
+
+func TestPusherRetry(t *testing.T) {
+	var calls int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer receiver.Close()
+
+	p, _ := NewPusher(New(), PushOTLP, receiver.URL)
+	p.MinBackoff = time.Millisecond
+	p.MaxBackoff = 2 * time.Millisecond
+
+	if err := p.PushWithRetry(context.Background()); err != nil {
+		t.Fatalf("PushWithRetry: %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("receiver called %d times; want 3 (two 503s, then success)", calls)
+	}
+}
+
+func TestPusherNoRetryOnClientError(t *testing.T) {
+	var calls int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer receiver.Close()
+
+	p, _ := NewPusher(New(), PushRemoteWrite, receiver.URL)
+	p.MinBackoff = time.Millisecond
+
+	err := p.PushWithRetry(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("PushWithRetry error = %v; want 400 failure", err)
+	}
+	if calls != 1 {
+		t.Errorf("receiver called %d times; want 1 (4xx is not retried)", calls)
+	}
+}
+
+// snappyDecodeLiterals decodes a snappy block that contains only literals
+func snappyDecodeLiterals(t *testing.T, src []byte) []byte {
+	t.Helper()
+	n, k := binary.Uvarint(src)
+	src = src[k:]
+	var dst []byte
+	for len(src) > 0 {
+		tag := src[0]
+		if tag&3 != 0 {
+			t.Fatalf("unexpected non-literal snappy element")
+		}
+		length := int(tag>>2) + 1
+		src = src[1:]
+		switch tag >> 2 {
+		case 60:
+			length = int(src[0]) + 1
+			src = src[1:]
+		case 61:
+			length = int(src[0]) | int(src[1])<<8 + 1
+			src = src[2:]
+		}
+		dst = append(dst, src[:length]...)
+		src = src[length:]
+	}
+	if uint64(len(dst)) != n {
+		t.Fatalf("snappy length %d; header says %d", len(dst), n)
+	}
+	return dst
+}
+
+// decodeWriteRequest decodes the subset of WriteRequest the pusher writes
+func decodeWriteRequest(t *testing.T, b []byte) ([]map[string]string, []float64) {
+	t.Helper()
+	var series []map[string]string
+	var values []float64
+	for _, ts := range fields(t, b) {
+		labels := map[string]string{}
+		for _, f := range fields(t, ts.data) {
+			if f.num == 1 {
+				lf := fields(t, f.data)
+				labels[string(lf[0].data)] = string(lf[1].data)
+			} else {
+				sf := fields(t, f.data)
+				values = append(values, math.Float64frombits(binary.LittleEndian.Uint64(sf[0].data)))
+			}
+		}
+		series = append(series, labels)
+	}
+	return series, values
+}
+
+type field struct {
+	num  int
+	data []byte
+}
+
+// fields splits a protobuf message into fields (varint, fixed64, bytes)
+func fields(t *testing.T, b []byte) []field {
+	t.Helper()
+	var out []field
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		b = b[n:]
+		f := field{num: int(key >> 3)}
+		switch key & 7 {
+		case 0:
+			_, n = binary.Uvarint(b)
+			f.data, b = b[:n], b[n:]
+		case 1:
+			f.data, b = b[:8], b[8:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			b = b[n:]
+			f.data, b = b[:l], b[l:]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+		out = append(out, f)
+	}
+	return out
+}
@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"encoding/binary"
+	"math"
+	"sort"
+	"time"
+)
+
+// encodeRemoteWrite turns families into a snappy-compressed Prometheus
+// remote-write (v1) WriteRequest. Every sample line becomes one time series
+// with a single sample at ts.
+func encodeRemoteWrite(families []family, ts time.Time) []byte {
+	millis := ts.UnixMilli()
+
+	var req []byte
+	for _, f := range families {
+		for _, s := range f.samples {
+			labels := make([]label, 0, len(s.labels)+1)
+			labels = append(labels, label{"__name__", f.name + s.suffix})
+			labels = append(labels, s.labels...)
+			sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+
+			var series []byte
+			for _, l := range labels {
+				var lb []byte
+				lb = appendBytesField(lb, 1, []byte(l.name))
+				lb = appendBytesField(lb, 2, []byte(l.value))
+				series = appendBytesField(series, 1, lb)
+			}
+			var sample []byte
+			sample = appendTag(sample, 1, 1) // double, fixed64
+			sample = binary.LittleEndian.AppendUint64(sample, math.Float64bits(s.value))
+			sample = appendTag(sample, 2, 0) // int64, varint
+			sample = binary.AppendUvarint(sample, uint64(millis))
+			series = appendBytesField(series, 2, sample)
+
+			req = appendBytesField(req, 1, series)
+		}
+	}
+	return snappyEncode(req)
+}
+
+// appendTag appends a protobuf field key
+func appendTag(b []byte, field, wireType int) []byte {
+	return binary.AppendUvarint(b, uint64(field<<3|wireType))
+}
+
+// appendBytesField appends a length-delimited protobuf field
+func appendBytesField(b []byte, field int, v []byte) []byte {
+	b = appendTag(b, field, 2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// snappyEncode produces a valid snappy block made only of literals.
+// Remote-write requires snappy framing but not compression, and metric
+// payloads are small enough that skipping the matcher is fine.
+func snappyEncode(src []byte) []byte {
+	dst := binary.AppendUvarint(nil, uint64(len(src)))
+	for len(src) > 0 {
+		n := len(src)
+		if n > 65536 {
+			n = 65536
+		}
+		switch {
+		case n <= 60:
+			dst = append(dst, byte(n-1)<<2)
+		case n <= 256:
+			dst = append(dst, 60<<2, byte(n-1))
+		default:
+			dst = append(dst, 61<<2, byte(n-1), byte((n-1)>>8))
+		}
+		dst = append(dst, src[:n]...)
+		src = src[n:]
+	}
+	return dst
+}
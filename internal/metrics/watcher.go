@@ -0,0 +1,147 @@
+package metrics
+
+import "time"
+
+// Sync kinds passed to RecordSync
+const (
+	SyncFull = "full" // agents + jobs + all relevant job statuses
+	SyncJob  = "job"  // a single job's status
+)
+
+// Skip reasons passed to SetSkippedTasks
+const (
+	SkipNoHost = "no_host" // agent has no resolvable endpoint
+	SkipNoPort = "no_port" // running task exposes no usable port
+)
+
+// watcherStats is the control-plane view of the route watcher
+type watcherStats struct {
+	sseConnected  bool
+	sseReconnects int64
+	lastSync      time.Time
+
+	syncCount   map[string]int64   // kind -> syncs
+	syncSeconds map[string]float64 // kind -> total seconds
+	fetchErrors map[string]int64   // endpoint -> errors
+
+	routes    map[string]int // route pattern -> backends (replaced on every build)
+	skipped   map[string]int // skip reason -> tasks skipped in last build
+	conflicts map[string]int // route pattern -> jobs left out in last build
+}
+
+// SetSSEConnected records whether the watcher's event stream is connected
+func (m *Metrics) SetSSEConnected(connected bool) {
+	m.mu.Lock()
+	m.watcher.sseConnected = connected
+	m.mu.Unlock()
+}
+
+// IncSSEReconnects counts an event stream reconnect attempt
+func (m *Metrics) IncSSEReconnects() {
+	m.mu.Lock()
+	m.watcher.sseReconnects++
+	m.mu.Unlock()
+}
+
+// RecordSync records a successful sync of the given kind (SyncFull, SyncJob)
+func (m *Metrics) RecordSync(kind string, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.watcher.syncCount[kind]++
+	m.watcher.syncSeconds[kind] += duration.Seconds()
+	m.watcher.lastSync = time.Now()
+}
+
+// RecordFetchError counts a failed fetch from a hop agent endpoint.
+// endpoint should be a path template (e.g. "/v1/jobs/{job}/status") to keep
+// label cardinality bounded.
+func (m *Metrics) RecordFetchError(endpoint string) {
+	m.mu.Lock()
+	m.watcher.fetchErrors[endpoint]++
+	m.mu.Unlock()
+}
+
+// SetRoutes replaces the route snapshot: route pattern -> backend count
+func (m *Metrics) SetRoutes(backends map[string]int) {
+	routes := make(map[string]int, len(backends))
+	for pattern, n := range backends {
+		routes[pattern] = n
+	}
+
+	m.mu.Lock()
+	m.watcher.routes = routes
+	m.mu.Unlock()
+}
+
+// SetSkippedTasks records how many running tasks the last route build
+// skipped, per reason (SkipNoHost, SkipNoPort)
+func (m *Metrics) SetSkippedTasks(noHost, noPort int) {
+	m.mu.Lock()
+	m.watcher.skipped[SkipNoHost] = noHost
+	m.watcher.skipped[SkipNoPort] = noPort
+	m.mu.Unlock()
+}
+
+// SetRouteConflicts replaces the conflict snapshot: route pattern -> number
+// of jobs that claim the route but were left out of it
+func (m *Metrics) SetRouteConflicts(ignored map[string]int) {
+	conflicts := make(map[string]int, len(ignored))
+	for pattern, n := range ignored {
+		conflicts[pattern] = n
+	}
+
+	m.mu.Lock()
+	m.watcher.conflicts = conflicts
+	m.mu.Unlock()
+}
+
+// WatcherSnapshot is a point-in-time copy of the watcher stats
+type WatcherSnapshot struct {
+	SSEConnected  bool
+	SSEReconnects int64
+	LastSync      time.Time // zero if never synced
+	SyncCount     map[string]int64
+	SyncSeconds   map[string]float64
+	FetchErrors   map[string]int64
+	Routes        map[string]int
+	Skipped       map[string]int
+	Conflicts     map[string]int
+}
+
+// Watcher returns a copy of the watcher stats
+func (m *Metrics) Watcher() WatcherSnapshot {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	s := WatcherSnapshot{
+		SSEConnected:  m.watcher.sseConnected,
+		SSEReconnects: m.watcher.sseReconnects,
+		LastSync:      m.watcher.lastSync,
+		SyncCount:     make(map[string]int64, len(m.watcher.syncCount)),
+		SyncSeconds:   make(map[string]float64, len(m.watcher.syncSeconds)),
+		FetchErrors:   make(map[string]int64, len(m.watcher.fetchErrors)),
+		Routes:        make(map[string]int, len(m.watcher.routes)),
+		Skipped:       make(map[string]int, len(m.watcher.skipped)),
+		Conflicts:     make(map[string]int, len(m.watcher.conflicts)),
+	}
+	for k, v := range m.watcher.syncCount {
+		s.SyncCount[k] = v
+	}
+	for k, v := range m.watcher.syncSeconds {
+		s.SyncSeconds[k] = v
+	}
+	for k, v := range m.watcher.fetchErrors {
+		s.FetchErrors[k] = v
+	}
+	for k, v := range m.watcher.routes {
+		s.Routes[k] = v
+	}
+	for k, v := range m.watcher.skipped {
+		s.Skipped[k] = v
+	}
+	for k, v := range m.watcher.conflicts {
+		s.Conflicts[k] = v
+	}
+	return s
+}
@@ -0,0 +1,272 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OTLPExporter batches spans and POSTs them as OTLP/HTTP JSON to
+// <endpoint>/v1/traces. Spans are dropped (not blocked on) when the queue
+// is full so tracing can never slow down proxying.
+type OTLPExporter struct {
+	url         string
+	serviceName string
+	client      *http.Client
+
+	// Headers are added to every export request (e.g. auth for a SaaS collector)
+	Headers map[string]string
+
+	queue    chan *Span
+	batch    int
+	interval time.Duration
+
+	mu      sync.Mutex
+	dropped int64
+
+	flushCh chan chan struct{}
+	done    chan struct{}
+	stopped sync.WaitGroup
+}
+
+// NewOTLPExporter creates an exporter for the collector at endpoint
+// (e.g. "http://otel-collector:4318") and starts its background sender
+func NewOTLPExporter(endpoint, serviceName string) *OTLPExporter {
+	e := &OTLPExporter{
+		url:         strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		queue:       make(chan *Span, 2048),
+		batch:       512,
+		interval:    5 * time.Second,
+		flushCh:     make(chan chan struct{}),
+		done:        make(chan struct{}),
+	}
+	e.stopped.Add(1)
+	go e.run()
+	return e
+}
+
+// Export queues a finished span
+func (e *OTLPExporter) Export(s *Span) {
+	select {
+	case e.queue <- s:
+	default:
+		e.mu.Lock()
+		e.dropped++
+		e.mu.Unlock()
+	}
+}
+
+// Dropped returns how many spans were dropped because the queue was full
+func (e *OTLPExporter) Dropped() int64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.dropped
+}
+
+// Flush sends everything queued so far and waits for it
+func (e *OTLPExporter) Flush() {
+	ack := make(chan struct{})
+	select {
+	case e.flushCh <- ack:
+		<-ack
+	case <-e.done:
+	}
+}
+
+// Shutdown flushes queued spans and stops the sender
+func (e *OTLPExporter) Shutdown(ctx context.Context) {
+	close(e.done)
+	stopped := make(chan struct{})
+	go func() {
+		e.stopped.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+	}
+}
+
+// run batches spans and sends on size, interval, flush or shutdown
+func (e *OTLPExporter) run() {
+	defer e.stopped.Done()
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	var pending []*Span
+	send := func() {
+		if len(pending) == 0 {
+			return
+		}
+		if err := e.send(pending); err != nil {
+			log.Printf("Trace export failed (%d spans): %v", len(pending), err)
+		}
+		pending = nil
+	}
+	drain := func() {
+		for {
+			select {
+			case s := <-e.queue:
+				pending = append(pending, s)
+			default:
+				return
+			}
+		}
+	}
+
+	for {
+		select {
+		case s := <-e.queue:
+			pending = append(pending, s)
+			if len(pending) >= e.batch {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case ack := <-e.flushCh:
+			drain()
+			send()
+			close(ack)
+		case <-e.done:
+			drain()
+			send()
+			return
+		}
+	}
+}
+
+// send POSTs one batch
+func (e *OTLPExporter) send(spans []*Span) error {
+	body, err := json.Marshal(e.encode(spans))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// OTLP/JSON payload (opentelemetry-proto, JSON mapping)
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		TraceState        string         `json:"traceState,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Status            otlpStatus     `json:"status"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"` // int64 as decimal string
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+	}
+)
+
+func (e *OTLPExporter) encode(spans []*Span) otlpRequest {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		os := otlpSpan{
+			TraceID:           s.Context.TraceID.String(),
+			SpanID:            s.Context.SpanID.String(),
+			TraceState:        s.Context.TraceState,
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Status:            otlpStatus{Code: s.Status, Message: s.StatusMsg},
+		}
+		if s.Parent.IsValid() {
+			os.ParentSpanID = s.Parent.String()
+		}
+		for _, a := range s.Attributes() {
+			os.Attributes = append(os.Attributes, keyValue(a))
+		}
+		out = append(out, os)
+	}
+
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{
+			keyValue(String("service.name", e.serviceName)),
+		}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "hoplb"},
+			Spans: out,
+		}},
+	}}}
+}
+
+func keyValue(a Attribute) otlpKeyValue {
+	kv := otlpKeyValue{Key: a.Key}
+	switch v := a.Value.(type) {
+	case string:
+		kv.Value.StringValue = &v
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		kv.Value.IntValue = &s
+	case float64:
+		kv.Value.DoubleValue = &v
+	case bool:
+		kv.Value.BoolValue = &v
+	default:
+		s := fmt.Sprint(v)
+		kv.Value.StringValue = &s
+	}
+	return kv
+}
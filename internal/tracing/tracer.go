@@ -0,0 +1,164 @@
+// Package tracing is a small OpenTelemetry-compatible tracer for proxied
+// requests: W3C Trace Context propagation, ratio sampling with optional
+// tail-keeping of errors, and export over OTLP/HTTP.
+package tracing
+
+import (
+	"encoding/binary"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Span kinds (OTLP values)
+const (
+	KindServer = 2
+	KindClient = 3
+)
+
+// Status codes (OTLP values)
+const (
+	StatusUnset = 0
+	StatusOK    = 1
+	StatusError = 2
+)
+
+// Exporter receives finished spans that were kept
+type Exporter interface {
+	Export(*Span)
+}
+
+// Tracer creates spans and hands kept ones to an exporter
+type Tracer struct {
+	exporter Exporter
+
+	// SampleRatio is the fraction (0.0-1.0) of new traces to sample.
+	// Incoming sampled/unsampled decisions from a traceparent are honoured.
+	SampleRatio float64
+
+	// KeepErrors exports unsampled spans that end with an error status,
+	// so failures are visible even at low sample ratios.
+	KeepErrors bool
+}
+
+// NewTracer creates a tracer exporting to e, sampling every new trace
+func NewTracer(e Exporter) *Tracer {
+	return &Tracer{exporter: e, SampleRatio: 1}
+}
+
+// Span is one timed operation. Attributes and status may be set until End.
+type Span struct {
+	Name      string
+	Kind      int
+	Context   SpanContext
+	Parent    SpanID // zero for a root span
+	Start     time.Time
+	End       time.Time
+	Status    int
+	StatusMsg string
+
+	mu    sync.Mutex
+	attrs []Attribute
+	ended bool
+
+	tracer *Tracer
+}
+
+// Attribute is a key/value pair on a span. Value is a string, int64,
+// float64 or bool.
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+// StartServer starts a server span for an incoming request, continuing the
+// trace from its traceparent header if present
+func (t *Tracer) StartServer(r *http.Request, name string) *Span {
+	parent, ok := Extract(r.Header)
+
+	s := &Span{
+		Name:   name,
+		Kind:   KindServer,
+		Start:  time.Now(),
+		tracer: t,
+	}
+	if ok {
+		s.Parent = parent.SpanID
+		s.Context = SpanContext{
+			TraceID:    parent.TraceID,
+			SpanID:     newSpanID(),
+			Sampled:    parent.Sampled,
+			TraceState: parent.TraceState,
+		}
+	} else {
+		traceID := newTraceID()
+		s.Context = SpanContext{
+			TraceID: traceID,
+			SpanID:  newSpanID(),
+			Sampled: t.sample(traceID),
+		}
+	}
+	return s
+}
+
+// sample makes a deterministic head decision from the trace ID, like the
+// OpenTelemetry TraceIDRatioBased sampler
+func (t *Tracer) sample(id TraceID) bool {
+	if t.SampleRatio >= 1 {
+		return true
+	}
+	if t.SampleRatio <= 0 {
+		return false
+	}
+	bound := uint64(t.SampleRatio * (1 << 63))
+	return binary.BigEndian.Uint64(id[8:])>>1 < bound
+}
+
+// SetAttributes adds attributes to the span
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	s.mu.Lock()
+	s.attrs = append(s.attrs, attrs...)
+	s.mu.Unlock()
+}
+
+// SetStatus sets the span status (StatusOK, StatusError) and message
+func (s *Span) SetStatus(code int, msg string) {
+	s.mu.Lock()
+	s.Status = code
+	s.StatusMsg = msg
+	s.mu.Unlock()
+}
+
+// Attributes returns a copy of the span's attributes
+func (s *Span) Attributes() []Attribute {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Attribute(nil), s.attrs...)
+}
+
+// Finish ends the span and exports it if sampled, or if it failed and the
+// tracer keeps errors. Later calls are no-ops.
+func (s *Span) Finish() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	keep := s.Context.Sampled || (s.tracer.KeepErrors && s.Status == StatusError)
+	s.mu.Unlock()
+
+	if keep && s.tracer.exporter != nil {
+		s.tracer.exporter.Export(s)
+	}
+}
+
+// String returns a string attribute
+func String(key, value string) Attribute { return Attribute{Key: key, Value: value} }
+
+// Int returns an integer attribute
+func Int(key string, value int) Attribute { return Attribute{Key: key, Value: int64(value)} }
+
+// Bool returns a boolean attribute
+func Bool(key string, value bool) Attribute { return Attribute{Key: key, Value: value} }
@@ -0,0 +1,162 @@
+package tracing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		in      string
+		ok      bool
+		sampled bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true, true}, // future version
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false}, // zero trace ID
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false}, // zero span ID
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false, false}, // uppercase
+		{"garbage", false, false},
+		{"", false, false},
+	}
+
+	for _, tt := range tests {
+		sc, ok := ParseTraceparent(tt.in)
+		if ok != tt.ok || sc.Sampled != tt.sampled {
+			t.Errorf("ParseTraceparent(%q) = ok %v sampled %v; want ok %v sampled %v", tt.in, ok, sc.Sampled, tt.ok, tt.sampled)
+		}
+		if ok && tt.in[:2] == "00" && sc.Traceparent() != tt.in {
+			t.Errorf("Traceparent() = %q; want round trip of %q", sc.Traceparent(), tt.in)
+		}
+	}
+}
+
+// recorder collects exported spans
+type recorder struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (r *recorder) Export(s *Span) {
+	r.mu.Lock()
+	r.spans = append(r.spans, s)
+	r.mu.Unlock()
+}
+
+func TestTracerContinuesTrace(t *testing.T) {
+	rec := &recorder{}
+	tracer := NewTracer(rec)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set(TracestateHeader, "vendor=abc")
+
+	span := tracer.StartServer(req, "GET")
+	if span.Context.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("trace ID = %s; want the incoming one", span.Context.TraceID)
+	}
+	if span.Parent.String() != "00f067aa0ba902b7" {
+		t.Errorf("parent = %s; want the incoming span ID", span.Parent)
+	}
+	if span.Context.SpanID.String() == "00f067aa0ba902b7" {
+		t.Errorf("server span must get its own span ID")
+	}
+
+	h := http.Header{}
+	Inject(h, span.Context)
+	if h.Get(TracestateHeader) != "vendor=abc" {
+		t.Errorf("tracestate = %q; want it passed through", h.Get(TracestateHeader))
+	}
+
+	span.Finish()
+	span.Finish() // second call is a no-op
+	if len(rec.spans) != 1 {
+		t.Errorf("exported %d spans; want 1", len(rec.spans))
+	}
+}
+
+func TestTracerSampling(t *testing.T) {
+	rec := &recorder{}
+	tracer := NewTracer(rec)
+	tracer.SampleRatio = 0
+	tracer.KeepErrors = true
+
+	// Unsampled successful span is dropped
+	ok := tracer.StartServer(httptest.NewRequest("GET", "/", nil), "GET")
+	ok.SetStatus(StatusOK, "")
+	ok.Finish()
+
+	// Unsampled failed span is kept
+	failed := tracer.StartServer(httptest.NewRequest("GET", "/", nil), "GET")
+	failed.SetStatus(StatusError, "backend error")
+	failed.Finish()
+
+	if len(rec.spans) != 1 || rec.spans[0] != failed {
+		t.Fatalf("exported %d spans; want only the failed one", len(rec.spans))
+	}
+	if failed.Context.Sampled {
+		t.Errorf("tail-kept span must not be marked sampled for propagation")
+	}
+
+	// Ratio sampling is roughly proportional
+	tracer.SampleRatio = 0.25
+	sampled := 0
+	for i := 0; i < 4000; i++ {
+		if tracer.StartServer(httptest.NewRequest("GET", "/", nil), "GET").Context.Sampled {
+			sampled++
+		}
+	}
+	if sampled < 800 || sampled > 1200 {
+		t.Errorf("sampled %d of 4000 at ratio 0.25; want ~1000", sampled)
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var mu sync.Mutex
+	var got []otlpRequest
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected export request %s %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode: %v", err)
+		}
+		mu.Lock()
+		got = append(got, req)
+		mu.Unlock()
+	}))
+	defer collector.Close()
+
+	exporter := NewOTLPExporter(collector.URL, "hoplb-test")
+	tracer := NewTracer(exporter)
+
+	span := tracer.StartServer(httptest.NewRequest("GET", "/", nil), "GET api.example.com")
+	span.SetAttributes(String("hoplb.route", "api.example.com"), Int("http.response.status_code", 502))
+	span.SetStatus(StatusError, "backend error")
+	span.Finish()
+	exporter.Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 1 || len(got[0].ResourceSpans) != 1 {
+		t.Fatalf("collector got %d exports; want 1", len(got))
+	}
+	rs := got[0].ResourceSpans[0]
+	if v := rs.Resource.Attributes[0].Value.StringValue; v == nil || *v != "hoplb-test" {
+		t.Errorf("service.name not set")
+	}
+	s := rs.ScopeSpans[0].Spans[0]
+	if s.TraceID != span.Context.TraceID.String() || s.Kind != KindServer || s.Status.Code != StatusError {
+		t.Errorf("span = %+v; want server span with error status", s)
+	}
+	if len(s.Attributes) != 2 || *s.Attributes[1].Value.IntValue != "502" {
+		t.Errorf("attributes = %+v; want route and status code", s.Attributes)
+	}
+}